@@ -0,0 +1,190 @@
+package main
+
+import "fmt"
+
+// RangeScanner - необязательная возможность движка: обход пар ключ-значение
+// диапазона по возрастанию ключа без повторного поиска каждого ключа.
+type RangeScanner interface {
+	ScanRange(minValue, maxValue string, fn func(key string, value interface{}) bool)
+}
+
+// RangeBounds - необязательная возможность движка: первый и последний ключ
+// диапазона без обхода остальных ключей.
+type RangeBounds interface {
+	FirstKey(minValue, maxValue string) (string, bool)
+	LastKey(minValue, maxValue string) (string, bool)
+}
+
+// RangeCounter - необязательная возможность движка: число ключей диапазона
+// без их перечисления.
+type RangeCounter interface {
+	CountRange(minValue, maxValue string) int
+}
+
+const (
+	AggregateCount = "count"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateSum   = "sum"
+	AggregateAvg   = "avg"
+)
+
+// AggregateResult - значение агрегата и число учтенных ключей.
+type AggregateResult struct {
+	Func  string      `json:"func"`
+	Field string      `json:"field,omitempty"`
+	Count int         `json:"count"`
+	Value interface{} `json:"value"`
+}
+
+// scanRange обходит диапазон по возрастанию ключа, отдавая значения в
+// текущей версии схемы. Для движков без RangeScanner ключи берутся из
+// GetRange. Вызывается под блокировкой коллекции.
+func (tc *TreeCollection) scanRange(minValue, maxValue string, fn func(key string, value interface{}) bool) error {
+	if scanner, ok := tc.Tree.(RangeScanner); ok {
+		scanner.ScanRange(minValue, maxValue, func(key string, value interface{}) bool {
+			if tc.expired(key) {
+				return true
+			}
+			return fn(key, tc.upgrade(key, value))
+		})
+		return nil
+	}
+	keys, err := tc.Tree.GetRange(minValue, maxValue)
+	if err != nil {
+		return err
+	}
+	tc.collation.Sort(keys)
+	for _, key := range keys {
+		if tc.expired(key) {
+			continue
+		}
+		value, err := tc.stored(key)
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// countRange считает ключи диапазона наиболее дешевым способом, который
+// поддерживает движок. Счетчики движков учитывают и ключи с истекшим сроком
+// жизни, поэтому перед подсчетом их нужно удалить через PurgeExpired.
+func (tc *TreeCollection) countRange(minValue, maxValue string) (int, error) {
+	if counter, ok := tc.Tree.(RangeCounter); ok {
+		return counter.CountRange(minValue, maxValue), nil
+	}
+	if scanner, ok := tc.Tree.(RangeScanner); ok {
+		count := 0
+		scanner.ScanRange(minValue, maxValue, func(string, interface{}) bool {
+			count++
+			return true
+		})
+		return count, nil
+	}
+	keys, err := tc.Tree.GetRange(minValue, maxValue)
+	return len(keys), err
+}
+
+// keyBound возвращает первый (first) или последний ключ диапазона.
+func (tc *TreeCollection) keyBound(minValue, maxValue string, first bool) (string, bool, error) {
+	if bounds, ok := tc.Tree.(RangeBounds); ok {
+		if first {
+			key, found := bounds.FirstKey(minValue, maxValue)
+			return key, found, nil
+		}
+		key, found := bounds.LastKey(minValue, maxValue)
+		return key, found, nil
+	}
+	keys, err := tc.Tree.GetRange(minValue, maxValue)
+	if err != nil || len(keys) == 0 {
+		return "", false, err
+	}
+	tc.collation.Sort(keys)
+	if first {
+		return keys[0], true, nil
+	}
+	return keys[len(keys)-1], true, nil
+}
+
+// Aggregate вычисляет count, min, max, sum или avg по ключам диапазона
+// [minValue, maxValue]. Без поля count, min и max считаются по ключам, а sum
+// и avg - по самим значениям. С полем учитываются только числовые значения
+// поля; ключи без него пропускаются.
+func (tc *TreeCollection) Aggregate(fn, field, minValue, maxValue string) (*AggregateResult, error) {
+	switch fn {
+	case AggregateCount, AggregateMin, AggregateMax, AggregateSum, AggregateAvg:
+	default:
+		return nil, fmt.Errorf("неизвестная агрегатная функция: %s", fn)
+	}
+	tc.PurgeExpired()
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	result := &AggregateResult{Func: fn, Field: field}
+
+	if field == "" {
+		switch fn {
+		case AggregateCount:
+			count, err := tc.countRange(minValue, maxValue)
+			result.Count, result.Value = count, count
+			return result, err
+		case AggregateMin, AggregateMax:
+			key, found, err := tc.keyBound(minValue, maxValue, fn == AggregateMin)
+			if err != nil || !found {
+				return result, err
+			}
+			count, err := tc.countRange(minValue, maxValue)
+			result.Count, result.Value = count, key
+			return result, err
+		}
+	}
+
+	var sum, best float64
+	// в мультиотображении учитывается каждое значение списка ключа
+	err := tc.scanRange(minValue, maxValue, func(key string, stored interface{}) bool {
+		for _, value := range tc.elements(stored) {
+			if field != "" {
+				var ok bool
+				if value, ok = fieldValue(value, field); !ok || value == nil {
+					continue
+				}
+			}
+			if fn == AggregateCount {
+				result.Count++
+				continue
+			}
+			number, ok := toFloat(value)
+			if !ok {
+				continue
+			}
+			if result.Count == 0 || (fn == AggregateMin && number < best) || (fn == AggregateMax && number > best) {
+				best = number
+			}
+			sum += number
+			result.Count++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch fn {
+	case AggregateCount:
+		result.Value = result.Count
+	case AggregateSum:
+		result.Value = sum
+	case AggregateMin, AggregateMax:
+		if result.Count > 0 {
+			result.Value = best
+		}
+	case AggregateAvg:
+		if result.Count > 0 {
+			result.Value = sum / float64(result.Count)
+		}
+	}
+	return result, nil
+}
@@ -10,12 +10,15 @@ type Node struct {
 	key    string
 	value  interface{}
 	height int
+	size   int // число узлов в поддереве
 	left   *Node
 	right  *Node
 }
 
 type AVLTree struct {
-	root *Node
+	root      *Node
+	collation *Collation
+	keyVersions
 }
 
 func NewAVLTree() *AVLTree {
@@ -23,13 +26,17 @@ func NewAVLTree() *AVLTree {
 }
 
 func (avl *AVLTree) Insert(key string, value interface{}) error {
-	var err error
-	avl.root, err = insert(avl.root, key, value)
-	return err
+	root, err := insert(avl.root, key, value, avl.collation)
+	if err != nil {
+		return err
+	}
+	avl.root = root
+	avl.bump(key)
+	return nil
 }
 
 func (avl *AVLTree) Get(key string) (interface{}, error) {
-	node, err := getNode(avl.root, key)
+	node, err := getNode(avl.root, key, avl.collation)
 	if err != nil {
 		return nil, err
 	}
@@ -43,13 +50,13 @@ func (avl *AVLTree) GetRange(minValue, maxValue string) ([]string, error) {
 		if node == nil {
 			return
 		}
-		if node.key >= minValue {
+		if avl.collation.compareBound(node.key, minValue) >= 0 {
 			getRangeHelper(node.left, minValue, maxValue)
 		}
-		if node.key >= minValue && node.key <= maxValue {
+		if avl.collation.inRange(node.key, minValue, maxValue) {
 			result = append(result, node.key)
 		}
-		if node.key <= maxValue {
+		if avl.collation.compareBound(node.key, maxValue) <= 0 {
 			getRangeHelper(node.right, minValue, maxValue)
 		}
 	}
@@ -58,34 +65,41 @@ func (avl *AVLTree) GetRange(minValue, maxValue string) ([]string, error) {
 }
 
 func (avl *AVLTree) Update(key string, value interface{}) error {
-	node, err := getNode(avl.root, key)
+	node, err := getNode(avl.root, key, avl.collation)
 	if err != nil {
 		return err
 	}
 	node.value = value
+	avl.bump(key)
 	return nil
 }
 
 func (avl *AVLTree) Remove(key string) error {
-	var err error
-	avl.root, err = deleteNode(avl.root, key)
-	return err
-}
-
-func (avl *AVLTree) SaveToFile(filename string) error {
-	data, err := json.Marshal(avl)
+	root, err := deleteNode(avl.root, key, avl.collation)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filename, data, 0644)
+	avl.root = root
+	avl.forget(key)
+	return nil
+}
+
+func (avl *AVLTree) GetVersioned(key string) (interface{}, uint64, error) {
+	return getVersioned(avl, key)
+}
+
+func (avl *AVLTree) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return compareAndSet(avl, key, expectedVersion, value)
+}
+
+// SaveToFile сохраняет пары в порядке ключей; LoadFromFile строит из них
+// дерево заново.
+func (avl *AVLTree) SaveToFile(filename string) error {
+	return saveEntries(filename, avl)
 }
 
 func (avl *AVLTree) LoadFromFile(filename string) error {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, avl)
+	return loadEntries(filename, avl)
 }
 
 func height(node *Node) int {
@@ -95,6 +109,19 @@ func height(node *Node) int {
 	return node.height
 }
 
+func nodeSize(node *Node) int {
+	if node == nil {
+		return 0
+	}
+	return node.size
+}
+
+// updateNode пересчитывает высоту и размер узла по его потомкам
+func updateNode(node *Node) {
+	node.height = max(height(node.left), height(node.right)) + 1
+	node.size = nodeSize(node.left) + nodeSize(node.right) + 1
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
@@ -111,9 +138,9 @@ func rightRotate(y *Node) *Node {
 	x.right = y
 	y.left = T2
 
-	// Обновляем высоты
-	y.height = max(height(y.left), height(y.right)) + 1
-	x.height = max(height(x.left), height(x.right)) + 1
+	// Обновляем высоты и размеры
+	updateNode(y)
+	updateNode(x)
 
 	// Возвращаем новый корень
 	return x
@@ -128,9 +155,9 @@ func leftRotate(x *Node) *Node {
 	y.left = x
 	x.right = T2
 
-	// Обновляем высоты
-	x.height = max(height(x.left), height(x.right)) + 1
-	y.height = max(height(y.left), height(y.right)) + 1
+	// Обновляем высоты и размеры
+	updateNode(x)
+	updateNode(y)
 
 	// Возвращаем новый корень
 	return y
@@ -144,45 +171,45 @@ func getBalance(node *Node) int {
 	return height(node.left) - height(node.right)
 }
 
-func insert(node *Node, key string, value interface{}) (*Node, error) {
+func insert(node *Node, key string, value interface{}, c *Collation) (*Node, error) {
 	if node == nil {
-		return &Node{key: key, value: value, height: 1}, nil
+		return &Node{key: key, value: value, height: 1, size: 1}, nil
 	}
 
-	if key < node.key {
-		var err error
-		node.left, err = insert(node.left, key, value)
+	if c.Compare(key, node.key) < 0 {
+		child, err := insert(node.left, key, value, c)
 		if err != nil {
 			return nil, err
 		}
-	} else if key > node.key {
-		var err error
-		node.right, err = insert(node.right, key, value)
+		node.left = child
+	} else if c.Compare(key, node.key) > 0 {
+		child, err := insert(node.right, key, value, c)
 		if err != nil {
 			return nil, err
 		}
+		node.right = child
 	} else {
 		return nil, errors.New("Элемент с таким ключом уже существует!")
 	}
 
-	node.height = 1 + max(height(node.left), height(node.right))
+	updateNode(node)
 
 	balance := getBalance(node)
 
-	if balance > 1 && key < node.left.key {
+	if balance > 1 && c.Compare(key, node.left.key) < 0 {
 		return rightRotate(node), nil
 	}
 
-	if balance < -1 && key > node.right.key {
+	if balance < -1 && c.Compare(key, node.right.key) > 0 {
 		return leftRotate(node), nil
 	}
 
-	if balance > 1 && key > node.left.key {
+	if balance > 1 && c.Compare(key, node.left.key) > 0 {
 		node.left = leftRotate(node.left)
 		return rightRotate(node), nil
 	}
 
-	if balance < -1 && key < node.right.key {
+	if balance < -1 && c.Compare(key, node.right.key) < 0 {
 		node.right = rightRotate(node.right)
 		return leftRotate(node), nil
 	}
@@ -198,23 +225,23 @@ func minValueNode(node *Node) *Node {
 	return current
 }
 
-func deleteNode(root *Node, key string) (*Node, error) {
+func deleteNode(root *Node, key string, c *Collation) (*Node, error) {
 	if root == nil {
 		return root, errors.New("Элемент не найден!")
 	}
 
-	if key < root.key {
-		var err error
-		root.left, err = deleteNode(root.left, key)
+	if c.Compare(key, root.key) < 0 {
+		child, err := deleteNode(root.left, key, c)
 		if err != nil {
 			return nil, err
 		}
-	} else if key > root.key {
-		var err error
-		root.right, err = deleteNode(root.right, key)
+		root.left = child
+	} else if c.Compare(key, root.key) > 0 {
+		child, err := deleteNode(root.right, key, c)
 		if err != nil {
 			return nil, err
 		}
+		root.right = child
 	} else {
 		if (root.left == nil) || (root.right == nil) {
 			var temp *Node
@@ -234,11 +261,11 @@ func deleteNode(root *Node, key string) (*Node, error) {
 			temp := minValueNode(root.right)
 			root.key = temp.key
 			root.value = temp.value
-			var err error
-			root.right, err = deleteNode(root.right, temp.key)
+			child, err := deleteNode(root.right, temp.key, c)
 			if err != nil {
 				return nil, err
 			}
+			root.right = child
 		}
 	}
 
@@ -246,7 +273,7 @@ func deleteNode(root *Node, key string) (*Node, error) {
 		return root, nil
 	}
 
-	root.height = max(height(root.left), height(root.right)) + 1
+	updateNode(root)
 
 	balance := getBalance(root)
 
@@ -271,15 +298,15 @@ func deleteNode(root *Node, key string) (*Node, error) {
 	return root, nil
 }
 
-func getNode(node *Node, key string) (*Node, error) {
+func getNode(node *Node, key string, c *Collation) (*Node, error) {
 	if node == nil {
 		return nil, errors.New("Элемент не найден!")
 	}
 
-	if key < node.key {
-		return getNode(node.left, key)
-	} else if key > node.key {
-		return getNode(node.right, key)
+	if c.Compare(key, node.key) < 0 {
+		return getNode(node.left, key, c)
+	} else if c.Compare(key, node.key) > 0 {
+		return getNode(node.right, key, c)
 	} else {
 		return node, nil
 	}
@@ -296,13 +323,16 @@ func NewAVLCollection() *AVLCollection {
 }
 
 func (avl *AVLCollection) Insert(key string, value interface{}) error {
-	var err error
-	avl.tree.root, err = insert(avl.tree.root, key, value)
-	return err
+	root, err := insert(avl.tree.root, key, value, nil)
+	if err != nil {
+		return err
+	}
+	avl.tree.root = root
+	return nil
 }
 
 func (avl *AVLCollection) Get(key string) (interface{}, error) {
-	node, err := getNode(avl.tree.root, key)
+	node, err := getNode(avl.tree.root, key, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -331,7 +361,7 @@ func (avl *AVLCollection) GetRange(minValue, maxValue string) ([]string, error)
 }
 
 func (avl *AVLCollection) Update(key string, value interface{}) error {
-	node, err := getNode(avl.tree.root, key)
+	node, err := getNode(avl.tree.root, key, nil)
 	if err != nil {
 		return err
 	}
@@ -340,9 +370,12 @@ func (avl *AVLCollection) Update(key string, value interface{}) error {
 }
 
 func (avl *AVLCollection) Remove(key string) error {
-	var err error
-	avl.tree.root, err = deleteNode(avl.tree.root, key)
-	return err
+	root, err := deleteNode(avl.tree.root, key, nil)
+	if err != nil {
+		return err
+	}
+	avl.tree.root = root
+	return nil
 }
 
 func (avl *AVLCollection) SaveToFile(filename string) error {
@@ -360,3 +393,128 @@ func (avl *AVLCollection) LoadFromFile(filename string) error {
 	}
 	return json.Unmarshal(data, avl)
 }
+
+// FirstKey возвращает наименьший ключ диапазона спуском по дереву
+func (avl *AVLTree) FirstKey(minValue, maxValue string) (string, bool) {
+	var best *Node
+	for node := avl.root; node != nil; {
+		if avl.collation.compareBound(node.key, minValue) >= 0 {
+			best = node
+			node = node.left
+		} else {
+			node = node.right
+		}
+	}
+	if best == nil || avl.collation.compareBound(best.key, maxValue) > 0 {
+		return "", false
+	}
+	return best.key, true
+}
+
+// LastKey возвращает наибольший ключ диапазона спуском по дереву
+func (avl *AVLTree) LastKey(minValue, maxValue string) (string, bool) {
+	var best *Node
+	for node := avl.root; node != nil; {
+		if avl.collation.compareBound(node.key, maxValue) <= 0 {
+			best = node
+			node = node.right
+		} else {
+			node = node.left
+		}
+	}
+	if best == nil || avl.collation.compareBound(best.key, minValue) < 0 {
+		return "", false
+	}
+	return best.key, true
+}
+
+// ScanRange обходит пары ключ-значение диапазона по возрастанию ключа, пока
+// fn возвращает true
+func (avl *AVLTree) ScanRange(minValue, maxValue string, fn func(key string, value interface{}) bool) {
+	var scan func(node *Node) bool
+	scan = func(node *Node) bool {
+		if node == nil {
+			return true
+		}
+		if avl.collation.compareBound(node.key, minValue) >= 0 && !scan(node.left) {
+			return false
+		}
+		if avl.collation.inRange(node.key, minValue, maxValue) && !fn(node.key, node.value) {
+			return false
+		}
+		if avl.collation.compareBound(node.key, maxValue) <= 0 {
+			return scan(node.right)
+		}
+		return true
+	}
+	scan(avl.root)
+}
+
+// countBefore возвращает число ключей меньше key, а при inclusive - не
+// больше key; compare - полное сравнение ключей или сравнение с границей
+// диапазона
+func (avl *AVLTree) countBefore(key string, inclusive bool, compare func(a, b string) int) int {
+	count := 0
+	for node := avl.root; node != nil; {
+		if c := compare(node.key, key); c < 0 || (inclusive && c == 0) {
+			count += nodeSize(node.left) + 1
+			node = node.right
+		} else {
+			node = node.left
+		}
+	}
+	return count
+}
+
+// Rank возвращает число ключей меньше key
+func (avl *AVLTree) Rank(key string) int {
+	return avl.countBefore(key, false, avl.collation.Compare)
+}
+
+// Select возвращает k-й по возрастанию ключ (с нуля)
+func (avl *AVLTree) Select(k int) (string, bool) {
+	for node := avl.root; node != nil; {
+		leftSize := nodeSize(node.left)
+		switch {
+		case k < leftSize:
+			node = node.left
+		case k == leftSize:
+			return node.key, true
+		default:
+			k -= leftSize + 1
+			node = node.right
+		}
+	}
+	return "", false
+}
+
+// CountRange возвращает число ключей диапазона по размерам поддеревьев
+func (avl *AVLTree) CountRange(minValue, maxValue string) int {
+	if avl.collation.compareBound(minValue, maxValue) > 0 {
+		return 0
+	}
+	return avl.countBefore(maxValue, true, avl.collation.compareBound) - avl.countBefore(minValue, false, avl.collation.compareBound)
+}
+
+// BulkLoad заменяет содержимое дерева ключами keys, отсортированными по
+// возрастанию, и строит идеально сбалансированное дерево за O(n) без
+// поворотов.
+func (avl *AVLTree) BulkLoad(keys []string, values []interface{}) {
+	avl.root = buildAVL(keys, values)
+	avl.reset(keys)
+}
+
+func buildAVL(keys []string, values []interface{}) *Node {
+	if len(keys) == 0 {
+		return nil
+	}
+	mid := len(keys) / 2
+	node := &Node{
+		key:   keys[mid],
+		value: values[mid],
+		left:  buildAVL(keys[:mid], values[:mid]),
+		right: buildAVL(keys[mid+1:], values[mid+1:]),
+	}
+	updateNode(node)
+	return node
+}
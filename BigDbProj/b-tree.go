@@ -1,128 +1,169 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"sort"
 )
 
-const m = 2
+// defaultBTreeDegree - минимальная степень B-дерева по умолчанию: узел
+// хранит от degree-1 до 2*degree-1 ключей.
+const defaultBTreeDegree = 2
 
 type NodeB struct {
 	keys     []string
+	values   []interface{}
 	children []*NodeB
 	leaf     bool
-	value    interface{}
+	size     int // число ключей в поддереве
+}
+
+// recount пересчитывает размер узла по его ключам и потомкам
+func (n *NodeB) recount() {
+	n.size = len(n.keys)
+	for _, child := range n.children {
+		n.size += child.size
+	}
 }
 
 type BTree struct {
-	root *NodeB
+	root      *NodeB
+	degree    int
+	collation *Collation
+	keyVersions
 }
 
-func NewNodeB(leaf bool, value interface{}) *NodeB {
+func NewNodeB(leaf bool) *NodeB {
 	return &NodeB{
 		keys:     make([]string, 0),
+		values:   make([]interface{}, 0),
 		children: make([]*NodeB, 0),
 		leaf:     leaf,
-		value:    value,
 	}
 }
 
 func NewBTree() *BTree {
+	return NewBTreeWithDegree(defaultBTreeDegree)
+}
+
+func NewBTreeWithDegree(degree int) *BTree {
 	return &BTree{
-		root: NewNodeB(true, nil),
+		root:   NewNodeB(true),
+		degree: degree,
 	}
 }
 
 func (t *BTree) Insert(key string, value interface{}) error {
+	if t.Search(key) != nil {
+		return fmt.Errorf("Элемент с таким ключом уже существует!")
+	}
 	root := t.root
-	if len(root.keys) == (2*m - 1) { //2*t - 1
-		newRoot := NewNodeB(false, nil)
+	if len(root.keys) == (2*t.degree - 1) {
+		newRoot := NewNodeB(false)
 		newRoot.children = append(newRoot.children, root)
 		t.root = newRoot
-		t.splitChild(0)
-		t.insertNonFull(newRoot, key)
+		t.splitChild(newRoot, 0)
+		newRoot.recount()
+		t.insertNonFull(newRoot, key, value)
 	} else {
-		t.insertNonFull(root, key)
+		t.insertNonFull(root, key, value)
 	}
+	t.bump(key)
 	return nil
 }
 
-func (t *BTree) splitChild(i int) {
-	child := t.root.children[i]
-	newChild := NewNodeB(child.leaf, nil)
+// splitChild делит заполненного i-го потомка узла parent пополам,
+// поднимая средний ключ в parent
+func (t *BTree) splitChild(parent *NodeB, i int) {
+	child := parent.children[i]
+	newChild := NewNodeB(child.leaf)
 	mid := len(child.keys) / 2
-	splitKey := child.keys[mid]
+	splitKey, splitValue := child.keys[mid], child.values[mid]
 
-	t.root.children = append(t.root.children[:i+1], nil)
-	copy(t.root.children[i+2:], t.root.children[i+1:])
-	t.root.children[i+1] = newChild
+	parent.children = append(parent.children, nil)
+	copy(parent.children[i+2:], parent.children[i+1:])
+	parent.children[i+1] = newChild
 
 	newChild.keys = append(newChild.keys, child.keys[mid+1:]...)
+	newChild.values = append(newChild.values, child.values[mid+1:]...)
 	child.keys = child.keys[:mid]
+	child.values = child.values[:mid]
 
 	if !child.leaf {
 		newChild.children = append(newChild.children, child.children[mid+1:]...)
 		child.children = child.children[:mid+1]
 	}
 
-	t.root.keys = append(t.root.keys[:i], append([]string{splitKey}, t.root.keys[i:]...)...)
+	parent.keys = append(parent.keys[:i], append([]string{splitKey}, parent.keys[i:]...)...)
+	parent.values = append(parent.values[:i], append([]interface{}{splitValue}, parent.values[i:]...)...)
+	// размер parent не меняется: ключи только перераспределены
+	child.recount()
+	newChild.recount()
 }
 
-func (t *BTree) insertNonFull(node *NodeB, key string) {
+func (t *BTree) insertNonFull(node *NodeB, key string, value interface{}) {
+	// ключ новый (проверено в Insert), поэтому каждый узел пути растет на 1
+	node.size++
 	i := len(node.keys) - 1
 	if node.leaf {
-		for i >= 0 && key < node.keys[i] {
+		for i >= 0 && t.collation.Compare(key, node.keys[i]) < 0 {
 			i--
 		}
 		node.keys = append(node.keys[:i+1], append([]string{key}, node.keys[i+1:]...)...)
+		node.values = append(node.values[:i+1], append([]interface{}{value}, node.values[i+1:]...)...)
 	} else {
-		for i >= 0 && key < node.keys[i] {
+		for i >= 0 && t.collation.Compare(key, node.keys[i]) < 0 {
 			i--
 		}
 		i++
-		if len(node.children[i].keys) == (2*m - 1) {
-			t.splitChild(i)
-			if key > node.keys[i] {
+		if len(node.children[i].keys) == (2*t.degree - 1) {
+			t.splitChild(node, i)
+			if t.collation.Compare(key, node.keys[i]) > 0 {
 				i++
 			}
 		}
-		t.insertNonFull(node.children[i], key)
+		t.insertNonFull(node.children[i], key, value)
 	}
 }
 
 func (t *BTree) Search(key string) *NodeB {
-	return t.search(t.root, key)
+	node, _ := t.search(t.root, key)
+	return node
 }
 
-func (t *BTree) search(node *NodeB, key string) *NodeB {
+// search возвращает узел, содержащий key, и позицию ключа в нем
+func (t *BTree) search(node *NodeB, key string) (*NodeB, int) {
 	if node == nil {
-		return nil
+		return nil, -1
 	}
 	i := 0
-	for i < len(node.keys) && key > node.keys[i] {
+	for i < len(node.keys) && t.collation.Compare(key, node.keys[i]) > 0 {
 		i++
 	}
 	if i < len(node.keys) && key == node.keys[i] {
-		return node
+		return node, i
 	}
 	if node.leaf {
-		return nil
+		return nil, -1
 	}
 	return t.search(node.children[i], key)
 }
 
 func (t *BTree) Remove(key string) error {
-	t.root = t.delete(t.root, key)
-	if len(t.root.keys) == 0 && len(t.root.children) == 1 {
+	if t.Search(key) == nil {
+		return fmt.Errorf("key not found")
+	}
+	t.delete(t.root, key)
+	if len(t.root.keys) == 0 && !t.root.leaf {
 		t.root = t.root.children[0]
 	}
+	t.forget(key)
 	return nil
 }
 
-func (t *BTree) delete(node *NodeB, key string) *NodeB {
+func (t *BTree) delete(node *NodeB, key string) {
+	defer node.recount()
 	i := 0
-	for i < len(node.keys) && key > node.keys[i] {
+	for i < len(node.keys) && t.collation.Compare(key, node.keys[i]) > 0 {
 		i++
 	}
 	if i < len(node.keys) && key == node.keys[i] {
@@ -131,70 +172,65 @@ func (t *BTree) delete(node *NodeB, key string) *NodeB {
 		} else {
 			t.removeFromNonLeaf(node, i)
 		}
+		return
+	}
+	if node.leaf {
+		fmt.Println("Key", key, "not found")
+		return
+	}
+	flag := i == len(node.keys)
+	if len(node.children[i].keys) < t.degree {
+		t.fill(node, i)
+	}
+	// после слияния последнего потомка с предыдущим ключ ушел в children[i-1]
+	if flag && i > len(node.keys) {
+		t.delete(node.children[i-1], key)
 	} else {
-		if node.leaf {
-			fmt.Println("Key", key, "not found")
-			return node
-		}
-		var flag bool
-		if i == len(node.keys) {
-			flag = true
-		} else {
-			flag = false
-		}
-		if len(node.children[i].keys) < m {
-			t.fill(node, i)
-		}
-		if flag && i > len(node.keys) {
-			node.children[i-1] = t.delete(node.children[i-1], key)
-		} else {
-			node.children[i] = t.delete(node.children[i], key)
-		}
+		t.delete(node.children[i], key)
 	}
-	return node
 }
 
 func (t *BTree) removeFromLeaf(node *NodeB, idx int) {
-	copy(node.keys[idx:], node.keys[idx+1:])
-	node.keys = node.keys[:len(node.keys)-1]
+	node.keys = append(node.keys[:idx], node.keys[idx+1:]...)
+	node.values = append(node.values[:idx], node.values[idx+1:]...)
 }
 
 func (t *BTree) removeFromNonLeaf(node *NodeB, idx int) {
 	key := node.keys[idx]
-	if len(node.children[idx].keys) >= m { //t
-		pred := t.getPred(node, idx)
-		node.keys[idx] = pred
-		t.delete(node.children[idx], pred)
-	} else if len(node.children[idx+1].keys) >= m { //t
-		succ := t.getSucc(node, idx)
-		node.keys[idx] = succ
-		t.delete(node.children[idx+1], succ)
+	if len(node.children[idx].keys) >= t.degree {
+		predKey, predValue := t.getPred(node, idx)
+		node.keys[idx], node.values[idx] = predKey, predValue
+		t.delete(node.children[idx], predKey)
+	} else if len(node.children[idx+1].keys) >= t.degree {
+		succKey, succValue := t.getSucc(node, idx)
+		node.keys[idx], node.values[idx] = succKey, succValue
+		t.delete(node.children[idx+1], succKey)
 	} else {
 		t.merge(node, idx)
 		t.delete(node.children[idx], key)
 	}
 }
 
-func (t *BTree) getPred(node *NodeB, idx int) string {
+func (t *BTree) getPred(node *NodeB, idx int) (string, interface{}) {
 	cur := node.children[idx]
 	for !cur.leaf {
 		cur = cur.children[len(cur.children)-1]
 	}
-	return cur.keys[len(cur.keys)-1]
+	return cur.keys[len(cur.keys)-1], cur.values[len(cur.values)-1]
 }
 
-func (t *BTree) getSucc(node *NodeB, idx int) string {
+func (t *BTree) getSucc(node *NodeB, idx int) (string, interface{}) {
 	cur := node.children[idx+1]
 	for !cur.leaf {
 		cur = cur.children[0]
 	}
-	return cur.keys[0]
+	return cur.keys[0], cur.values[0]
 }
 
 func (t *BTree) fill(node *NodeB, idx int) {
-	if idx != 0 && len(node.children[idx-1].keys) >= m { //t
+	if idx != 0 && len(node.children[idx-1].keys) >= t.degree {
 		t.borrowFromPrev(node, idx)
-	} else if idx != len(node.keys) && len(node.children[idx+1].keys) >= m { //t
+	} else if idx != len(node.keys) && len(node.children[idx+1].keys) >= t.degree {
 		t.borrowFromNext(node, idx)
 	} else {
 		if idx != len(node.keys) {
@@ -209,18 +245,23 @@ func (t *BTree) borrowFromPrev(node *NodeB, idx int) {
 	child := node.children[idx]
 	sibling := node.children[idx-1]
 
-	// Перемещаем ключ из родительского узла в конец child
+	// Перемещаем ключ из родительского узла в начало child
 	child.keys = append([]string{node.keys[idx-1]}, child.keys...)
+	child.values = append([]interface{}{node.values[idx-1]}, child.values...)
 
 	// Если не лист, перемещаем последнего ребенка из sibling в начало child
 	if !child.leaf {
 		child.children = append([]*NodeB{sibling.children[len(sibling.children)-1]}, child.children...)
 	}
-	node.keys[idx-1] = sibling.keys[len(sibling.keys)-1]
-	sibling.keys = sibling.keys[:len(sibling.keys)-1]
+	last := len(sibling.keys) - 1
+	node.keys[idx-1], node.values[idx-1] = sibling.keys[last], sibling.values[last]
+	sibling.keys = sibling.keys[:last]
+	sibling.values = sibling.values[:last]
 	if !sibling.leaf {
 		sibling.children = sibling.children[:len(sibling.children)-1]
 	}
+	child.recount()
+	sibling.recount()
 }
 
 func (t *BTree) borrowFromNext(node *NodeB, idx int) {
@@ -229,16 +270,20 @@ func (t *BTree) borrowFromNext(node *NodeB, idx int) {
 
 	// Перемещаем ключ из родительского узла в конец child
 	child.keys = append(child.keys, node.keys[idx])
+	child.values = append(child.values, node.values[idx])
 
 	// Если не лист, перемещаем первого ребенка из sibling в конец child
 	if !child.leaf {
 		child.children = append(child.children, sibling.children[0])
 	}
-	node.keys[idx] = sibling.keys[0]
+	node.keys[idx], node.values[idx] = sibling.keys[0], sibling.values[0]
 	sibling.keys = sibling.keys[1:]
+	sibling.values = sibling.values[1:]
 	if !sibling.leaf {
 		sibling.children = sibling.children[1:]
 	}
+	child.recount()
+	sibling.recount()
 }
 
 func (t *BTree) merge(node *NodeB, idx int) {
@@ -247,20 +292,24 @@ func (t *BTree) merge(node *NodeB, idx int) {
 
 	child.keys = append(child.keys, node.keys[idx])
 	child.keys = append(child.keys, sibling.keys...)
+	child.values = append(child.values, node.values[idx])
+	child.values = append(child.values, sibling.values...)
 	if !child.leaf {
 		child.children = append(child.children, sibling.children...)
 	}
 
 	node.keys = append(node.keys[:idx], node.keys[idx+1:]...)
+	node.values = append(node.values[:idx], node.values[idx+1:]...)
 	node.children = append(node.children[:idx+1], node.children[idx+2:]...)
+	child.recount()
 }
 
 func (t *BTree) Get(key string) (interface{}, error) {
-	node := t.Search(key)
+	node, i := t.search(t.root, key)
 	if node == nil {
 		return nil, fmt.Errorf("key not found")
 	}
-	return node, nil
+	return node.values[i], nil
 }
 
 func (t *BTree) GetRange(minValue, maxValue string) ([]string, error) {
@@ -275,48 +324,231 @@ func (t *BTree) traverseRange(node *NodeB, minValue, maxValue string, keysInRang
 	}
 
 	i := 0
-	for i < len(node.keys) && node.keys[i] < minValue {
+	for i < len(node.keys) && t.collation.compareBound(node.keys[i], minValue) < 0 {
 		i++
 	}
 
 	for ; i < len(node.keys); i++ {
-		if node.children[i] != nil {
+		if !node.leaf {
 			t.traverseRange(node.children[i], minValue, maxValue, keysInRange)
 		}
-		if node.keys[i] >= minValue && node.keys[i] <= maxValue {
-			*keysInRange = append(*keysInRange, node.keys[i])
-		}
-		if node.keys[i] > maxValue {
-			break
+		if t.collation.compareBound(node.keys[i], maxValue) > 0 {
+			return
 		}
+		*keysInRange = append(*keysInRange, node.keys[i])
 	}
 
-	if node.children[i] != nil {
+	if !node.leaf {
 		t.traverseRange(node.children[i], minValue, maxValue, keysInRange)
 	}
 }
 
 func (t *BTree) Update(key string, value interface{}) error {
-	node := t.Search(key)
+	node, i := t.search(t.root, key)
 	if node == nil {
 		return fmt.Errorf("key not found")
 	}
-	node.value = value
+	node.values[i] = value
+	t.bump(key)
 	return nil
 }
 
+func (t *BTree) GetVersioned(key string) (interface{}, uint64, error) {
+	return getVersioned(t, key)
+}
+
+func (t *BTree) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return compareAndSet(t, key, expectedVersion, value)
+}
+
+// SaveToFile сохраняет пары в порядке ключей; LoadFromFile строит из них
+// дерево заново.
 func (t *BTree) SaveToFile(filename string) error {
-	data, err := json.Marshal(t)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(filename, data, 0644)
+	return saveEntries(filename, t)
 }
 
 func (t *BTree) LoadFromFile(filename string) error {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
+	return loadEntries(filename, t)
+}
+
+// FirstKey возвращает наименьший ключ диапазона, спускаясь по одному пути
+func (t *BTree) FirstKey(minValue, maxValue string) (string, bool) {
+	var first func(node *NodeB) (string, bool)
+	first = func(node *NodeB) (string, bool) {
+		i := t.lowerBound(node, minValue)
+		if !node.leaf {
+			if key, ok := first(node.children[i]); ok {
+				return key, true
+			}
+		}
+		if i < len(node.keys) && t.collation.compareBound(node.keys[i], maxValue) <= 0 {
+			return node.keys[i], true
+		}
+		return "", false
 	}
-	return json.Unmarshal(data, t)
+	return first(t.root)
+}
+
+// LastKey возвращает наибольший ключ диапазона, спускаясь по одному пути
+func (t *BTree) LastKey(minValue, maxValue string) (string, bool) {
+	var last func(node *NodeB) (string, bool)
+	last = func(node *NodeB) (string, bool) {
+		// i - число ключей узла, не превышающих maxValue
+		i := sort.Search(len(node.keys), func(j int) bool { return t.collation.compareBound(node.keys[j], maxValue) > 0 })
+		if !node.leaf {
+			if key, ok := last(node.children[i]); ok {
+				return key, true
+			}
+		}
+		if i > 0 && t.collation.compareBound(node.keys[i-1], minValue) >= 0 {
+			return node.keys[i-1], true
+		}
+		return "", false
+	}
+	return last(t.root)
+}
+
+// lowerBound возвращает позицию первого ключа узла, не меньшего границы
+// minValue
+func (t *BTree) lowerBound(node *NodeB, minValue string) int {
+	return sort.Search(len(node.keys), func(j int) bool { return t.collation.compareBound(node.keys[j], minValue) >= 0 })
+}
+
+// ScanRange обходит пары ключ-значение диапазона по возрастанию ключа, пока
+// fn возвращает true
+func (t *BTree) ScanRange(minValue, maxValue string, fn func(key string, value interface{}) bool) {
+	var scan func(node *NodeB) bool
+	scan = func(node *NodeB) bool {
+		i := t.lowerBound(node, minValue)
+		for ; i < len(node.keys); i++ {
+			if !node.leaf && !scan(node.children[i]) {
+				return false
+			}
+			if t.collation.compareBound(node.keys[i], maxValue) > 0 || !fn(node.keys[i], node.values[i]) {
+				return false
+			}
+		}
+		if !node.leaf {
+			return scan(node.children[i])
+		}
+		return true
+	}
+	scan(t.root)
+}
+
+// countBefore возвращает число ключей меньше key, а при inclusive - не
+// больше key; compare - полное сравнение ключей или сравнение с границей
+// диапазона
+func (t *BTree) countBefore(key string, inclusive bool, compare func(a, b string) int) int {
+	count := 0
+	for node := t.root; ; {
+		i := sort.Search(len(node.keys), func(j int) bool {
+			c := compare(node.keys[j], key)
+			return c > 0 || (!inclusive && c == 0)
+		})
+		count += i
+		if node.leaf {
+			return count
+		}
+		for _, child := range node.children[:i] {
+			count += child.size
+		}
+		node = node.children[i]
+	}
+}
+
+// Rank возвращает число ключей меньше key
+func (t *BTree) Rank(key string) int {
+	return t.countBefore(key, false, t.collation.Compare)
+}
+
+// Select возвращает k-й по возрастанию ключ (с нуля)
+func (t *BTree) Select(k int) (string, bool) {
+	if k < 0 || k >= t.root.size {
+		return "", false
+	}
+	node := t.root
+	for !node.leaf {
+		next := node.children[len(node.keys)]
+		for i, child := range node.children[:len(node.keys)] {
+			if k < child.size {
+				next = child
+				break
+			}
+			k -= child.size
+			if k == 0 {
+				return node.keys[i], true
+			}
+			k--
+		}
+		node = next
+	}
+	return node.keys[k], true
+}
+
+// CountRange возвращает число ключей диапазона по размерам поддеревьев
+func (t *BTree) CountRange(minValue, maxValue string) int {
+	if t.collation.compareBound(minValue, maxValue) > 0 {
+		return 0
+	}
+	return t.countBefore(maxValue, true, t.collation.compareBound) - t.countBefore(minValue, false, t.collation.compareBound)
+}
+
+// BulkLoad заменяет содержимое дерева ключами keys, отсортированными по
+// возрастанию, и строит B-дерево снизу вверх за O(n) без расщеплений: все
+// листья на одной глубине, ключи распределены между потомками поровну.
+func (t *BTree) BulkLoad(keys []string, values []interface{}) {
+	height := 0
+	for t.maxKeys(height) < len(keys) {
+		height++
+	}
+	t.root = t.build(keys, values, height)
+	t.reset(keys)
+}
+
+// maxKeys и minKeys - наибольшее и наименьшее число ключей в некорневом
+// поддереве высоты height.
+func (t *BTree) maxKeys(height int) int {
+	result := 2*t.degree - 1
+	for i := 0; i < height; i++ {
+		result = result*2*t.degree + 2*t.degree - 1
+	}
+	return result
+}
+
+func (t *BTree) minKeys(height int) int {
+	result := t.degree - 1
+	for i := 0; i < height; i++ {
+		result = result*t.degree + t.degree - 1
+	}
+	return result
+}
+
+func (t *BTree) build(keys []string, values []interface{}, height int) *NodeB {
+	node := NewNodeB(height == 0)
+	if height == 0 {
+		node.keys = append(node.keys, keys...)
+		node.values = append(node.values, values...)
+		node.size = len(keys)
+		return node
+	}
+	// наибольшее число потомков, при котором каждый получит не меньше
+	// минимума; n ключей вместе с разделителями делятся на n+1 долю
+	n := len(keys)
+	children := (n + 1) / (t.minKeys(height-1) + 1)
+	if children > 2*t.degree {
+		children = 2 * t.degree
+	}
+	start := 0
+	for i := 0; i < children; i++ {
+		end := (n+1)*(i+1)/children - 1
+		node.children = append(node.children, t.build(keys[start:end], values[start:end], height-1))
+		if i < children-1 {
+			node.keys = append(node.keys, keys[end])
+			node.values = append(node.values, values[end])
+		}
+		start = end + 1
+	}
+	node.recount()
+	return node
 }
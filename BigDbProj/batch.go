@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// BatchOp - вид операции в пакете записи.
+type BatchOp string
+
+const (
+	BatchInsert BatchOp = "insert"
+	BatchUpdate BatchOp = "update"
+	BatchRemove BatchOp = "remove"
+)
+
+// BatchOperation - одна операция пакета; Value не используется для remove.
+type BatchOperation struct {
+	Op    BatchOp     `json:"op"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Batch - операции, которые применяются целиком или не применяются вовсе.
+type Batch []BatchOperation
+
+func insertBatch(entries []KeyValue) Batch {
+	batch := make(Batch, len(entries))
+	for i, entry := range entries {
+		batch[i] = BatchOperation{Op: BatchInsert, Key: entry.Key, Value: entry.Value}
+	}
+	return batch
+}
+
+func updateBatch(entries []KeyValue) Batch {
+	batch := make(Batch, len(entries))
+	for i, entry := range entries {
+		batch[i] = BatchOperation{Op: BatchUpdate, Key: entry.Key, Value: entry.Value}
+	}
+	return batch
+}
+
+func removeBatch(keys []string) Batch {
+	batch := make(Batch, len(keys))
+	for i, key := range keys {
+		batch[i] = BatchOperation{Op: BatchRemove, Key: key}
+	}
+	return batch
+}
+
+func (op BatchOperation) wrap(i int, err error) error {
+	return fmt.Errorf("операция %d (%s %s): %w", i+1, op.Op, op.Key, err)
+}
+
+// applyToTree применяет пакет к дереву движка по одной операции; если
+// операция не удалась, уже выполненные отменяются в обратном порядке.
+// Используется движками, у которых нет собственной пакетной записи.
+func applyToTree(tree Tree, batch Batch) error {
+	var undo []func()
+	for i, op := range batch {
+		var err error
+		switch op.Op {
+		case BatchInsert:
+			if err = tree.Insert(op.Key, op.Value); err == nil {
+				key := op.Key
+				undo = append(undo, func() { tree.Remove(key) })
+			}
+		case BatchUpdate:
+			var old interface{}
+			if old, err = tree.Get(op.Key); err == nil {
+				if err = tree.Update(op.Key, op.Value); err == nil {
+					key := op.Key
+					undo = append(undo, func() { tree.Update(key, old) })
+				}
+			}
+		case BatchRemove:
+			var old interface{}
+			if old, err = tree.Get(op.Key); err == nil {
+				if err = tree.Remove(op.Key); err == nil {
+					key := op.Key
+					undo = append(undo, func() { tree.Insert(key, old) })
+				}
+			}
+		default:
+			err = fmt.Errorf("неизвестная операция пакета %q", op.Op)
+		}
+		if err != nil {
+			for j := len(undo) - 1; j >= 0; j-- {
+				undo[j]()
+			}
+			return op.wrap(i, err)
+		}
+	}
+	return nil
+}
+
+func (t *AVLTree) InsertMany(entries []KeyValue) error { return applyToTree(t, insertBatch(entries)) }
+func (t *AVLTree) UpdateMany(entries []KeyValue) error { return applyToTree(t, updateBatch(entries)) }
+func (t *AVLTree) RemoveMany(keys []string) error      { return applyToTree(t, removeBatch(keys)) }
+func (t *AVLTree) Apply(batch Batch) error             { return applyToTree(t, batch) }
+
+func (t *RedBlackTree) InsertMany(entries []KeyValue) error {
+	return applyToTree(t, insertBatch(entries))
+}
+func (t *RedBlackTree) UpdateMany(entries []KeyValue) error {
+	return applyToTree(t, updateBatch(entries))
+}
+func (t *RedBlackTree) RemoveMany(keys []string) error { return applyToTree(t, removeBatch(keys)) }
+func (t *RedBlackTree) Apply(batch Batch) error        { return applyToTree(t, batch) }
+
+func (t *BTree) InsertMany(entries []KeyValue) error { return applyToTree(t, insertBatch(entries)) }
+func (t *BTree) UpdateMany(entries []KeyValue) error { return applyToTree(t, updateBatch(entries)) }
+func (t *BTree) RemoveMany(keys []string) error      { return applyToTree(t, removeBatch(keys)) }
+func (t *BTree) Apply(batch Batch) error             { return applyToTree(t, batch) }
+
+func (d *Deque) InsertMany(entries []KeyValue) error { return applyToTree(d, insertBatch(entries)) }
+func (d *Deque) UpdateMany(entries []KeyValue) error { return applyToTree(d, updateBatch(entries)) }
+func (d *Deque) RemoveMany(keys []string) error      { return applyToTree(d, removeBatch(keys)) }
+func (d *Deque) Apply(batch Batch) error             { return applyToTree(d, batch) }
+
+func (ts *TimeSeries) InsertMany(entries []KeyValue) error {
+	return applyToTree(ts, insertBatch(entries))
+}
+func (ts *TimeSeries) UpdateMany(entries []KeyValue) error {
+	return applyToTree(ts, updateBatch(entries))
+}
+func (ts *TimeSeries) RemoveMany(keys []string) error { return applyToTree(ts, removeBatch(keys)) }
+func (ts *TimeSeries) Apply(batch Batch) error        { return applyToTree(ts, batch) }
+
+func (mc *MapCollection) InsertMany(entries []KeyValue) error {
+	return mc.Apply(insertBatch(entries))
+}
+func (mc *MapCollection) UpdateMany(entries []KeyValue) error {
+	return mc.Apply(updateBatch(entries))
+}
+func (mc *MapCollection) RemoveMany(keys []string) error { return mc.Apply(removeBatch(keys)) }
+
+// Apply для хеш-таблицы сначала проверяет весь пакет и только потом
+// меняет данные, поэтому откат не нужен и пакет не печатает сообщение на
+// каждый ключ, как Insert и Update.
+func (mc *MapCollection) Apply(batch Batch) error {
+	present := make(map[string]bool)
+	exists := func(key string) bool {
+		if state, ok := present[key]; ok {
+			return state
+		}
+		_, ok := mc.Data[key]
+		return ok
+	}
+	for i, op := range batch {
+		switch op.Op {
+		case BatchInsert:
+			if exists(op.Key) {
+				return op.wrap(i, fmt.Errorf("Элемент с таким ключом уже существует!"))
+			}
+			present[op.Key] = true
+		case BatchUpdate, BatchRemove:
+			if !exists(op.Key) {
+				return op.wrap(i, fmt.Errorf("Элемент не найден!"))
+			}
+			present[op.Key] = op.Op == BatchUpdate
+		default:
+			return op.wrap(i, fmt.Errorf("неизвестная операция пакета %q", op.Op))
+		}
+	}
+	for _, op := range batch {
+		if op.Op == BatchRemove {
+			delete(mc.Data, op.Key)
+			mc.forget(op.Key)
+		} else {
+			mc.Data[op.Key] = op.Value
+			mc.bump(op.Key)
+		}
+	}
+	return nil
+}
+
+func (tc *TreeCollection) InsertMany(entries []KeyValue) error {
+	return tc.Apply(insertBatch(entries))
+}
+
+func (tc *TreeCollection) UpdateMany(entries []KeyValue) error {
+	return tc.Apply(updateBatch(entries))
+}
+
+func (tc *TreeCollection) RemoveMany(keys []string) error {
+	return tc.Apply(removeBatch(keys))
+}
+
+// Apply выполняет пакет под одной исключительной блокировкой коллекции.
+// Операции видят результат предыдущих операций пакета; если одна из них не
+// прошла проверки схемы, уникальности или памяти, все уже выполненные
+// отменяются и коллекция остается в прежнем состоянии.
+func (tc *TreeCollection) Apply(batch Batch) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	_, err := tc.apply(batch)
+	return err
+}
+
+// apply возвращает действия, отменяющие пакет, в порядке выполнения.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) apply(batch Batch) ([]func(), error) {
+	var undo []func()
+	for i, op := range batch {
+		revert, err := tc.applyOne(op)
+		if err != nil {
+			for j := len(undo) - 1; j >= 0; j-- {
+				undo[j]()
+			}
+			return nil, op.wrap(i, err)
+		}
+		undo = append(undo, revert)
+	}
+	return undo, nil
+}
+
+func (tc *TreeCollection) applyOne(op BatchOperation) (func(), error) {
+	key := op.Key
+	switch op.Op {
+	case BatchInsert:
+		if tc.multimap {
+			return tc.add(key, op.Value, time.Time{})
+		}
+		if err := tc.insert(key, op.Value); err != nil {
+			return nil, err
+		}
+		return func() { tc.drop(key) }, nil
+	case BatchUpdate:
+		old, err := tc.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := tc.update(key, op.Value); err != nil {
+			return nil, err
+		}
+		return func() { tc.update(key, old) }, nil
+	case BatchRemove:
+		old, err := tc.get(key)
+		if err != nil {
+			return nil, err
+		}
+		oldExpiry := tc.expires[key]
+		if err := tc.remove(key); err != nil {
+			return nil, err
+		}
+		return func() {
+			if tc.insert(key, old) == nil && !oldExpiry.IsZero() {
+				tc.setExpiry(key, oldExpiry)
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("неизвестная операция пакета %q", op.Op)
+}
+
+// Apply выполняет пакет в транзакции; в журнал отмены попадает одна запись
+// на весь пакет.
+func (tx *Transaction) Apply(tc *TreeCollection, batch Batch) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	undo, err := tc.apply(batch)
+	tc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	})
+	return nil
+}
+
+// BatchCommand - одна запись журнала команд на весь пакет вместе с ключами
+// его операций. К данным применяются операции над их ключом, а вставка -
+// и когда данных еще нет, как InsertCommand; в отличие от команд одной
+// операции, пакет не паникует: он уже проверен коллекцией.
+type BatchCommand struct {
+	Batch Batch
+}
+
+func (c *BatchCommand) Execute(dataExists *bool, dataToModify *TData) {
+	now := time.Now()
+	keys := make([]string, len(c.Batch))
+	for i, op := range c.Batch {
+		keys[i] = op.Key
+		if *dataExists && op.Key != dataToModify.Key {
+			continue
+		}
+		switch op.Op {
+		case BatchInsert:
+			*dataToModify = TData{Key: op.Key, Value: op.Value, Timestamp: now}
+			*dataExists = true
+		case BatchUpdate:
+			if *dataExists {
+				dataToModify.Value, dataToModify.Timestamp = op.Value, now
+			}
+		case BatchRemove:
+			*dataExists = false
+		}
+	}
+	fmt.Printf("Пакет данных: ключи = %v, операций = %d, время = %s\n", keys, len(c.Batch), now.Format(time.RFC3339))
+}
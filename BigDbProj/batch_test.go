@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Пакет движка применяется целиком или не применяется вовсе.
+func TestEngineApplyIsAtomic(t *testing.T) {
+	for _, engine := range []string{"avl", "redblack", "btree", "map"} {
+		t.Run(engine, func(t *testing.T) {
+			tree, err := newEngine(engine, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.InsertMany([]KeyValue{{Key: "a", Value: "1"}, {Key: "c", Value: "3"}}); err != nil {
+				t.Fatal(err)
+			}
+			err = tree.Apply(Batch{
+				{Op: BatchInsert, Key: "b", Value: "2"},
+				{Op: BatchUpdate, Key: "a", Value: "10"},
+				{Op: BatchRemove, Key: "c"},
+				{Op: BatchInsert, Key: "a", Value: "11"},
+			})
+			if err == nil {
+				t.Fatal("пакет с повторной вставкой применен")
+			}
+			for key, want := range map[string]interface{}{"a": "1", "c": "3"} {
+				if value, err := tree.Get(key); err != nil || value != want {
+					t.Errorf("%s = %v, %v; ожидалось %v", key, value, err, want)
+				}
+			}
+			if _, err := tree.Get("b"); err == nil {
+				t.Error("вставка из отвергнутого пакета осталась в дереве")
+			}
+
+			if err := tree.UpdateMany([]KeyValue{{Key: "a", Value: "10"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.RemoveMany([]string{"a", "c"}); err != nil {
+				t.Fatal(err)
+			}
+			if keys, _ := tree.GetRange("", maxKey); len(keys) != 0 {
+				t.Errorf("после RemoveMany остались ключи %v", keys)
+			}
+		})
+	}
+}
+
+// Пакет попадает в журнал команд одной записью, которая знает ключи своих
+// операций.
+func TestBatchCommandAppliesOperationsOfItsKey(t *testing.T) {
+	cr := &ChainOfResponsibility{}
+	cr.AddHandler(&BatchCommand{Batch: Batch{
+		{Op: BatchInsert, Key: "a", Value: "1"},
+		{Op: BatchInsert, Key: "b", Value: "2"},
+		{Op: BatchUpdate, Key: "a", Value: "3"},
+		{Op: BatchRemove, Key: "b"},
+	}})
+	if cr.FirstHandler != cr.LastHandler {
+		t.Fatal("пакет записан в журнал несколькими записями")
+	}
+	exists := false
+	var data TData
+	cr.Handle(&exists, &data, time.Now().Add(time.Hour).Unix())
+	if !exists || data.Key != "a" || data.Value != "3" {
+		t.Errorf("после пакета данные %+v (есть: %v), ожидалось a = 3", data, exists)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// BulkLoader - необязательная возможность движка: построение дерева из
+// отсортированных ключей за линейное время вместо n вставок.
+type BulkLoader interface {
+	BulkLoad(keys []string, values []interface{})
+}
+
+// KeyValidator - необязательная возможность движка, принимающего не любые
+// строки в качестве ключей: проверка ключа до пакетной загрузки.
+type KeyValidator interface {
+	ValidateKey(key string) error
+}
+
+var ErrCollectionNotEmpty = errors.New("Пакетная загрузка возможна только в пустую коллекцию!")
+
+// KeyValue - пара ключ-значение для пакетной загрузки и импорта.
+type KeyValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// EntryStream отдает пары по возрастанию ключа; конец потока - io.EOF.
+type EntryStream interface {
+	Next() (KeyValue, error)
+}
+
+type sliceStream struct {
+	entries []KeyValue
+}
+
+func (s *sliceStream) Next() (KeyValue, error) {
+	if len(s.entries) == 0 {
+		return KeyValue{}, io.EOF
+	}
+	entry := s.entries[0]
+	s.entries = s.entries[1:]
+	return entry, nil
+}
+
+// saveEntries записывает в файл все пары дерева в порядке ключей.
+func saveEntries(filename string, tree RangeScanner) error {
+	var entries []KeyValue
+	tree.ScanRange("", maxKey, func(key string, value interface{}) bool {
+		entries = append(entries, KeyValue{Key: key, Value: value})
+		return true
+	})
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, data, 0644)
+}
+
+// loadEntries заменяет содержимое дерева парами, записанными saveEntries.
+func loadEntries(filename string, tree BulkLoader) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var entries []KeyValue
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	keys := make([]string, len(entries))
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		keys[i], values[i] = entry.Key, entry.Value
+	}
+	tree.BulkLoad(keys, values)
+	return nil
+}
+
+// SortedEntries сортирует пары по ключу по правилам collation и возвращает
+// их как поток для BulkLoad.
+func SortedEntries(entries []KeyValue, collation *Collation) EntryStream {
+	sort.Slice(entries, func(i, j int) bool { return collation.Compare(entries[i].Key, entries[j].Key) < 0 })
+	return &sliceStream{entries: entries}
+}
+
+// BulkLoad загружает в пустую коллекцию пары из stream, которые должны
+// идти строго по возрастанию ключа по правилам сравнения коллекции.
+// Значения проверяются по схеме и ограничениям уникальности, как при
+// Insert, но дерево движка с BulkLoader строится снизу вверх за O(n). При
+// ошибке коллекция остается пустой.
+func (tc *TreeCollection) BulkLoad(stream EntryStream) (int, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.purgeDue(time.Now())
+	if existing, err := tc.Tree.GetRange("", maxKey); err != nil {
+		return 0, err
+	} else if len(existing) > 0 {
+		return 0, ErrCollectionNotEmpty
+	}
+	if status, ok := tc.conversionStatus(); ok && !status.Done {
+		return 0, ErrConversionRunning
+	}
+
+	var keys []string
+	var values []interface{}
+	unique := make(map[string]map[string]string)
+	for {
+		entry, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if len(keys) > 0 && tc.collation.Compare(entry.Key, keys[len(keys)-1]) <= 0 {
+			return 0, fmt.Errorf("ключи пакетной загрузки должны строго возрастать: %s после %s", entry.Key, keys[len(keys)-1])
+		}
+		if err := checkKey(entry.Key); err != nil {
+			return 0, err
+		}
+		if validator, ok := tc.Tree.(KeyValidator); ok {
+			if err := validator.ValidateKey(entry.Key); err != nil {
+				return 0, err
+			}
+		}
+		value, err := tc.coerce(entry.Value)
+		if err != nil {
+			return 0, fmt.Errorf("ключ %s: %w", entry.Key, err)
+		}
+		if err := tc.checkBudget(entry.Key, value); err != nil {
+			return 0, fmt.Errorf("ключ %s: %w", entry.Key, err)
+		}
+		if err := tc.checkBulkUnique(unique, entry.Key, value); err != nil {
+			return 0, err
+		}
+		keys = append(keys, entry.Key)
+		values = append(values, value)
+	}
+	indexes, err := tc.emptyIndexes()
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := tc.addToIndexes(indexes, key, values[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	sp := GetStringPools()
+	for i := range keys {
+		keys[i], values[i] = sp.Acquire(keys[i]), sp.internValue(values[i])
+	}
+	if loader, ok := tc.Tree.(BulkLoader); ok {
+		loader.BulkLoad(keys, values)
+	} else {
+		for i, key := range keys {
+			if err := tc.Tree.Insert(key, values[i]); err != nil {
+				for _, inserted := range keys[:i] {
+					tc.Tree.Remove(inserted)
+				}
+				for j := range keys {
+					sp.Release(keys[j])
+					sp.releaseValue(values[j])
+				}
+				return 0, fmt.Errorf("ключ %s: %w", key, err)
+			}
+		}
+	}
+	tc.indexes = indexes
+	for i, key := range keys {
+		tc.stampSchemaVersion(key)
+		tc.cacheAdd(key, values[i])
+	}
+	return len(keys), nil
+}
+
+// checkBulkUnique проверяет уникальные поля среди загружаемых значений;
+// unique запоминает закодированные значения полей, уже встреченные в потоке.
+func (tc *TreeCollection) checkBulkUnique(unique map[string]map[string]string, key string, value interface{}) error {
+	for field, idx := range tc.indexes {
+		if !idx.Unique {
+			continue
+		}
+		if unique[field] == nil {
+			unique[field] = make(map[string]string)
+		}
+		for _, item := range tc.elements(value) {
+			entry, ok := idx.entryKey("", item)
+			if !ok {
+				continue
+			}
+			if holder, exists := unique[field][entry]; exists && holder != key {
+				v, _ := fieldValue(item, field)
+				return fmt.Errorf("%w: значение %v поля %s уже занято ключом %s", ErrUniqueViolation, v, field, holder)
+			}
+			unique[field][entry] = key
+		}
+	}
+	return nil
+}
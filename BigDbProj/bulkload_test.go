@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// failingTree - движок без BulkLoader, вставка в который отказывает после
+// left успешных вставок.
+type failingTree struct {
+	*MapCollection
+	left int
+}
+
+func (f *failingTree) Insert(key string, value interface{}) error {
+	if f.left == 0 {
+		return errors.New("сбой вставки")
+	}
+	f.left--
+	return f.MapCollection.Insert(key, value)
+}
+
+func pooled(str string) bool {
+	shard := GetStringPools().shard(str)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	_, ok := shard.entries[str]
+	return ok
+}
+
+// Сбой вставки посреди пакетной загрузки оставляет коллекцию пустой и не
+// оставляет ссылок в пуле строк.
+func TestBulkLoadFallbackRollsBack(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c map",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Tree = &failingTree{MapCollection: tc.Tree.(*MapCollection), left: 3}
+	var entries []KeyValue
+	for i := 0; i < 5; i++ {
+		entries = append(entries, KeyValue{Key: fmt.Sprintf("bulk-key-%d", i), Value: fmt.Sprintf("bulk-value-%d", i)})
+	}
+	if _, err := tc.BulkLoad(SortedEntries(entries, nil)); err == nil {
+		t.Fatal("загрузка прошла без ошибки")
+	}
+	if keys, _ := tc.GetRange("", maxKey); len(keys) != 0 {
+		t.Errorf("после ошибки в коллекции остались ключи %v", keys)
+	}
+	for _, entry := range entries {
+		if pooled(entry.Key) || pooled(entry.Value.(string)) {
+			t.Errorf("пара %s осталась в пуле строк", entry.Key)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	CachePolicyLRU = "lru"
+	CachePolicyLFU = "lfu"
+)
+
+var ErrValueTooLarge = errors.New("Значение больше бюджета памяти коллекции!")
+
+// CacheStats - счетчики коллекции в режиме кэша.
+type CacheStats struct {
+	Policy    string `json:"policy"`
+	Budget    int64  `json:"budget"`
+	Used      int64  `json:"used"`
+	Keys      int    `json:"keys"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+type cacheEntry struct {
+	key   string
+	size  int64
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+// collectionCache учитывает примерный размер ключей и значений коллекции и
+// выбирает ключ для вытеснения: при LRU - давно не использованный, при LFU -
+// реже всего использованный, а из равных - давно не использованный.
+// Собственный мьютекс нужен потому, что чтение под разделяемой блокировкой
+// коллекции тоже меняет порядок вытеснения.
+type collectionCache struct {
+	mu      sync.Mutex
+	policy  string
+	budget  int64
+	used    int64
+	clock   uint64
+	entries map[string]*cacheEntry
+	order   []*cacheEntry
+	stats   CacheStats
+}
+
+func (c *collectionCache) Len() int { return len(c.order) }
+func (c *collectionCache) Less(i, j int) bool {
+	a, b := c.order[i], c.order[j]
+	if c.policy == CachePolicyLFU && a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.tick < b.tick
+}
+func (c *collectionCache) Swap(i, j int) {
+	c.order[i], c.order[j] = c.order[j], c.order[i]
+	c.order[i].index = i
+	c.order[j].index = j
+}
+func (c *collectionCache) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(c.order)
+	c.order = append(c.order, entry)
+}
+func (c *collectionCache) Pop() interface{} {
+	entry := c.order[len(c.order)-1]
+	c.order = c.order[:len(c.order)-1]
+	return entry
+}
+
+// touch отмечает обращение к ключу.
+func (c *collectionCache) touch(entry *cacheEntry) {
+	c.clock++
+	entry.tick = c.clock
+	entry.freq++
+	heap.Fix(c, entry.index)
+}
+
+// put учитывает новый или перезаписанный ключ.
+func (c *collectionCache) put(key string, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		c.used += size - entry.size
+		entry.size = size
+		c.touch(entry)
+		return
+	}
+	entry := &cacheEntry{key: key, size: size}
+	c.entries[key] = entry
+	c.used += size
+	heap.Push(c, entry)
+	c.touch(entry)
+}
+
+func (c *collectionCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		heap.Remove(c, entry.index)
+		delete(c.entries, key)
+		c.used -= entry.size
+	}
+}
+
+// lookup учитывает чтение ключа как попадание или промах.
+func (c *collectionCache) lookup(key string, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !found || !ok {
+		c.stats.Misses++
+		return
+	}
+	c.stats.Hits++
+	c.touch(entry)
+}
+
+// victim возвращает ключ, который нужно вытеснить, если бюджет превышен.
+// Ключ keep не вытесняется.
+func (c *collectionCache) victim(keep string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.used <= c.budget || len(c.order) == 0 {
+		return "", false
+	}
+	if c.order[0].key != keep {
+		return c.order[0].key, true
+	}
+	// первый кандидат - только что записанный ключ (при LFU у нового ключа
+	// наименьшая частота); следующий по порядку - меньший из детей корня
+	switch {
+	case len(c.order) == 1:
+		return "", false
+	case len(c.order) == 2 || c.Less(1, 2):
+		return c.order[1].key, true
+	default:
+		return c.order[2].key, true
+	}
+}
+
+// cacheAdd учитывает записанный ключ и вытесняет лишние. Вытеснение не
+// входит в журнал отмены транзакции: откат не возвращает вытесненные ключи.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) cacheAdd(key string, value interface{}) {
+	if tc.cache == nil {
+		return
+	}
+	tc.cache.put(key, int64(len(key))+approxSize(value))
+	tc.evict(key)
+}
+
+// evict удаляет ключи, пока коллекция не уложится в бюджет.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) evict(keep string) {
+	for {
+		key, ok := tc.cache.victim(keep)
+		if !ok {
+			return
+		}
+		if err := tc.drop(key); err != nil {
+			tc.cache.remove(key)
+			continue
+		}
+		tc.cache.mu.Lock()
+		tc.cache.stats.Evictions++
+		tc.cache.mu.Unlock()
+	}
+}
+
+// checkBudget не дает записать значение, которое одно больше бюджета.
+func (tc *TreeCollection) checkBudget(key string, value interface{}) error {
+	if tc.cache != nil && int64(len(key))+approxSize(value) > tc.cache.budget {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// SetCacheLimit включает режим кэша с бюджетом budget байт и политикой
+// вытеснения policy или меняет их на ходу. Нулевой бюджет выключает режим.
+// Если хранящиеся ключи не укладываются в новый бюджет, лишние вытесняются.
+func (tc *TreeCollection) SetCacheLimit(budget int64, policy string) error {
+	if policy == "" {
+		policy = CachePolicyLRU
+	}
+	if policy != CachePolicyLRU && policy != CachePolicyLFU {
+		return fmt.Errorf("неизвестная политика вытеснения: %s", policy)
+	}
+	if budget < 0 {
+		return fmt.Errorf("некорректный бюджет памяти: %d", budget)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if budget == 0 {
+		tc.cache = nil
+		return nil
+	}
+	if tc.cache != nil {
+		tc.cache.mu.Lock()
+		tc.cache.budget, tc.cache.policy = budget, policy
+		heap.Init(tc.cache)
+		tc.cache.mu.Unlock()
+		tc.evict("")
+		return nil
+	}
+
+	tc.cache = &collectionCache{policy: policy, budget: budget, entries: make(map[string]*cacheEntry)}
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := tc.stored(key)
+		if err != nil {
+			return err
+		}
+		tc.cache.put(key, int64(len(key))+approxSize(value))
+	}
+	tc.evict("")
+	return nil
+}
+
+// CacheStats возвращает счетчики режима кэша; ok ложно, если он выключен.
+func (tc *TreeCollection) CacheStats() (stats CacheStats, ok bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if tc.cache == nil {
+		return CacheStats{}, false
+	}
+	tc.cache.mu.Lock()
+	defer tc.cache.mu.Unlock()
+	stats = tc.cache.stats
+	stats.Policy, stats.Budget, stats.Used, stats.Keys = tc.cache.policy, tc.cache.budget, tc.cache.used, len(tc.cache.entries)
+	return stats, true
+}
+
+// approxSize оценивает объем памяти значения в байтах: длина строк плюс
+// условные накладные расходы на числа, элементы массивов и поля объектов.
+func approxSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v)) + 16
+	case bool:
+		return 1
+	case float64, int, int64, uint64, json.Number:
+		return 8
+	case []interface{}:
+		size := int64(24)
+		for _, item := range v {
+			size += approxSize(item)
+		}
+		return size
+	case map[string]interface{}:
+		size := int64(48)
+		for field, item := range v {
+			size += int64(len(field)) + 16 + approxSize(item)
+		}
+		return size
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
+
+// parseByteSize разбирает размер вида 4096, 512KB, 64MB или 1GB.
+func parseByteSize(text string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	upper := strings.ToUpper(strings.TrimSpace(text))
+	scale := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper, scale = strings.TrimSuffix(upper, unit.suffix), unit.scale
+			break
+		}
+	}
+	number, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("некорректный размер: %s", text)
+	}
+	if number > math.MaxInt64/scale {
+		return 0, fmt.Errorf("слишком большой размер: %s", text)
+	}
+	return number * scale, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Collation - правила сравнения ключей коллекции. Ключи сравниваются по
+// уровням: сначала по первому, при равенстве - по следующим, а в конце
+// побайтово, поэтому разные строки никогда не считаются одним ключом.
+// Границы диапазонов в GetRange сравниваются только по первому уровню:
+// в коллекции без учета регистра диапазон ["a", "b"] включает и "A", и "B".
+// Пустая строка меньше, а maxKey больше любого ключа при любых правилах.
+// Нулевой указатель означает побайтовое сравнение.
+type Collation struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	levels      []func(a, b string) int
+}
+
+var collations = map[string]*Collation{}
+
+func init() {
+	for _, c := range []*Collation{
+		{Name: "binary", Description: "побайтовое сравнение UTF-8", levels: []func(a, b string) int{strings.Compare}},
+		{Name: "nocase", Description: "без учета регистра", levels: []func(a, b string) int{compareNoCase}},
+		{Name: "natural", Description: "числа внутри ключей сравниваются по значению: \"9\" < \"10\"", levels: []func(a, b string) int{compareNatural}},
+		{Name: "unicode", Description: "по алфавиту без учета регистра, ё рядом с е, затем строчные перед прописными", levels: []func(a, b string) int{compareAlphabet, compareLetters, compareCase}},
+	} {
+		collations[c.Name] = c
+	}
+}
+
+// LookupCollation находит правила сравнения по имени.
+func LookupCollation(name string) (*Collation, error) {
+	c, ok := collations[name]
+	if !ok {
+		var names []string
+		for _, c := range Collations() {
+			names = append(names, c.Name)
+		}
+		return nil, fmt.Errorf("неизвестные правила сравнения %q, доступны: %s", name, strings.Join(names, ", "))
+	}
+	return c, nil
+}
+
+// Collations возвращает все правила сравнения в порядке имен.
+func Collations() []*Collation {
+	result := make([]*Collation, 0, len(collations))
+	for _, c := range collations {
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// CollationName возвращает имя правил; для nil - "binary".
+func (c *Collation) CollationName() string {
+	if c == nil {
+		return "binary"
+	}
+	return c.Name
+}
+
+// Compare задает порядок ключей в движке: отрицательное число, если a < b,
+// ноль только для равных строк.
+func (c *Collation) Compare(a, b string) int {
+	if c == nil || a == b {
+		return strings.Compare(a, b)
+	}
+	if a == maxKey {
+		return 1
+	}
+	if b == maxKey {
+		return -1
+	}
+	for _, level := range c.levels {
+		if result := level(a, b); result != 0 {
+			return result
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// compareBound сравнивает ключ с границей диапазона по первому уровню.
+func (c *Collation) compareBound(key, bound string) int {
+	if c == nil || key == bound {
+		return strings.Compare(key, bound)
+	}
+	if key == maxKey {
+		return 1
+	}
+	if bound == maxKey {
+		return -1
+	}
+	return c.levels[0](key, bound)
+}
+
+// inRange сообщает, что key лежит в диапазоне [minValue, maxValue].
+func (c *Collation) inRange(key, minValue, maxValue string) bool {
+	return c.compareBound(key, minValue) >= 0 && c.compareBound(key, maxValue) <= 0
+}
+
+// splitCollation отделяет от параметров движка параметр collation.
+func splitCollation(options map[string]string) (map[string]string, *Collation, error) {
+	name, ok := options["collation"]
+	if !ok {
+		return options, nil, nil
+	}
+	collation, err := LookupCollation(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	rest := make(map[string]string, len(options)-1)
+	for option, value := range options {
+		if option != "collation" {
+			rest[option] = value
+		}
+	}
+	return rest, collation, nil
+}
+
+// Collation возвращает имя правил сравнения ключей коллекции.
+func (tc *TreeCollection) Collation() string {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.collation.CollationName()
+}
+
+// keyCollation возвращает правила сравнения ключей коллекции.
+func (tc *TreeCollection) keyCollation() *Collation {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.collation
+}
+
+// Sort сортирует ключи по правилам c.
+func (c *Collation) Sort(keys []string) {
+	sort.Slice(keys, func(i, j int) bool { return c.Compare(keys[i], keys[j]) < 0 })
+}
+
+// compareRunes сравнивает строки посимвольно по весам символов.
+func compareRunes(a, b string, weight func(r rune) rune) int {
+	for a != "" && b != "" {
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if wa, wb := weight(ra), weight(rb); wa != wb {
+			if wa < wb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return compareInts(len(a), len(b))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareNoCase(a, b string) int {
+	return compareRunes(a, b, unicode.ToLower)
+}
+
+// compareAlphabet - первый уровень правил unicode: регистр не учитывается,
+// ё и е - одна буква, как в русских словарях.
+func compareAlphabet(a, b string) int {
+	return compareRunes(a, b, func(r rune) rune {
+		r = unicode.ToLower(r)
+		if r == 'ё' {
+			return 'е'
+		}
+		return r
+	})
+}
+
+// compareLetters - второй уровень: е перед ё.
+func compareLetters(a, b string) int {
+	return compareRunes(a, b, unicode.ToLower)
+}
+
+// compareCase - третий уровень: строчная буква перед прописной.
+func compareCase(a, b string) int {
+	return compareRunes(a, b, func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return 1
+		}
+		return 0
+	})
+}
+
+// compareNatural сравнивает последовательности цифр как числа (ведущие нули
+// не учитываются), а остальные символы - по кодам.
+func compareNatural(a, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			digitsA, digitsB := digitPrefix(a), digitPrefix(b)
+			numberA, numberB := strings.TrimLeft(digitsA, "0"), strings.TrimLeft(digitsB, "0")
+			if result := compareInts(len(numberA), len(numberB)); result != 0 {
+				return result
+			}
+			if result := strings.Compare(numberA, numberB); result != 0 {
+				return result
+			}
+			a, b = a[len(digitsA):], b[len(digitsB):]
+			continue
+		}
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			return compareInts(int(ra), int(rb))
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return compareInts(len(a), len(b))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i]
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Для каждого правила сравнения - ключи в ожидаемом порядке.
+var collationOrders = map[string][]string{
+	"binary":  {"10", "9", "A", "B", "a", "b", "Ё", "а", "ё"},
+	"nocase":  {"10", "9", "A", "a", "B", "b", "Ж", "ж"},
+	"natural": {"item2", "item007", "item7", "item10", "item10a", "item10b", "itema"},
+	"unicode": {"абрикос", "Абрикос", "ёж", "ёлка", "Ёлка", "ель", "Ель", "ёль", "яблоко"},
+}
+
+func TestCollationOrders(t *testing.T) {
+	for name, want := range collationOrders {
+		collation, err := LookupCollation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			for j := range want {
+				if got, expected := sign(collation.Compare(want[i], want[j])), compareInts(i, j); got != expected {
+					t.Errorf("%s: Compare(%q, %q) = %d, ожидалось %d", name, want[i], want[j], got, expected)
+				}
+			}
+		}
+	}
+}
+
+// Упорядоченные движки хранят ключи в порядке правил коллекции.
+func TestEnginesHonorCollation(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for name, want := range collationOrders {
+		collation, err := LookupCollation(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, engine := range []string{"avl", "redblack", "btree"} {
+			tree, err := newEngine(engine, nil, collation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range rng.Perm(len(want)) {
+				if err := tree.Insert(want[i], i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if keys, _ := tree.GetRange("", maxKey); !reflect.DeepEqual(keys, want) {
+				t.Errorf("%s/%s: ключи %q, ожидалось %q", engine, name, keys, want)
+			}
+			for i, key := range want {
+				if value, err := tree.Get(key); err != nil || value != i {
+					t.Errorf("%s/%s: Get(%q) = %v, %v", engine, name, key, value, err)
+				}
+			}
+		}
+	}
+}
+
+// Границы диапазона сравниваются по первому уровню правил.
+func TestCollationRangeBounds(t *testing.T) {
+	collation, err := LookupCollation("nocase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := newEngine("btree", nil, collation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range collationOrders["nocase"] {
+		if err := tree.Insert(key, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys, _ := tree.GetRange("a", "b"); !reflect.DeepEqual(keys, []string{"A", "a", "B", "b"}) {
+		t.Errorf("GetRange(a, b) = %q", keys)
+	}
+}
+
+func sign(x int) int {
+	return compareInts(x, 0)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// conversionBatch - число ключей, копируемых под одной разделяемой
+	// блокировкой коллекции
+	conversionBatch = 256
+	// conversionCatchUp - сколько измененных во время копирования ключей
+	// можно дописать уже под исключительной блокировкой при подмене дерева
+	conversionCatchUp = 64
+)
+
+var ErrConversionRunning = errors.New("Коллекция уже переводится на другой движок!")
+
+// ConversionStatus - ход перевода коллекции на другой движок.
+type ConversionStatus struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Total    int       `json:"total"`
+	Copied   int       `json:"copied"`
+	Replayed int       `json:"replayed"`
+	Done     bool      `json:"done"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// conversion копирует дерево коллекции в новый движок. Записи, сделанные во
+// время копирования, отмечаются в dirty и затем переносятся повторно.
+type conversion struct {
+	target    Tree
+	collation *Collation
+	mu        sync.Mutex
+	dirty     map[string]bool
+	status    ConversionStatus
+}
+
+// trackWrite отмечает ключ, измененный во время перевода на другой движок.
+// Вызывается под исключительной блокировкой коллекции после изменения
+// дерева.
+func (tc *TreeCollection) trackWrite(key string) {
+	if tc.conversion == nil {
+		return
+	}
+	tc.conversion.mu.Lock()
+	if !tc.conversion.status.Done {
+		tc.conversion.dirty[key] = true
+	}
+	tc.conversion.mu.Unlock()
+}
+
+func (c *conversion) takeDirty() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.dirty))
+	for key := range c.dirty {
+		keys = append(keys, key)
+	}
+	c.dirty = make(map[string]bool)
+	return keys
+}
+
+func (c *conversion) update(fn func(status *ConversionStatus)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fn(&c.status)
+}
+
+// copyKey переносит в новое дерево текущее состояние ключа: значение, если
+// ключ есть, или его отсутствие. Вызывается под блокировкой коллекции.
+func (tc *TreeCollection) copyKey(target Tree, key string) error {
+	value, err := tc.Tree.Get(key)
+	if err != nil {
+		target.Remove(key)
+		return nil
+	}
+	if _, err := target.Get(key); err == nil {
+		return target.Update(key, value)
+	}
+	return target.Insert(key, value)
+}
+
+// Convert начинает перевод коллекции на движок engine и возвращается сразу.
+// Копирование идет в фоне пакетами под разделяемой блокировкой, поэтому
+// чтение и запись в коллекцию продолжают работать. Когда измененных за время
+// копирования ключей остается немного, они дописываются под исключительной
+// блокировкой и дерево коллекции подменяется.
+// Параметр collation=имя в options меняет и правила сравнения ключей.
+func (tc *TreeCollection) Convert(engine string, options map[string]string) error {
+	options, collation, err := splitCollation(options)
+	if err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	if collation == nil {
+		collation = tc.collation
+	}
+	if tc.keySchema != nil && collation.CollationName() != "binary" {
+		tc.mu.Unlock()
+		return fmt.Errorf("составные ключи сравниваются побайтово, правила %s недоступны", collation.Name)
+	}
+	target, err := newEngine(engine, options, collation)
+	if err != nil {
+		tc.mu.Unlock()
+		return err
+	}
+	if status, ok := tc.conversionStatus(); ok && !status.Done {
+		tc.mu.Unlock()
+		return ErrConversionRunning
+	}
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		tc.mu.Unlock()
+		return err
+	}
+	c := &conversion{
+		target:    target,
+		collation: collation,
+		dirty:     make(map[string]bool),
+		status:    ConversionStatus{From: tc.engine, To: engine, Total: len(keys), Started: time.Now()},
+	}
+	tc.conversion = c
+	tc.mu.Unlock()
+
+	go tc.runConversion(c, engine, options, keys)
+	return nil
+}
+
+func (tc *TreeCollection) runConversion(c *conversion, engine string, options map[string]string, keys []string) {
+	err := tc.copyAll(c, keys)
+	if err == nil {
+		err = tc.catchUp(c)
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if err == nil {
+		for _, key := range c.takeDirty() {
+			if err = tc.copyKey(c.target, key); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		// ключи сохраняют версии: ETag, выданные до перевода, остаются
+		// действительными
+		*c.target.versionTable() = tc.Tree.versionTable().clone()
+		tc.Tree, tc.engine, tc.engineOptions, tc.collation = c.target, engine, options, c.collation
+	}
+	c.update(func(status *ConversionStatus) {
+		status.Done, status.Finished = true, time.Now()
+		if err != nil {
+			status.Error = err.Error()
+		}
+	})
+}
+
+// copyAll переносит ключи, которые были в коллекции на момент начала.
+func (tc *TreeCollection) copyAll(c *conversion, keys []string) error {
+	for start := 0; start < len(keys); start += conversionBatch {
+		end := start + conversionBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		tc.mu.RLock()
+		for _, key := range keys[start:end] {
+			if err := tc.copyKey(c.target, key); err != nil {
+				tc.mu.RUnlock()
+				return err
+			}
+		}
+		tc.mu.RUnlock()
+		c.update(func(status *ConversionStatus) { status.Copied = end })
+	}
+	return nil
+}
+
+// catchUp повторно переносит ключи, измененные во время копирования, пока
+// их не станет меньше conversionCatchUp.
+func (tc *TreeCollection) catchUp(c *conversion) error {
+	for {
+		c.mu.Lock()
+		pending := len(c.dirty)
+		c.mu.Unlock()
+		if pending < conversionCatchUp {
+			return nil
+		}
+		keys := c.takeDirty()
+		tc.mu.RLock()
+		for _, key := range keys {
+			if err := tc.copyKey(c.target, key); err != nil {
+				tc.mu.RUnlock()
+				return err
+			}
+		}
+		tc.mu.RUnlock()
+		c.update(func(status *ConversionStatus) { status.Replayed += len(keys) })
+	}
+}
+
+// ConversionStatus возвращает ход последнего перевода коллекции на другой
+// движок; ok ложно, если перевода не было.
+func (tc *TreeCollection) ConversionStatus() (status ConversionStatus, ok bool) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.conversionStatus()
+}
+
+func (tc *TreeCollection) conversionStatus() (ConversionStatus, bool) {
+	if tc.conversion == nil {
+		return ConversionStatus{}, false
+	}
+	tc.conversion.mu.Lock()
+	defer tc.conversion.mu.Unlock()
+	return tc.conversion.status, true
+}
+
+// Engine возвращает имя движка коллекции.
+func (tc *TreeCollection) Engine() string {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.engine
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EngineCapabilities описывает свойства движка: Ordered - ключи хранятся
+// упорядоченно и диапазоны не требуют сортировки, Persistent - SaveToFile
+// движка записывает все ключи и значения, Concurrent - движок сам безопасен для
+// параллельного доступа без блокировки коллекции.
+type EngineCapabilities struct {
+	Ordered    bool `json:"ordered"`
+	Persistent bool `json:"persistent"`
+	Concurrent bool `json:"concurrent"`
+}
+
+// EngineOption - параметр движка, задаваемый при создании коллекции как
+// имя=значение. Type - "int", "duration" или "string".
+type EngineOption struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Default     string `json:"default"`
+	Min         int    `json:"min,omitempty"`
+	Description string `json:"description"`
+}
+
+// EngineInfo - движок хранения, зарегистрированный под именем Name. New
+// получает параметры, уже проверенные по Options и дополненные значениями
+// по умолчанию, и правила сравнения ключей (nil - побайтово).
+type EngineInfo struct {
+	Name         string                                                              `json:"name"`
+	Description  string                                                              `json:"description"`
+	Options      []EngineOption                                                      `json:"options,omitempty"`
+	Capabilities EngineCapabilities                                                  `json:"capabilities"`
+	New          func(options map[string]string, collation *Collation) (Tree, error) `json:"-"`
+}
+
+var (
+	enginesMu sync.RWMutex
+	engines   = make(map[string]*EngineInfo)
+)
+
+// RegisterEngine добавляет движок в реестр. Повторная регистрация имени -
+// ошибка программы.
+func RegisterEngine(info *EngineInfo) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if _, exists := engines[info.Name]; exists {
+		panic("движок " + info.Name + " уже зарегистрирован")
+	}
+	engines[info.Name] = info
+}
+
+// Engines возвращает зарегистрированные движки в порядке имен.
+func Engines() []*EngineInfo {
+	enginesMu.RLock()
+	defer enginesMu.RUnlock()
+	result := make([]*EngineInfo, 0, len(engines))
+	for _, info := range engines {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func engineNames() []string {
+	var names []string
+	for _, info := range Engines() {
+		names = append(names, info.Name)
+	}
+	return names
+}
+
+// LookupEngine находит движок по имени.
+func LookupEngine(name string) (*EngineInfo, error) {
+	enginesMu.RLock()
+	info, ok := engines[name]
+	enginesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("неизвестный тип коллекции %q, доступные движки: %s", name, strings.Join(engineNames(), ", "))
+	}
+	return info, nil
+}
+
+// newEngine создает дерево движка name с параметрами options и правилами
+// сравнения ключей collation.
+func newEngine(name string, options map[string]string, collation *Collation) (Tree, error) {
+	info, err := LookupEngine(name)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := info.resolveOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return info.New(resolved, collation)
+}
+
+// resolveOptions проверяет параметры по схеме движка и подставляет значения
+// по умолчанию.
+func (info *EngineInfo) resolveOptions(options map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(info.Options))
+	known := make(map[string]bool, len(info.Options))
+	for _, option := range info.Options {
+		known[option.Name] = true
+		value, ok := options[option.Name]
+		if !ok {
+			value = option.Default
+		}
+		if option.Type == "int" {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < option.Min {
+				return nil, fmt.Errorf("параметр %s движка %s должен быть целым числом не меньше %d", option.Name, info.Name, option.Min)
+			}
+		}
+		if option.Type == "duration" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("параметр %s движка %s должен быть длительностью вида 1h30m", option.Name, info.Name)
+			}
+		}
+		resolved[option.Name] = value
+	}
+	for name := range options {
+		if !known[name] {
+			return nil, fmt.Errorf("у движка %s нет параметра %s", info.Name, name)
+		}
+	}
+	return resolved, nil
+}
+
+// parseEngineOptions разбирает параметры движка вида имя=значение.
+func parseEngineOptions(args []string) (map[string]string, error) {
+	options := make(map[string]string, len(args))
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("параметр движка должен иметь вид имя=значение: %s", arg)
+		}
+		options[name] = value
+	}
+	return options, nil
+}
+
+func init() {
+	RegisterEngine(&EngineInfo{
+		Name:         "avl",
+		Description:  "АВЛ-дерево",
+		Capabilities: EngineCapabilities{Ordered: true, Persistent: true},
+		New: func(_ map[string]string, collation *Collation) (Tree, error) {
+			return &AVLTree{collation: collation}, nil
+		},
+	})
+	RegisterEngine(&EngineInfo{
+		Name:         "redblack",
+		Description:  "Красно-черное дерево",
+		Capabilities: EngineCapabilities{Ordered: true, Persistent: true},
+		New: func(_ map[string]string, collation *Collation) (Tree, error) {
+			return &RedBlackTree{collation: collation}, nil
+		},
+	})
+	RegisterEngine(&EngineInfo{
+		Name:        "btree",
+		Description: "B-дерево",
+		Options: []EngineOption{{
+			Name: "degree", Type: "int", Default: strconv.Itoa(defaultBTreeDegree), Min: 2,
+			Description: "минимальная степень: узел хранит до 2*degree-1 ключей",
+		}},
+		Capabilities: EngineCapabilities{Ordered: true, Persistent: true},
+		New: func(options map[string]string, collation *Collation) (Tree, error) {
+			degree, _ := strconv.Atoi(options["degree"])
+			tree := NewBTreeWithDegree(degree)
+			tree.collation = collation
+			return tree, nil
+		},
+	})
+	RegisterEngine(&EngineInfo{
+		Name:         "map",
+		Description:  "Хеш-таблица без порядка ключей",
+		Capabilities: EngineCapabilities{Persistent: true},
+		New: func(_ map[string]string, collation *Collation) (Tree, error) {
+			return &MapCollection{Data: make(map[string]interface{}), collation: collation}, nil
+		},
+	})
+	RegisterEngine(&EngineInfo{
+		Name:        timeSeriesEngine,
+		Description: "Временной ряд: ключи - метки времени с необязательной серией, хранение по партициям",
+		Options: []EngineOption{{
+			Name: "partition", Type: "duration", Default: "1h",
+			Description: "ширина партиции по времени",
+		}, {
+			Name: "retention", Type: "duration", Default: "0s",
+			Description: "срок хранения: более старые партиции удаляются; 0 - хранить всё",
+		}},
+		Capabilities: EngineCapabilities{Ordered: true, Persistent: true},
+		New: func(options map[string]string, collation *Collation) (Tree, error) {
+			if collation != nil {
+				return nil, fmt.Errorf("ключи временного ряда сравниваются побайтово, правила %s недоступны", collation.Name)
+			}
+			partition, _ := time.ParseDuration(options["partition"])
+			retention, _ := time.ParseDuration(options["retention"])
+			if partition <= 0 {
+				return nil, fmt.Errorf("ширина партиции временного ряда должна быть положительной")
+			}
+			return NewTimeSeries(partition, retention), nil
+		},
+	})
+	RegisterEngine(&EngineInfo{
+		Name:         queueEngine,
+		Description:  "Очередь FIFO: извлечение в порядке добавления",
+		Capabilities: EngineCapabilities{Ordered: true, Persistent: true},
+		New: func(_ map[string]string, collation *Collation) (Tree, error) {
+			return newDeque(false, collation)
+		},
+	})
+	RegisterEngine(&EngineInfo{
+		Name:         stackEngine,
+		Description:  "Стек LIFO: извлечение в порядке, обратном добавлению",
+		Capabilities: EngineCapabilities{Ordered: true, Persistent: true},
+		New: func(_ map[string]string, collation *Collation) (Tree, error) {
+			return newDeque(true, collation)
+		},
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// engineTestKey возвращает i-й ключ, допустимый для дерева движка.
+func engineTestKey(tree Tree, i int) string {
+	switch tree.(type) {
+	case *Deque:
+		return fmt.Sprintf("%020d", i+1)
+	case *TimeSeries:
+		return timeSeriesKey(time.Date(2024, 1, 1, 0, i, 0, 0, time.UTC), "")
+	}
+	return fmt.Sprintf("k%03d", i)
+}
+
+// Движок с флагом Persistent записывает в SaveToFile все ключи и значения,
+// а деревья, умеющие LoadFromFile, восстанавливаются из файла полностью.
+func TestPersistentEnginesSaveEverything(t *testing.T) {
+	for _, info := range Engines() {
+		if !info.Capabilities.Persistent {
+			continue
+		}
+		t.Run(info.Name, func(t *testing.T) {
+			tree, err := newEngine(info.Name, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 50; i++ {
+				if err := tree.Insert(engineTestKey(tree, i), fmt.Sprintf("value-%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			filename := filepath.Join(t.TempDir(), "tree.json")
+			if err := tree.SaveToFile(filename); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 50; i++ {
+				if key := engineTestKey(tree, i); !strings.Contains(string(data), key) {
+					t.Fatalf("ключ %s не сохранен", key)
+				}
+				if value := fmt.Sprintf(`"value-%d"`, i); !strings.Contains(string(data), value) {
+					t.Fatalf("значение %s не сохранено", value)
+				}
+			}
+
+			restored, err := newEngine(info.Name, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loader, ok := restored.(interface{ LoadFromFile(string) error })
+			if !ok {
+				return
+			}
+			if err := loader.LoadFromFile(filename); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := tree.GetRange("", maxKey)
+			got, _ := restored.GetRange("", maxKey)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("после загрузки ключи %v, ожидалось %v", got, want)
+			}
+			for i, key := range want {
+				if value, err := restored.Get(key); err != nil || value != fmt.Sprintf("value-%d", i) {
+					t.Errorf("%s = %v, %v", key, value, err)
+				}
+			}
+		})
+	}
+}
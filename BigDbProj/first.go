@@ -2,12 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,46 +32,33 @@ func handlePoolsAndSchemas(pools *AllPools, args []string) error {
 		if len(args) < 3 {
 			return fmt.Errorf("недостаточно аргументов для команды add-schema")
 		}
-		pool, err := pools.GetPools(args[1])
-		if err != nil {
-			return err
-		}
-		pool.AddSchema(args[2])
+		return pools.WithPool(args[1], func(pool *Pools) error {
+			pool.AddSchema(args[2])
+			return nil
+		})
 	case "remove-schema":
 		if len(args) < 3 {
 			return fmt.Errorf("недостаточно аргументов для команды remove-schema")
 		}
-		pool, err := pools.GetPools(args[1])
-		if err != nil {
-			return err
-		}
-		pool.RemoveSchema(args[2])
+		return pools.WithPool(args[1], func(pool *Pools) error {
+			pool.RemoveSchema(args[2])
+			return nil
+		})
 	case "add-collection":
 		if len(args) < 5 {
 			return fmt.Errorf("недостаточно аргументов для команды add-collection")
 		}
-		collectionType := args[4]
-		pool, err := pools.GetPools(args[1])
+		options, err := parseEngineOptions(args[5:])
 		if err != nil {
 			return err
 		}
-		treeCollection := NewTreeCollection(collectionType)
-		if err = pool.AddCollection(args[2], args[3], *treeCollection); err != nil {
-			return err
-		}
-	case "remove-collection":
-		if len(args) < 4 {
-			return fmt.Errorf("недостаточно аргументов для команды remove-collection")
-		}
-		pool, err := pools.GetPools(args[1])
+		treeCollection, err := NewTreeCollection(args[4], options)
 		if err != nil {
 			return err
 		}
-		schema, err := pool.GetSchema(args[2])
-		if err != nil {
-			return err
-		}
-		schema.RemoveCollection(args[3])
+		return pools.WithPool(args[1], func(pool *Pools) error {
+			return pool.AddCollection(args[2], args[3], treeCollection)
+		})
 	default:
 		return fmt.Errorf("неизвестная команда")
 	}
@@ -75,36 +66,759 @@ func handlePoolsAndSchemas(pools *AllPools, args []string) error {
 }
 
 func RunCommand(pools *AllPools, command string, cr *ChainOfResponsibility) error {
-	args := strings.Fields(command)
+	args, err := SplitCommand(command)
+	if err != nil {
+		return err
+	}
+	return runCommand(pools, args, cr, commandSession{})
+}
+
+// commandSession задает транзакцию, в которой выполняется команда, и таймаут
+// ожидания блокировок для этого запроса (0 - таймаут транзакции).
+type commandSession struct {
+	tx          *Transaction
+	lockTimeout time.Duration
+}
+
+// inTransaction выполняет fn над коллекцией из args[1:4] в транзакции сессии.
+func inTransaction(pools *AllPools, session commandSession, args []string, fn func(tx *Transaction, tc *TreeCollection) error) error {
+	tc, err := pools.GetCollection(args[1], args[2], args[3])
+	if err != nil {
+		return err
+	}
+	return session.run(pools, func(tx *Transaction) error {
+		return fn(tx, tc)
+	})
+}
+
+// exclusively выполняет fn над коллекцией из args[1:4] под исключительной
+// блокировкой транзакции сессии, чтобы схема, индексы и движок коллекции не
+// менялись, пока ее используют другие транзакции.
+func exclusively(pools *AllPools, session commandSession, args []string, fn func(tc *TreeCollection) error) error {
+	return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+		if err := tx.Lock(tc, ExclusiveLock); err != nil {
+			return err
+		}
+		return fn(tc)
+	})
+}
+
+// lockAll берет блокировку mode на все коллекции всех пулов.
+func lockAll(pools *AllPools, tx *Transaction, mode LockMode) error {
+	for _, tc := range pools.collections() {
+		if err := tx.Lock(tc, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run выполняет fn в транзакции сессии, а если она не задана - в отдельной
+// автоматически фиксируемой транзакции.
+func (session commandSession) run(pools *AllPools, fn func(tx *Transaction) error) error {
+	if session.tx == nil {
+		return pools.Transactions().Autocommit(func(tx *Transaction) error {
+			if session.lockTimeout > 0 {
+				tx.LockTimeout = session.lockTimeout
+			}
+			return fn(tx)
+		})
+	}
+	tx := session.tx
+	return tx.Do(func() error {
+		if session.lockTimeout > 0 {
+			defer func(timeout time.Duration) { tx.LockTimeout = timeout }(tx.LockTimeout)
+			tx.LockTimeout = session.lockTimeout
+		}
+		return fn(tx)
+	})
+}
+
+func runCommand(pools *AllPools, args []string, cr *ChainOfResponsibility, session commandSession) error {
 	if len(args) == 0 {
 		return fmt.Errorf("не указана команда")
 	}
 
 	switch args[0] {
-	case "add-pool", "remove-pool", "add-schema", "remove-schema", "add-collection", "remove-collection":
+	case "add-pool", "remove-pool", "add-schema", "remove-schema", "add-collection":
 		return handlePoolsAndSchemas(pools, args)
+	case "remove-collection":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды remove-collection")
+		}
+		// коллекция удаляется только после завершения транзакций, которые ее
+		// используют
+		return exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return pools.WithSchema(args[1], args[2], func(schema *Schema) error {
+				schema.RemoveCollection(args[3])
+				return nil
+			})
+		})
 	case "insert-data":
-		if len(args) < 5 {
+		if len(args) < 6 {
 			return fmt.Errorf("недостаточно аргументов для команды insert-data")
 		}
-		data := TData{Key: args[3], Value: args[4]}
-		insertCmd := &InsertCommand{InitialVersion: data}
-		cr.AddHandler(insertCmd)
-		fmt.Println("Команда вставки добавлена")
-	case "update-data":
-		if len(args) < 4 {
-			return fmt.Errorf("недостаточно аргументов для команды update-data")
+		ttl, err := parseTTLFlag(args[0], args[6:])
+		if err != nil {
+			return err
+		}
+		data := TData{Key: args[4], Value: args[5], Timestamp: time.Now()}
+		err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			key, err := tc.ResolveKey(data.Key)
+			if err != nil {
+				return err
+			}
+			// запись журнала временного ряда получает метку точки
+			if t, _, err := parseTimeSeriesKey(key); err == nil && tc.Engine() == timeSeriesEngine {
+				data.Timestamp = t
+			}
+			if tc.Multimap() {
+				return tx.Add(tc, key, data.Value, expiresAfter(ttl))
+			}
+			return tx.InsertWithExpiry(tc, key, data.Value, expiresAfter(ttl))
+		})
+		if err != nil {
+			return err
+		}
+		insertCmd := &InsertCommand{InitialVersion: data}
+		cr.AddHandler(insertCmd)
+		fmt.Println("Команда вставки добавлена")
+	case "update-data":
+		if len(args) < 6 {
+			return fmt.Errorf("недостаточно аргументов для команды update-data")
+		}
+		ttl, err := parseTTLFlag(args[0], args[6:])
+		if err != nil {
+			return err
+		}
+		err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			key, err := tc.ResolveKey(args[4])
+			if err != nil {
+				return err
+			}
+			if ttl > 0 {
+				return tx.UpdateWithExpiry(tc, key, args[5], expiresAfter(ttl))
+			}
+			return tx.Update(tc, key, args[5])
+		})
+		if err != nil {
+			return err
+		}
+		updateCmd := &UpdateCommand{UpdateExpression: args[5]}
+		cr.AddHandler(updateCmd)
+		fmt.Println("Команда обновления добавлена")
+	case "delete-data":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды delete-data")
+		}
+		if len(args) > 6 {
+			return fmt.Errorf("лишние аргументы команды delete-data: значения с пробелами заключите в кавычки")
+		}
+		err := inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			key, err := tc.ResolveKey(args[4])
+			if err != nil {
+				return err
+			}
+			// в мультиотображении можно удалить одно значение ключа
+			if len(args) > 5 {
+				if !tc.Multimap() {
+					return fmt.Errorf("лишние аргументы команды delete-data: значения с пробелами заключите в кавычки")
+				}
+				return tx.RemoveValue(tc, key, args[5])
+			}
+			return tx.Remove(tc, key)
+		})
+		if err != nil {
+			return err
+		}
+		deleteCmd := &DisposeCommand{}
+		cr.AddHandler(deleteCmd)
+		fmt.Println("Команда удаления добавлена")
+	case "create-index":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды create-index")
+		}
+		engine := "avl"
+		if len(args) > 5 {
+			engine = args[5]
+		}
+		err := exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.CreateIndex(args[4], engine, false)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Индекс по полю", args[4], "создан")
+	case "add-unique":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды add-unique")
+		}
+		engine := "avl"
+		if len(args) > 5 {
+			engine = args[5]
+		}
+		err := exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.CreateIndex(args[4], engine, true)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Поле", args[4], "объявлено уникальным")
+	case "drop-index":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды drop-index")
+		}
+		err := exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.DropIndex(args[4])
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Индекс по полю", args[4], "удален")
+	case "find-by-index":
+		if len(args) < 6 {
+			return fmt.Errorf("недостаточно аргументов для команды find-by-index")
+		}
+		minValue := parseIndexArgument(args[5])
+		maxValue := minValue
+		if len(args) > 6 {
+			maxValue = parseIndexArgument(args[6])
+		}
+		err := inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			keys, err := tc.FindByIndex(args[4], minValue, maxValue)
+			if err != nil {
+				return err
+			}
+			for i, key := range keys {
+				keys[i] = tc.formatKey(key)
+			}
+			fmt.Println("Найденные ключи:", keys)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	case "set-value-schema":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды set-value-schema")
+		}
+		schema, err := ParseValueSchema(args[4])
+		if err != nil {
+			return err
+		}
+		err = exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.SetValueSchema(schema)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Схема значений коллекции", args[3], "установлена")
+	case "set-key-schema":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды set-key-schema")
+		}
+		schema, err := ParseKeySchema(args[4])
+		if err != nil {
+			return err
+		}
+		err = exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.SetKeySchema(schema)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Схема ключей коллекции", args[3], "установлена")
+	case "get-values":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды get-values")
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			key, err := tc.ResolveKey(args[4])
+			if err != nil {
+				return err
+			}
+			values, err := tc.Values(key)
+			if err != nil {
+				return err
+			}
+			for i, value := range values {
+				fmt.Printf("%d: %v\n", i+1, value)
+			}
+			fmt.Println("Значений ключа", args[4]+":", len(values))
+			return nil
+		})
+	case "get-prefix":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды get-prefix")
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			schema := tc.KeySchema()
+			if schema == nil {
+				return fmt.Errorf("у коллекции %s не объявлена схема ключей", args[3])
+			}
+			prefix, err := schema.ParseTuple(args[4], true)
+			if err != nil {
+				return err
+			}
+			entries, err := tc.GetPrefix(prefix)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				fmt.Printf("%s: %v\n", tc.formatKey(entry.Key), entry.Value)
+			}
+			fmt.Println("Найдено ключей:", len(entries))
+			return nil
+		})
+	case "window", "downsample":
+		if len(args) < 6 || (args[0] == "downsample" && len(args) < 7) {
+			return fmt.Errorf("недостаточно аргументов для команды %s", args[0])
+		}
+		from, err := parseTimeArgument(args[4])
+		if err != nil {
+			return err
+		}
+		to, err := parseTimeArgument(args[5])
+		if err != nil {
+			return err
+		}
+		flags := args[6:]
+		var bucket time.Duration
+		if args[0] == "downsample" {
+			if bucket, err = time.ParseDuration(args[6]); err != nil {
+				return fmt.Errorf("некорректный интервал прореживания: %s", args[6])
+			}
+			flags = args[7:]
+		}
+		series, field := "", ""
+		for i := 0; i < len(flags); i += 2 {
+			if i+1 >= len(flags) {
+				return fmt.Errorf("не указано значение флага %s", flags[i])
+			}
+			switch flags[i] {
+			case "--series":
+				series = flags[i+1]
+			case "--field":
+				field = flags[i+1]
+			default:
+				return fmt.Errorf("неизвестный флаг %s", flags[i])
+			}
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			if args[0] == "window" {
+				points, err := tc.Window(series, from, to)
+				if err != nil {
+					return err
+				}
+				for _, point := range points {
+					fmt.Println(timeSeriesKey(point.Time, point.Series)+":", point.Value)
+				}
+				fmt.Println("Точек в окне:", len(points))
+				return nil
+			}
+			buckets, err := tc.Downsample(series, from, to, bucket, field)
+			if err != nil {
+				return err
+			}
+			for _, b := range buckets {
+				fmt.Printf("%s: count = %d, min = %v, max = %v, avg = %v\n", b.Start.UTC().Format(time.RFC3339), b.Count, b.Min, b.Max, b.Avg)
+			}
+			fmt.Println("Интервалов:", len(buckets))
+			return nil
+		})
+	case "set-retention":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды set-retention")
+		}
+		retention, err := time.ParseDuration(args[4])
+		if err != nil {
+			return fmt.Errorf("некорректный срок хранения: %s", args[4])
+		}
+		err = exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.SetRetention(retention)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Срок хранения временного ряда", args[3], "установлен:", retention)
+	case "push":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды push")
+		}
+		if len(args) > 5 {
+			return fmt.Errorf("лишние аргументы команды push: значения с пробелами заключите в кавычки")
+		}
+		var key string
+		err := inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			var err error
+			key, err = tx.Push(tc, args[4])
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Элемент добавлен с ключом", key)
+	case "pop":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды pop")
+		}
+		opts, err := parsePopFlags(args[4:])
+		if err != nil {
+			return err
+		}
+		message, err := PopWait(pools, session, args, opts, nil)
+		if err != nil {
+			return err
+		}
+		printMessage(message)
+	case "peek":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды peek")
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			message, err := tc.Peek()
+			if err != nil {
+				return err
+			}
+			printMessage(message)
+			return nil
+		})
+	case "ack":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды ack")
+		}
+		err := inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			return tx.Ack(tc, args[4])
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Элемент", args[4], "подтвержден и удален")
+	case "alter-collection":
+		if len(args) < 6 {
+			return fmt.Errorf("недостаточно аргументов для команды alter-collection")
+		}
+		eager := false
+		var opArgs []string
+		for _, arg := range args[4:] {
+			switch arg {
+			case "--eager":
+				eager = true
+			case "--lazy":
+				eager = false
+			default:
+				opArgs = append(opArgs, arg)
+			}
+		}
+		if len(opArgs) < 2 {
+			return fmt.Errorf("недостаточно аргументов для команды alter-collection")
+		}
+		m := SchemaMigration{Op: opArgs[0], Field: opArgs[1]}
+		switch m.Op {
+		case MigrationAddField, MigrationChangeType:
+			if len(opArgs) < 3 {
+				return fmt.Errorf("недостаточно аргументов для операции %s", m.Op)
+			}
+			m.Type = opArgs[2]
+			// тип можно задать описанием поля с вложенными fields или items
+			if strings.HasPrefix(m.Type, "{") {
+				var spec FieldSpec
+				if err := json.Unmarshal([]byte(m.Type), &spec); err != nil {
+					return fmt.Errorf("некорректное описание поля: %v", err)
+				}
+				m.Type, m.Fields, m.Items = spec.Type, spec.Fields, spec.Items
+			}
+			if len(opArgs) > 3 {
+				m.Default = parseIndexArgument(opArgs[3])
+			}
+		case MigrationRenameField:
+			if len(opArgs) < 3 {
+				return fmt.Errorf("недостаточно аргументов для операции %s", m.Op)
+			}
+			m.NewName = opArgs[2]
+		}
+		err := exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.AlterValueSchema(m, eager)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Схема значений коллекции", args[3], "изменена")
+	case "show-value-schema":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды show-value-schema")
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			schema := tc.ValueSchema()
+			if schema == nil {
+				fmt.Println("У коллекции", args[3], "нет схемы значений")
+				return nil
+			}
+			data, err := json.Marshal(schema)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Схема значений коллекции", args[3]+":", string(data))
+			return nil
+		})
+	case "aggregate":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды aggregate")
+		}
+		field, minValue, maxValue := "", "", maxKey
+		for i := 5; i < len(args); i += 2 {
+			if i+1 >= len(args) {
+				return fmt.Errorf("не указано значение флага %s", args[i])
+			}
+			switch args[i] {
+			case "--field":
+				field = args[i+1]
+			case "--from":
+				minValue = args[i+1]
+			case "--to":
+				maxValue = args[i+1]
+			default:
+				return fmt.Errorf("неизвестный флаг %s", args[i])
+			}
+		}
+		var result *AggregateResult
+		err := inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			minValue, maxValue, err := tc.ResolveRange(minValue, maxValue)
+			if err != nil {
+				return err
+			}
+			result, err = tc.Aggregate(args[4], field, minValue, maxValue)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s = %v (учтено ключей: %d)\n", args[4], result.Value, result.Count)
+	case "rank", "key-at", "count-range":
+		if len(args) < 5 || (args[0] == "count-range" && len(args) < 6) {
+			return fmt.Errorf("недостаточно аргументов для команды %s", args[0])
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			switch args[0] {
+			case "rank":
+				key, err := tc.ResolveKey(args[4])
+				if err != nil {
+					return err
+				}
+				rank, err := tc.Rank(key)
+				if err != nil {
+					return err
+				}
+				fmt.Println("Ранг ключа", args[4]+":", rank)
+			case "key-at":
+				k, err := strconv.Atoi(args[4])
+				if err != nil {
+					return fmt.Errorf("некорректный номер ключа: %s", args[4])
+				}
+				key, err := tc.KeyAt(k)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Ключ номер %d: %s\n", k, tc.formatKey(key))
+			case "count-range":
+				minValue, maxValue, err := tc.ResolveRange(args[4], args[5])
+				if err != nil {
+					return err
+				}
+				count, err := tc.CountRange(minValue, maxValue)
+				if err != nil {
+					return err
+				}
+				fmt.Println("Ключей в диапазоне:", count)
+			}
+			return nil
+		})
+	case "convert-collection":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды convert-collection")
+		}
+		options, err := parseEngineOptions(args[5:])
+		if err != nil {
+			return err
+		}
+		err = exclusively(pools, session, args, func(tc *TreeCollection) error {
+			return tc.Convert(args[4], options)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Начат перевод коллекции", args[3], "на движок", args[4])
+	case "conversion-status":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды conversion-status")
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			status, ok := tc.ConversionStatus()
+			if !ok {
+				return fmt.Errorf("коллекция %s не переводилась на другой движок", args[3])
+			}
+			fmt.Printf("%s -> %s: скопировано %d из %d, повторно перенесено %d\n", status.From, status.To, status.Copied, status.Total, status.Replayed)
+			switch {
+			case status.Error != "":
+				fmt.Println("Перевод прерван:", status.Error)
+			case status.Done:
+				fmt.Println("Перевод завершен за", status.Finished.Sub(status.Started))
+			default:
+				fmt.Println("Перевод выполняется")
+			}
+			return nil
+		})
+	case "list-engines":
+		for _, info := range Engines() {
+			var capabilities []string
+			if info.Capabilities.Ordered {
+				capabilities = append(capabilities, "ordered")
+			}
+			if info.Capabilities.Persistent {
+				capabilities = append(capabilities, "persistent")
+			}
+			if info.Capabilities.Concurrent {
+				capabilities = append(capabilities, "concurrent")
+			}
+			fmt.Printf("%s - %s [%s]\n", info.Name, info.Description, strings.Join(capabilities, ", "))
+			for _, option := range info.Options {
+				fmt.Printf("  %s=<%s> (по умолчанию %s): %s\n", option.Name, option.Type, option.Default, option.Description)
+			}
+		}
+	case "list-collations":
+		for _, collation := range Collations() {
+			fmt.Printf("%s - %s\n", collation.Name, collation.Description)
+		}
+	case "string-pool-stats":
+		stats := GetStringPools().Stats()
+		fmt.Printf("Строк в пуле: %d, ссылок: %d, байт: %d, сэкономлено байт: %d\n", stats.Entries, stats.References, stats.Bytes, stats.BytesSaved)
+		fmt.Printf("Обращений: %d, попаданий: %d (%.1f%%)\n", stats.Lookups, stats.Hits, stats.HitRate*100)
+	case "set-cache":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды set-cache")
+		}
+		budget, err := parseByteSize(args[4])
+		if err != nil {
+			return err
+		}
+		policy := ""
+		if len(args) > 5 {
+			policy = args[5]
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, ExclusiveLock); err != nil {
+				return err
+			}
+			if err := tc.SetCacheLimit(budget, policy); err != nil {
+				return err
+			}
+			if budget == 0 {
+				fmt.Println("Режим кэша коллекции", args[3], "выключен")
+			} else {
+				fmt.Println("Бюджет памяти коллекции", args[3]+":", budget, "байт")
+			}
+			return nil
+		})
+	case "cache-stats":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды cache-stats")
+		}
+		return inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			stats, ok := tc.CacheStats()
+			if !ok {
+				return fmt.Errorf("режим кэша для коллекции %s не включен", args[3])
+			}
+			fmt.Printf("Политика: %s, занято %d из %d байт, ключей: %d\n", stats.Policy, stats.Used, stats.Budget, stats.Keys)
+			fmt.Printf("Попаданий: %d, промахов: %d, вытеснено: %d\n", stats.Hits, stats.Misses, stats.Evictions)
+			return nil
+		})
+	case "query":
+		if len(args) < 2 {
+			return fmt.Errorf("недостаточно аргументов для команды query")
+		}
+		result, err := ExecuteQuery(pools, session, strings.Join(args[1:], " "))
+		if err != nil {
+			return err
+		}
+		fmt.Println("План:", result.Plan)
+		for _, row := range result.Rows {
+			data, err := json.Marshal(row)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		}
+		fmt.Println("Затронуто ключей:", result.Affected)
+	case "begin-tx":
+		// необязательный аргумент - время простоя, после которого транзакция
+		// откатывается
+		var idle time.Duration
+		if len(args) > 1 {
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				return fmt.Errorf("некорректное время простоя транзакции: %s", args[1])
+			}
+			idle = d
+		}
+		tx := pools.Transactions().Begin()
+		if idle > 0 {
+			tx.SetIdleTimeout(idle)
+		}
+		fmt.Println("Начата транзакция", tx.ID)
+	case "commit-tx", "rollback-tx":
+		if len(args) < 2 {
+			return fmt.Errorf("недостаточно аргументов для команды %s", args[0])
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("некорректный номер транзакции: %s", args[1])
 		}
-		updateCmd := &UpdateCommand{UpdateExpression: args[3]}
-		cr.AddHandler(updateCmd)
-		fmt.Println("Команда обновления добавлена")
-	case "delete-data":
+		if args[0] == "commit-tx" {
+			return pools.Transactions().Commit(id)
+		}
+		return pools.Transactions().Rollback(id)
+	case "in-tx":
 		if len(args) < 3 {
-			return fmt.Errorf("недостаточно аргументов для команды delete-data")
+			return fmt.Errorf("недостаточно аргументов для команды in-tx")
 		}
-		deleteCmd := &DisposeCommand{}
-		cr.AddHandler(deleteCmd)
-		fmt.Println("Команда удаления добавлена")
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("некорректный номер транзакции: %s", args[1])
+		}
+		if session.tx, err = pools.Transactions().Get(id); err != nil {
+			return err
+		}
+		return runCommand(pools, args[2:], cr, session)
 	case "get-data":
 		if len(args) < 2 {
 			return fmt.Errorf("недостаточно аргументов для команды get-data")
@@ -118,18 +832,59 @@ func RunCommand(pools *AllPools, command string, cr *ChainOfResponsibility) erro
 		var dataExists bool
 		var data TData
 		data.Timestamp = time.Now()
-		cr.FirstHandler.Handle(&dataExists, &data, time.Now().Unix())
+		cr.Handle(&dataExists, &data, time.Now().Unix())
 		HandleCommand(&data)
 		fmt.Println("Команды выполнены, текущее состояние:", data.Timestamp.Format("2006-01-02 15:04:05"))
 	case "save-state":
 		if len(args) < 2 {
 			return fmt.Errorf("недостаточно аргументов для команды save-state")
 		}
-		err := pools.SaveToFile(args[1])
+		// разделяемые блокировки дают сохранить согласованное состояние:
+		// незафиксированные изменения других транзакций в файл не попадут
+		err := session.run(pools, func(tx *Transaction) error {
+			if err := lockAll(pools, tx, SharedLock); err != nil {
+				return err
+			}
+			return pools.SaveToFile(args[1])
+		})
 		if err != nil {
 			return err
 		}
 		fmt.Println("Состояние системы успешно сохранено в файл:", args[1])
+	case "load-state":
+		if len(args) < 2 {
+			return fmt.Errorf("недостаточно аргументов для команды load-state")
+		}
+		// коллекции заменяются только после завершения транзакций, которые
+		// их используют
+		err := session.run(pools, func(tx *Transaction) error {
+			if err := lockAll(pools, tx, ExclusiveLock); err != nil {
+				return err
+			}
+			return pools.LoadFromFile(args[1])
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Состояние системы загружено из файла:", args[1])
+	case "import-data":
+		if len(args) < 5 {
+			return fmt.Errorf("недостаточно аргументов для команды import-data")
+		}
+		file, err := os.Open(args[4])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		var count int
+		err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			count, err = tx.ImportData(tc, file)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("Импортировано ключей:", count)
 	case "exit":
 		return nil
 	default:
@@ -138,6 +893,83 @@ func RunCommand(pools *AllPools, command string, cr *ChainOfResponsibility) erro
 	return nil
 }
 
+// sessionFromRequest читает из параметров запроса транзакцию (tx) и таймаут
+// ожидания блокировок (lock-timeout).
+func sessionFromRequest(pools *AllPools, r *http.Request) (commandSession, error) {
+	var session commandSession
+	if id := r.URL.Query().Get("tx"); id != "" {
+		txID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return session, fmt.Errorf("некорректный номер транзакции: %s", id)
+		}
+		if session.tx, err = pools.Transactions().Get(txID); err != nil {
+			return session, err
+		}
+	}
+	if timeout := r.URL.Query().Get("lock-timeout"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return session, fmt.Errorf("некорректный lock-timeout: %s", timeout)
+		}
+		session.lockTimeout = d
+	}
+	return session, nil
+}
+
+// runScriptFile выполняет режим командной строки
+// "BigDbProj run-script file [--stop-on-error|--continue] [--tx]" и
+// возвращает код завершения процесса.
+func runScriptFile(pools *AllPools, cr *ChainOfResponsibility, args []string) int {
+	if len(args) < 1 {
+		fmt.Println("Использование: BigDbProj run-script <файл> [--stop-on-error|--continue] [--tx]")
+		return 2
+	}
+	opts, err := parseScriptFlags(args[1:])
+	if err != nil {
+		fmt.Println("Ошибка:", err)
+		return 2
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Println("Ошибка при открытии скрипта:", err)
+		return 1
+	}
+	defer file.Close()
+	report, err := RunScript(pools, cr, file, opts)
+	report.Print(os.Stdout)
+	if err != nil {
+		fmt.Println("Ошибка при чтении скрипта:", err)
+		return 1
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// writeDataError отвечает на ошибку запроса кодом HTTP по ее виду. Ошибки
+// без своего вида вызваны аргументами запроса, кроме ошибок файловой
+// системы.
+func writeDataError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &pathErr):
+		status = http.StatusInternalServerError
+	case errors.Is(err, ErrVersionMismatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrKeyNotFound), errors.Is(err, ErrValueNotFound), errors.Is(err, ErrQueueEmpty), errors.Is(err, ErrIndexOutOfRange):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNotMultimap), errors.Is(err, ErrNotQueue), errors.Is(err, ErrInvalidKey):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrDeadlock), errors.Is(err, ErrLockTimeout), errors.Is(err, ErrUniqueViolation), errors.Is(err, ErrNotInFlight):
+		status = http.StatusConflict
+	case errors.Is(err, ErrSchemaViolation):
+		status = http.StatusUnprocessableEntity
+	}
+	http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), status)
+}
+
 func HandleCommand(data *TData) {
 	data.Timestamp = time.Now()
 }
@@ -146,7 +978,11 @@ var users = map[string]string{
 	"admin": "password1234",
 }
 
+var usersMu sync.RWMutex
+
 func authenticate(username, password string) bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
 	if pass, ok := users[username]; ok {
 		return pass == password
 	}
@@ -157,6 +993,15 @@ func main() {
 	pools := InitPools()
 	cr := &ChainOfResponsibility{}
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run-script":
+			os.Exit(runScriptFile(pools, cr, os.Args[2:]))
+		case "repl":
+			os.Exit(runREPL(pools, cr, os.Args[2:]))
+		}
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		file, err := os.Open("login.html")
 		if err != nil {
@@ -219,23 +1064,541 @@ func main() {
 			http.Error(w, `{"error": "Missing command parameter"}`, http.StatusBadRequest)
 			return
 		}
-		if err := RunCommand(pools, command, cr); err != nil {
-			http.Error(w, fmt.Sprintf(`{"error": "Error executing command: %s"}`, err), http.StatusInternalServerError)
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		args, err := SplitCommand(command)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if err = runCommand(pools, args, cr, session); err != nil {
+			writeDataError(w, fmt.Errorf("Error executing command: %w", err))
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, `{"message": "Command executed successfully"}`)
 	})
 
+	http.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		text := r.URL.Query().Get("q")
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, `{"error": "Failed to read request body"}`, http.StatusBadRequest)
+				return
+			}
+			text = string(body)
+		}
+		if strings.TrimSpace(text) == "" {
+			http.Error(w, `{"error": "Missing q parameter"}`, http.StatusBadRequest)
+			return
+		}
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		result, err := ExecuteQuery(pools, session, text)
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	http.HandleFunc("/run-script", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		opts := ScriptOptions{
+			StopOnError:   r.URL.Query().Get("mode") != "continue",
+			InTransaction: r.URL.Query().Get("transaction") == "true",
+		}
+		// файл можно передать полем формы "script" или телом запроса
+		var script io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("script")
+			if err != nil {
+				http.Error(w, `{"error": "Missing script file"}`, http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			script = file
+		}
+		report, err := RunScript(pools, cr, script, opts)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+
+	http.HandleFunc("/aggregate", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		tc, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusNotFound)
+			return
+		}
+		maxValue := maxKey
+		if query.Has("to") {
+			maxValue = query.Get("to")
+		}
+		var result *AggregateResult
+		err = session.run(pools, func(tx *Transaction) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			minValue, maxValue, err := tc.ResolveRange(query.Get("from"), maxValue)
+			if err != nil {
+				return err
+			}
+			result, err = tc.Aggregate(query.Get("func"), query.Get("field"), minValue, maxValue)
+			return err
+		})
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	http.HandleFunc("/rank", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		tc, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusNotFound)
+			return
+		}
+		response := make(map[string]interface{})
+		err = pools.Transactions().Autocommit(func(tx *Transaction) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			if query.Has("index") {
+				k, err := strconv.Atoi(query.Get("index"))
+				if err != nil {
+					return fmt.Errorf("некорректный номер ключа: %s", query.Get("index"))
+				}
+				key, err := tc.KeyAt(k)
+				response["index"], response["key"] = k, tc.DisplayKey(key)
+				return err
+			}
+			key, err := tc.ResolveKey(query.Get("key"))
+			if err != nil {
+				return err
+			}
+			rank, err := tc.Rank(key)
+			response["key"], response["rank"] = tc.DisplayKey(key), rank
+			return err
+		})
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+
+	http.HandleFunc("/cache-stats", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		tc, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusNotFound)
+			return
+		}
+		stats, ok := tc.CacheStats()
+		if !ok {
+			http.Error(w, `{"error": "Cache mode is disabled"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	http.HandleFunc("/engines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Engines())
+	})
+
+	http.HandleFunc("/collations", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Collations())
+	})
+
+	http.HandleFunc("/string-pool-stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetStringPools().Stats())
+	})
+
+	http.HandleFunc("/tx/begin", func(w http.ResponseWriter, r *http.Request) {
+		var idle time.Duration
+		if value := r.URL.Query().Get("idle-timeout"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				http.Error(w, fmt.Sprintf(`{"error": %q}`, "некорректный idle-timeout: "+value), http.StatusBadRequest)
+				return
+			}
+			idle = d
+		}
+		tx := pools.Transactions().Begin()
+		if idle > 0 {
+			tx.SetIdleTimeout(idle)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"tx": %d}`, tx.ID)
+	})
+
+	http.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		key := query.Get("key")
+		if key == "" {
+			http.Error(w, `{"error": "Missing key parameter"}`, http.StatusBadRequest)
+			return
+		}
+		writeError := func(err error) { writeDataError(w, err) }
+
+		tc, err := pools.GetCollection(query.Get("pool"), query.Get("schema"), query.Get("collection"))
+		if err != nil {
+			writeError(err)
+			return
+		}
+		if key, err = tc.ResolveKey(key); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if value := query.Get("ttl"); value != "" {
+			if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+				http.Error(w, `{"error": "Invalid ttl parameter"}`, http.StatusBadRequest)
+				return
+			}
+		}
+		mode := ExclusiveLock
+		if r.Method == http.MethodGet {
+			mode = SharedLock
+		}
+		err = pools.Transactions().Autocommit(func(tx *Transaction) error {
+			if err := tx.Lock(tc, mode); err != nil {
+				return err
+			}
+			switch r.Method {
+			case http.MethodGet:
+				value, version, err := tc.GetVersioned(key)
+				if err != nil {
+					return err
+				}
+				result := map[string]interface{}{"key": tc.DisplayKey(key), "value": value, "version": version}
+				if expiresAt, err := tc.Expiry(key); err == nil && !expiresAt.IsZero() {
+					result["expiresAt"] = expiresAt
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", formatETag(version))
+				return json.NewEncoder(w).Encode(result)
+			case http.MethodPost:
+				// POST дописывает значение в список ключа мультиотображения
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				if err := tc.Add(key, string(body)); err != nil {
+					return err
+				}
+				if ttl > 0 {
+					if err := tc.Expire(key, expiresAfter(ttl)); err != nil {
+						return err
+					}
+				}
+				_, version, err := tc.GetVersioned(key)
+				if err != nil {
+					return err
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", formatETag(version))
+				return json.NewEncoder(w).Encode(map[string]interface{}{"key": tc.DisplayKey(key), "version": version})
+			case http.MethodPut:
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					return err
+				}
+				var version uint64
+				switch {
+				case r.Header.Get("If-Match") != "":
+					var expected uint64
+					if expected, err = parseETag(r.Header.Get("If-Match")); err != nil {
+						return err
+					}
+					version, err = tc.CompareAndSet(key, expected, string(body))
+				case r.Header.Get("If-None-Match") == "*":
+					version, err = tc.CompareAndSet(key, 0, string(body))
+				default:
+					version, err = tc.Put(key, string(body))
+				}
+				if err != nil {
+					return err
+				}
+				if ttl > 0 {
+					if err := tc.Expire(key, expiresAfter(ttl)); err != nil {
+						return err
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", formatETag(version))
+				return json.NewEncoder(w).Encode(map[string]interface{}{"key": tc.DisplayKey(key), "version": version})
+			case http.MethodDelete:
+				if query.Has("value") {
+					if err := tc.RemoveValue(key, query.Get("value")); err != nil {
+						return err
+					}
+				} else if r.Header.Get("If-Match") == "" {
+					if err := tc.Remove(key); err != nil {
+						return err
+					}
+				} else {
+					expected, err := parseETag(r.Header.Get("If-Match"))
+					if err != nil {
+						return err
+					}
+					if err := tc.CompareAndRemove(key, expected); err != nil {
+						return err
+					}
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"message": "Key deleted"}`)
+				return nil
+			default:
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return nil
+			}
+		})
+		if err != nil {
+			writeError(err)
+		}
+	})
+
+	// insert-batch вставляет JSON-массив пар {"key": ..., "value": ...} одним
+	// пакетом: либо все пары, либо ни одной.
+	http.HandleFunc("/insert-batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		var entries []KeyValue
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			http.Error(w, `{"error": "Body must be a JSON array of {key, value} objects"}`, http.StatusBadRequest)
+			return
+		}
+		batch := insertBatch(entries)
+		args := []string{"insert-batch", query.Get("pool"), query.Get("schema"), query.Get("collection")}
+		err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			for i := range batch {
+				key, err := tc.ResolveKey(batch[i].Key)
+				if err != nil {
+					return batch[i].wrap(i, err)
+				}
+				batch[i].Key = key
+			}
+			if err := tx.Apply(tc, batch); err != nil {
+				return err
+			}
+			// пакет, откаченный вместе с транзакцией, в журнал не попадает
+			tx.OnCommit(func() { cr.AddHandler(&BatchCommand{Batch: batch}) })
+			return nil
+		})
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"inserted": %d}`, len(batch))
+	})
+
+	// prefix возвращает пары коллекции со схемой ключей, ключи которых
+	// начинаются с кортежа prefix (JSON-массив частей).
+	http.HandleFunc("/prefix", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		type prefixEntry struct {
+			Key   interface{} `json:"key"`
+			Value interface{} `json:"value"`
+		}
+		result := []prefixEntry{}
+		args := []string{"prefix", query.Get("pool"), query.Get("schema"), query.Get("collection")}
+		err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			schema := tc.KeySchema()
+			if schema == nil {
+				return fmt.Errorf("у коллекции %s не объявлена схема ключей", query.Get("collection"))
+			}
+			prefix, err := schema.ParseTuple(query.Get("prefix"), true)
+			if err != nil {
+				return err
+			}
+			entries, err := tc.GetPrefix(prefix)
+			for _, entry := range entries {
+				result = append(result, prefixEntry{Key: tc.DisplayKey(entry.Key), Value: entry.Value})
+			}
+			return err
+		})
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+
+	// timeseries/window возвращает точки ряда с метками из [from, to], а
+	// timeseries/downsample - их агрегаты по интервалам длины bucket.
+	timeSeriesHandler := func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTimeArgument(query.Get("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeArgument(query.Get("to"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		var result interface{}
+		args := []string{r.URL.Path, query.Get("pool"), query.Get("schema"), query.Get("collection")}
+		err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+			if err := tx.Lock(tc, SharedLock); err != nil {
+				return err
+			}
+			if r.URL.Path == "/timeseries/window" {
+				result, err = tc.Window(query.Get("series"), from, to)
+				return err
+			}
+			bucket, err := time.ParseDuration(query.Get("bucket"))
+			if err != nil {
+				return fmt.Errorf("некорректный интервал прореживания: %s", query.Get("bucket"))
+			}
+			result, err = tc.Downsample(query.Get("series"), from, to, bucket, query.Get("field"))
+			return err
+		})
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+	http.HandleFunc("/timeseries/window", timeSeriesHandler)
+	http.HandleFunc("/timeseries/downsample", timeSeriesHandler)
+
+	// queue/push добавляет тело запроса в очередь или стек, queue/pop
+	// извлекает элемент, ожидая его до wait (long polling), queue/peek
+	// показывает следующий элемент, queue/ack подтверждает выданный.
+	queueHandler := func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		session, err := sessionFromRequest(pools, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != "/queue/peek" && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		args := []string{r.URL.Path, query.Get("pool"), query.Get("schema"), query.Get("collection")}
+		var result interface{}
+		switch r.URL.Path {
+		case "/queue/push":
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error": %q}`, err.Error()), http.StatusBadRequest)
+				return
+			}
+			err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+				key, err := tx.Push(tc, string(body))
+				result = map[string]string{"key": key}
+				return err
+			})
+		case "/queue/pop":
+			var opts PopOptions
+			for name, target := range map[string]*time.Duration{"wait": &opts.Wait, "visibility": &opts.Visibility} {
+				if value := query.Get(name); value != "" {
+					if *target, err = time.ParseDuration(value); err != nil || *target < 0 {
+						http.Error(w, fmt.Sprintf(`{"error": "Invalid %s parameter"}`, name), http.StatusBadRequest)
+						return
+					}
+				}
+			}
+			opts.AutoAck = query.Get("auto-ack") == "true"
+			result, err = PopWait(pools, session, args, opts, r.Context().Done())
+			if errors.Is(err, ErrQueueEmpty) {
+				// ожидание истекло, а элемент так и не появился
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case "/queue/peek":
+			err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+				if err := tx.Lock(tc, SharedLock); err != nil {
+					return err
+				}
+				result, err = tc.Peek()
+				return err
+			})
+		case "/queue/ack":
+			err = inTransaction(pools, session, args, func(tx *Transaction, tc *TreeCollection) error {
+				result = map[string]string{"acked": query.Get("key")}
+				return tx.Ack(tc, query.Get("key"))
+			})
+		}
+		if err != nil {
+			writeDataError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+	http.HandleFunc("/queue/push", queueHandler)
+	http.HandleFunc("/queue/pop", queueHandler)
+	http.HandleFunc("/queue/peek", queueHandler)
+	http.HandleFunc("/queue/ack", queueHandler)
+
 	http.HandleFunc("/get-info", func(w http.ResponseWriter, r *http.Request) {
 		type Info struct {
 			Pools map[string][]string `json:"pools"`
 		}
 		info := Info{Pools: make(map[string][]string)}
-		for poolName, pool := range pools.Pools {
-			for schemaName := range pool.schema {
-				info.Pools[poolName] = append(info.Pools[poolName], schemaName)
-			}
+		for _, poolName := range pools.PoolNames() {
+			pools.WithPool(poolName, func(pool *Pools) error {
+				info.Pools[poolName] = pool.SchemaNames()
+				return nil
+			})
 		}
 		data, err := json.Marshal(info)
 		if err != nil {
@@ -246,6 +1609,11 @@ func main() {
 		w.Write(data)
 	})
 
+	http.HandleFunc("/names", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(collectNames(pools))
+	})
+
 	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			file, err := os.Open("registration.html")
@@ -266,7 +1634,9 @@ func main() {
 		if r.Method == http.MethodPost {
 			username := r.FormValue("username")
 			password := r.FormValue("password")
+			usersMu.Lock()
 			users[username] = password
+			usersMu.Unlock()
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 		}
 
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SecondaryIndex - вторичный индекс по полю JSON-значений коллекции.
+// Ключ индекса - закодированное значение поля, разделитель 0x00 и первичный
+// ключ, поэтому индекс хранится в упорядоченном движке Tree, принимающем
+// любые ключи, и поддерживает диапазоны.
+type SecondaryIndex struct {
+	Field  string
+	Engine string
+	Unique bool
+	tree   Tree
+}
+
+var ErrUniqueViolation = errors.New("Нарушено ограничение уникальности")
+
+// fieldValue достает поле по пути вида "address.city" из значения коллекции.
+// Строковые значения разбираются как JSON.
+func fieldValue(value interface{}, path string) (interface{}, bool) {
+	if s, ok := value.(string); ok {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(s), &parsed); err != nil {
+			return nil, false
+		}
+		value = parsed
+	}
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// encodeIndexValue кодирует значение поля в строку с сохранением порядка:
+// сначала по типу (null < bool < число < строка < время), затем по значению.
+// Байты 0x00 и 0x01 в строках экранируются, чтобы 0x00 оставался разделителем.
+func encodeIndexValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "0", nil
+	case bool:
+		if v {
+			return "1t", nil
+		}
+		return "1f", nil
+	case float64:
+		return encodeNumber(v, 0), nil
+	case int:
+		return encodeInt(int64(v)), nil
+	case int64:
+		return encodeInt(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return encodeInt(i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", err
+		}
+		return encodeNumber(f, 0), nil
+	case time.Time:
+		return fmt.Sprintf("4%016x", uint64(v.UnixNano())^(1<<63)), nil
+	case string:
+		escaped := strings.NewReplacer("\x01", "\x01\x02", "\x00", "\x01\x01").Replace(v)
+		return "3" + escaped, nil
+	default:
+		return "", fmt.Errorf("поле типа %T нельзя индексировать", value)
+	}
+}
+
+// encodeNumber кодирует число как ближайшее float64 и точный остаток
+// offset целого числа относительно него, так что целые больше 2^53 не
+// совпадают между собой, а целые и дробные числа упорядочены вместе.
+func encodeNumber(f float64, offset int64) string {
+	if f == 0 {
+		// -0 и +0 - одно значение
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if f >= 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return fmt.Sprintf("2%016x%016x", bits, uint64(offset)^(1<<63))
+}
+
+func encodeInt(i int64) string {
+	f := float64(i)
+	if f >= math.MaxInt64 {
+		// float64(i) округлилось до 2^63, которое не помещается в int64
+		return encodeNumber(f, i-math.MaxInt64-1)
+	}
+	return encodeNumber(f, i-int64(f))
+}
+
+// parseIndexArgument разбирает аргумент команды как JSON-литерал или метку
+// времени RFC 3339, а если это не удается - считает его строкой.
+func parseIndexArgument(arg string) interface{} {
+	if t, err := time.Parse(time.RFC3339Nano, arg); err == nil {
+		return t
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(arg), &value); err != nil {
+		return arg
+	}
+	return value
+}
+
+func (idx *SecondaryIndex) entryKey(key string, value interface{}) (string, bool) {
+	field, ok := fieldValue(value, idx.Field)
+	if !ok {
+		return "", false
+	}
+	encoded, err := encodeIndexValue(field)
+	if err != nil {
+		return "", false
+	}
+	return encoded + "\x00" + key, true
+}
+
+// newIndexTree создает дерево индекса на движке engine. Индекс ищет по
+// диапазонам закодированных значений, поэтому движок должен быть
+// упорядоченным и принимать любые ключи.
+func newIndexTree(engine string) (Tree, error) {
+	info, err := LookupEngine(engine)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Capabilities.Ordered {
+		return nil, fmt.Errorf("движок %s не упорядочивает ключи и не подходит для индекса", engine)
+	}
+	tree, err := newEngine(engine, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tree.(KeyValidator); ok {
+		return nil, fmt.Errorf("движок %s принимает не любые ключи и не подходит для индекса", engine)
+	}
+	return tree, nil
+}
+
+// add и remove не считают ошибкой уже существующую или уже удаленную
+// запись: одинаковые поля значений одного ключа мультиотображения дают одну
+// запись индекса.
+func (idx *SecondaryIndex) add(key string, value interface{}) error {
+	entry, ok := idx.entryKey(key, value)
+	if !ok {
+		return nil
+	}
+	if _, err := idx.tree.Get(entry); err == nil {
+		return nil
+	}
+	if err := idx.tree.Insert(entry, nil); err != nil {
+		return fmt.Errorf("индекс по полю %s: %w", idx.Field, err)
+	}
+	return nil
+}
+
+func (idx *SecondaryIndex) remove(key string, value interface{}) error {
+	entry, ok := idx.entryKey(key, value)
+	if !ok {
+		return nil
+	}
+	if _, err := idx.tree.Get(entry); err != nil {
+		return nil
+	}
+	if err := idx.tree.Remove(entry); err != nil {
+		return fmt.Errorf("индекс по полю %s: %w", idx.Field, err)
+	}
+	return nil
+}
+
+// holders возвращает первичные ключи, у которых поле равно полю value.
+func (idx *SecondaryIndex) holders(value interface{}) []string {
+	entry, ok := idx.entryKey("", value)
+	if !ok {
+		return nil
+	}
+	entries, _ := idx.tree.GetRange(entry, entry+maxKey)
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e[len(entry):])
+	}
+	return keys
+}
+
+// checkUnique проверяет, что ни один другой ключ не держит значения
+// уникальных полей value. Вызывается до изменения дерева.
+func (tc *TreeCollection) checkUnique(key string, value interface{}) error {
+	for _, idx := range tc.indexes {
+		if !idx.Unique {
+			continue
+		}
+		for _, item := range tc.elements(value) {
+			for _, holder := range idx.holders(item) {
+				if holder != key && !tc.expired(holder) {
+					field, _ := fieldValue(item, idx.Field)
+					return fmt.Errorf("%w: значение %v поля %s уже занято ключом %s", ErrUniqueViolation, field, idx.Field, holder)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkUniqueValues проверяет, что значения values, целиком заменяющие
+// хранящиеся, не повторяют уникальные поля друг друга в индексах indexes.
+// Ключи с истекшим сроком жизни не учитываются.
+func (tc *TreeCollection) checkUniqueValues(indexes map[string]*SecondaryIndex, values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, idx := range indexes {
+		if !idx.Unique {
+			continue
+		}
+		holders := make(map[string]string)
+		for _, key := range keys {
+			if tc.expired(key) {
+				continue
+			}
+			for _, item := range tc.elements(values[key]) {
+				entry, ok := idx.entryKey("", item)
+				if !ok {
+					continue
+				}
+				if holder, exists := holders[entry]; exists && holder != key {
+					return fmt.Errorf("%w: ключи %s и %s имеют одинаковое значение поля %s", ErrUniqueViolation, holder, key, idx.Field)
+				}
+				holders[entry] = key
+			}
+		}
+	}
+	return nil
+}
+
+// emptyIndexes возвращает пустые копии индексов коллекции для перестройки.
+func (tc *TreeCollection) emptyIndexes() (map[string]*SecondaryIndex, error) {
+	indexes := make(map[string]*SecondaryIndex, len(tc.indexes))
+	for field, idx := range tc.indexes {
+		tree, err := newIndexTree(idx.Engine)
+		if err != nil {
+			return nil, err
+		}
+		indexes[field] = &SecondaryIndex{Field: idx.Field, Engine: idx.Engine, Unique: idx.Unique, tree: tree}
+	}
+	return indexes, nil
+}
+
+// indexAdd и indexRemove в мультиотображении индексируют каждое значение
+// списка; одинаковые поля значений одного ключа дают одну запись индекса,
+// поэтому список ключа всегда удаляется из индекса целиком.
+func (tc *TreeCollection) indexAdd(key string, value interface{}) error {
+	return tc.addToIndexes(tc.indexes, key, value)
+}
+
+// addToIndexes добавляет значение ключа в индексы indexes, в том числе еще
+// не установленные в коллекцию.
+func (tc *TreeCollection) addToIndexes(indexes map[string]*SecondaryIndex, key string, value interface{}) error {
+	for _, idx := range indexes {
+		for _, item := range tc.elements(value) {
+			if err := idx.add(key, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (tc *TreeCollection) indexRemove(key string, value interface{}) error {
+	for _, idx := range tc.indexes {
+		for _, item := range tc.elements(value) {
+			if err := idx.remove(key, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reindex заменяет записи индексов ключа для значения old записями для
+// value; при ошибке в индексах остаются записи для old.
+func (tc *TreeCollection) reindex(key string, old, value interface{}) error {
+	if err := tc.indexRemove(key, old); err != nil {
+		tc.indexAdd(key, old)
+		return err
+	}
+	if err := tc.indexAdd(key, value); err != nil {
+		tc.indexRemove(key, value)
+		tc.indexAdd(key, old)
+		return err
+	}
+	return nil
+}
+
+// CreateIndex строит индекс по полю field на движке engine по всем уже
+// хранящимся значениям. Уникальный индекс не строится, если значения поля
+// уже повторяются.
+func (tc *TreeCollection) CreateIndex(field, engine string, unique bool) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, exists := tc.indexes[field]; exists {
+		return errors.New("Индекс по этому полю уже существует!")
+	}
+	tree, err := newIndexTree(engine)
+	if err != nil {
+		return err
+	}
+	idx := &SecondaryIndex{Field: field, Engine: engine, Unique: unique, tree: tree}
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if tc.expired(key) {
+			continue
+		}
+		value, err := tc.stored(key)
+		if err != nil {
+			return err
+		}
+		for _, item := range tc.elements(value) {
+			if unique {
+				for _, holder := range idx.holders(item) {
+					if holder != key {
+						return fmt.Errorf("%w: ключи %s и %s имеют одинаковое значение поля %s", ErrUniqueViolation, holder, key, field)
+					}
+				}
+			}
+			if err := idx.add(key, item); err != nil {
+				return err
+			}
+		}
+	}
+	tc.indexes[field] = idx
+	return nil
+}
+
+func (tc *TreeCollection) DropIndex(field string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, exists := tc.indexes[field]; !exists {
+		return errors.New("Индекс не найден!")
+	}
+	delete(tc.indexes, field)
+	return nil
+}
+
+// FindByIndex возвращает первичные ключи, у которых значение поля field
+// лежит в диапазоне [minValue, maxValue], упорядоченные по значению поля.
+func (tc *TreeCollection) FindByIndex(field string, minValue, maxValue interface{}) ([]string, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	idx, exists := tc.indexes[field]
+	if !exists {
+		return nil, errors.New("Индекс не найден!")
+	}
+	from, err := encodeIndexValue(minValue)
+	if err != nil {
+		return nil, err
+	}
+	to, err := encodeIndexValue(maxValue)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := idx.tree.GetRange(from+"\x00", to+"\x00"+maxKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	// у ключа мультиотображения может быть несколько подходящих значений
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if key := entry[strings.IndexByte(entry, 0)+1:]; !tc.expired(key) && !seen[key] {
+			seen[key] = tc.multimap
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexEngines(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, engine := range []string{"map", "timeseries", "queue", "stack"} {
+		if err := tc.CreateIndex("age", engine, false); err == nil {
+			t.Errorf("индекс на движке %s создан", engine)
+		}
+	}
+	for _, engine := range []string{"avl", "redblack", "btree"} {
+		if err := tc.CreateIndex("age", engine, false); err != nil {
+			t.Errorf("индекс на движке %s: %v", engine, err)
+		}
+		if err := tc.DropIndex("age"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindByIndexOrder(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c btree",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.CreateIndex("age", "redblack", false); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{
+		"a": `{"age": 30}`,
+		"b": `{"age": -5}`,
+		"c": `{"age": 7}`,
+		"d": `{"age": 100}`,
+		"e": `{"name": "x"}`,
+	} {
+		if err := tc.Insert(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tc.Update("d", `{"age": 1}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := tc.FindByIndex("age", -10.0, 50.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b", "d", "a"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("FindByIndex = %v, ожидалось %v", keys, want)
+	}
+}
+
+// Ошибка записи в индекс возвращается вызывающему, а коллекция и индекс
+// остаются в прежнем состоянии.
+func TestIndexWriteErrorRollsBack(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.CreateIndex("age", "avl", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Insert("a", `{"age": 1}`); err != nil {
+		t.Fatal(err)
+	}
+	// дерево очереди отвергает записи индекса, как отверг бы сбойный движок
+	good := tc.indexes["age"].tree
+	broken, err := newEngine("queue", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.indexes["age"].tree = broken
+
+	if err := tc.Insert("b", `{"age": 2}`); err == nil {
+		t.Error("вставка при сбое индекса прошла без ошибки")
+	}
+	if _, err := tc.Get("b"); err == nil {
+		t.Error("ключ остался в коллекции после ошибки индекса")
+	}
+	if err := tc.Update("a", `{"age": 3}`); err == nil {
+		t.Error("изменение при сбое индекса прошло без ошибки")
+	}
+	tc.indexes["age"].tree = good
+	if value, err := tc.Get("a"); err != nil || value != `{"age": 1}` {
+		t.Errorf("a = %v, %v; ожидалось прежнее значение", value, err)
+	}
+	keys, err := tc.FindByIndex("age", 0.0, 10.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("FindByIndex = %v, ожидалось %v", keys, want)
+	}
+}
+
+// Значения разных типов упорядочены как nil < bool < числа < строки < время,
+// числа сравниваются точно, включая отрицательные и целые больше 2^53, а
+// записи индекса "значение\x00ключ" сохраняют порядок значений.
+func TestIndexValueEncodingOrder(t *testing.T) {
+	// группы равных значений по возрастанию
+	groups := [][]interface{}{
+		{nil},
+		{false},
+		{true},
+		{math.Inf(-1)},
+		{-1e300},
+		{int64(math.MinInt64), json.Number("-9223372036854775808")},
+		{int64(-(1 << 53) - 1), json.Number("-9007199254740993")},
+		{int64(-(1 << 53)), float64(-(1 << 53))},
+		{-1.5, json.Number("-1.5")},
+		{-1, int64(-1), -1.0},
+		{0, 0.0, math.Copysign(0, -1), json.Number("0")},
+		{0.5},
+		{1, 1.0, json.Number("1")},
+		{int64(1 << 53), float64(1 << 53), json.Number("9007199254740992")},
+		{int64(1<<53 + 1), json.Number("9007199254740993")},
+		{int64(1<<53 + 2), float64(1<<53 + 2)},
+		{int64(math.MaxInt64), json.Number("9223372036854775807")},
+		{1e300},
+		{math.Inf(1)},
+		{""},
+		{"a"},
+		{"a\x00"},
+		{"a\x00b"},
+		{"a\x01"},
+		{"a\x02"},
+		{"ab"},
+		{"я"},
+		{time.Unix(-1e9, 0)},
+		{time.Unix(0, -1)},
+		{time.Unix(0, 0)},
+		{time.Unix(1e9, 0)},
+	}
+	encoded := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, value := range group {
+			e, err := encodeIndexValue(value)
+			if err != nil {
+				t.Fatalf("encodeIndexValue(%#v): %v", value, err)
+			}
+			if len(encoded[i]) > 0 && e != encoded[i][0] {
+				t.Errorf("%#v и %#v закодированы по-разному: %q и %q", group[0], value, encoded[i][0], e)
+			}
+			encoded[i] = append(encoded[i], e)
+		}
+	}
+	for i := 1; i < len(encoded); i++ {
+		if encoded[i-1][0] >= encoded[i][0] {
+			t.Errorf("%#v закодировано не раньше %#v: %q и %q", groups[i-1][0], groups[i][0], encoded[i-1][0], encoded[i][0])
+		}
+		// ключ записи не должен переставлять соседние значения
+		prev, next := encoded[i-1][0]+"\x00"+"zzz", encoded[i][0]+"\x00"+""
+		if strings.Compare(prev, next) >= 0 {
+			t.Errorf("запись индекса %q не раньше %q", prev, next)
+		}
+	}
+}
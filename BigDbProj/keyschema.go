@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeySchema - составной типизированный ключ коллекции: кортеж частей типов
+// int, float, string, bool и timestamp. Кортеж кодируется в строку так, что
+// побайтовый порядок строк совпадает с порядком кортежей, поэтому любой
+// движок хранит такие ключи и выбирает их диапазоны без изменений:
+//   - int и timestamp (наносекунды Unix) - 16 шестнадцатеричных цифр числа
+//     с инвертированным знаковым битом;
+//   - float - 16 шестнадцатеричных цифр битов числа, преобразованных как во
+//     вторичных индексах;
+//   - bool - "0" или "1";
+//   - string - строка с экранированными байтами 0x00 и 0x01 и завершающим
+//     0x00, поэтому "ab" идет раньше "abc" и любых кортежей, начинающихся
+//     с "abc".
+type KeySchema struct {
+	Parts []FieldSpec `json:"parts"`
+}
+
+var ErrKeySchemaNotEmpty = errors.New("Схему ключей можно задать только для пустой коллекции!")
+
+var keyEscaper = strings.NewReplacer("\x01", "\x01\x02", "\x00", "\x01\x01")
+
+func ParseKeySchema(data string) (*KeySchema, error) {
+	var schema KeySchema
+	if err := json.Unmarshal([]byte(data), &schema); err != nil {
+		return nil, fmt.Errorf("некорректное описание схемы ключей: %v", err)
+	}
+	if len(schema.Parts) == 0 {
+		return nil, errors.New("в схеме ключей не объявлено ни одной части")
+	}
+	seen := make(map[string]bool)
+	for _, part := range schema.Parts {
+		if part.Name == "" {
+			return nil, errors.New("у части ключа не указано имя")
+		}
+		if seen[part.Name] {
+			return nil, fmt.Errorf("часть ключа %s объявлена дважды", part.Name)
+		}
+		seen[part.Name] = true
+		switch part.Type {
+		case FieldInt, FieldFloat, FieldString, FieldBool, FieldTimestamp:
+		default:
+			return nil, fmt.Errorf("часть ключа %s не может иметь тип %q", part.Name, part.Type)
+		}
+	}
+	return &schema, nil
+}
+
+// ParseTuple разбирает кортеж из аргумента команды: JSON-массив частей по
+// порядку схемы или одно значение первой части. При prefix кортеж может
+// быть короче схемы.
+func (ks *KeySchema) ParseTuple(arg string, prefix bool) ([]interface{}, error) {
+	var parts []interface{}
+	if strings.HasPrefix(strings.TrimSpace(arg), "[") {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(arg)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&parts); err != nil {
+			return nil, fmt.Errorf("некорректный кортеж ключа %s: %v", arg, err)
+		}
+	} else {
+		var part interface{} = arg
+		decoder := json.NewDecoder(strings.NewReader(arg))
+		decoder.UseNumber()
+		if ks.Parts[0].Type != FieldString && ks.Parts[0].Type != FieldTimestamp && decoder.Decode(&part) != nil {
+			part = arg
+		}
+		parts = []interface{}{part}
+	}
+	return ks.Coerce(parts, prefix)
+}
+
+// Coerce проверяет части кортежа по схеме и приводит их к типам частей.
+func (ks *KeySchema) Coerce(parts []interface{}, prefix bool) ([]interface{}, error) {
+	if len(parts) > len(ks.Parts) || (!prefix && len(parts) < len(ks.Parts)) {
+		return nil, fmt.Errorf("ключ должен состоять из %d частей, получено %d", len(ks.Parts), len(parts))
+	}
+	typed := make([]interface{}, len(parts))
+	for i, part := range parts {
+		value, err := coerceField(ks.Parts[i], part, ks.Parts[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		typed[i] = value
+	}
+	return typed, nil
+}
+
+// Encode кодирует кортеж или его префикс, уже приведенный к типам схемы.
+func (ks *KeySchema) Encode(parts []interface{}) string {
+	var b strings.Builder
+	for i, part := range parts {
+		switch ks.Parts[i].Type {
+		case FieldInt:
+			fmt.Fprintf(&b, "%016x", uint64(part.(int64))^(1<<63))
+		case FieldTimestamp:
+			fmt.Fprintf(&b, "%016x", uint64(part.(time.Time).UnixNano())^(1<<63))
+		case FieldFloat:
+			bits := math.Float64bits(part.(float64))
+			if bits>>63 == 0 {
+				bits ^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			fmt.Fprintf(&b, "%016x", bits)
+		case FieldBool:
+			if part.(bool) {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		case FieldString:
+			b.WriteString(keyEscaper.Replace(part.(string)))
+			b.WriteByte(0)
+		}
+	}
+	return b.String()
+}
+
+// Decode восстанавливает кортеж из ключа коллекции.
+func (ks *KeySchema) Decode(key string) ([]interface{}, error) {
+	parts := make([]interface{}, 0, len(ks.Parts))
+	malformed := fmt.Errorf("ключ %q не соответствует схеме ключей", key)
+	for _, spec := range ks.Parts {
+		switch spec.Type {
+		case FieldInt, FieldTimestamp, FieldFloat:
+			if len(key) < 16 {
+				return nil, malformed
+			}
+			bits, err := strconv.ParseUint(key[:16], 16, 64)
+			if err != nil {
+				return nil, malformed
+			}
+			key = key[16:]
+			switch spec.Type {
+			case FieldInt:
+				parts = append(parts, int64(bits^(1<<63)))
+			case FieldTimestamp:
+				parts = append(parts, time.Unix(0, int64(bits^(1<<63))).UTC())
+			case FieldFloat:
+				if bits>>63 == 1 {
+					bits ^= 1 << 63
+				} else {
+					bits = ^bits
+				}
+				parts = append(parts, math.Float64frombits(bits))
+			}
+		case FieldBool:
+			if key == "" || (key[0] != '0' && key[0] != '1') {
+				return nil, malformed
+			}
+			parts = append(parts, key[0] == '1')
+			key = key[1:]
+		case FieldString:
+			var s strings.Builder
+			i := 0
+			for ; i < len(key) && key[i] != 0; i++ {
+				if key[i] == 1 {
+					if i+1 == len(key) {
+						return nil, malformed
+					}
+					i++
+					s.WriteByte(key[i] - 1)
+				} else {
+					s.WriteByte(key[i])
+				}
+			}
+			if i == len(key) {
+				return nil, malformed
+			}
+			parts = append(parts, s.String())
+			key = key[i+1:]
+		}
+	}
+	if key != "" {
+		return nil, malformed
+	}
+	return parts, nil
+}
+
+// SetKeySchema объявляет схему составных ключей. Уже записанные строковые
+// ключи не перекодируются, поэтому коллекция должна быть пустой, а ключи
+// должны сравниваться побайтово.
+func (tc *TreeCollection) SetKeySchema(schema *KeySchema) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.purgeDue(time.Now())
+	if keys, err := tc.Tree.GetRange("", maxKey); err != nil {
+		return err
+	} else if len(keys) > 0 {
+		return ErrKeySchemaNotEmpty
+	}
+	if tc.collation.CollationName() != "binary" {
+		return fmt.Errorf("составные ключи сравниваются побайтово, а у коллекции правила %s", tc.collation.Name)
+	}
+	if tc.engine == timeSeriesEngine {
+		return errors.New("ключи временного ряда - метки времени, схема ключей для них не задается")
+	}
+	if tc.engine == queueEngine || tc.engine == stackEngine {
+		return errors.New("ключи очереди - номера добавления, схема ключей для них не задается")
+	}
+	tc.keySchema = schema
+	return nil
+}
+
+// KeySchema возвращает схему ключей коллекции или nil.
+func (tc *TreeCollection) KeySchema() *KeySchema {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.keySchema
+}
+
+// ResolveKey переводит аргумент команды в ключ коллекции: при объявленной
+// схеме ключей это полный кортеж, во временном ряду - время[/серия], иначе -
+// сама строка.
+func (tc *TreeCollection) ResolveKey(arg string) (string, error) {
+	if tc.Engine() == timeSeriesEngine {
+		return canonicalTimeSeriesKey(arg)
+	}
+	schema := tc.KeySchema()
+	if schema == nil {
+		return arg, nil
+	}
+	parts, err := schema.ParseTuple(arg, false)
+	if err != nil {
+		return "", err
+	}
+	return schema.Encode(parts), nil
+}
+
+// ResolveRange переводит границы диапазона. При схеме ключей границы -
+// префиксы кортежей, и диапазон включает все ключи, начинающиеся с to; во
+// временном ряду границы - метки времени, и to включает все серии.
+func (tc *TreeCollection) ResolveRange(from, to string) (string, string, error) {
+	if tc.Engine() == timeSeriesEngine {
+		var err error
+		if from != "" {
+			if from, err = canonicalTimeSeriesKey(from); err != nil {
+				return "", "", err
+			}
+		}
+		if to != maxKey {
+			if to, err = canonicalTimeSeriesKey(to); err != nil {
+				return "", "", err
+			}
+			to += maxKey
+		}
+		return from, to, nil
+	}
+	schema := tc.KeySchema()
+	if schema == nil {
+		return from, to, nil
+	}
+	minValue, maxValue := "", maxKey
+	if from != "" {
+		parts, err := schema.ParseTuple(from, true)
+		if err != nil {
+			return "", "", err
+		}
+		minValue = schema.Encode(parts)
+	}
+	if to != maxKey {
+		parts, err := schema.ParseTuple(to, true)
+		if err != nil {
+			return "", "", err
+		}
+		maxValue = schema.Encode(parts) + maxKey
+	}
+	return minValue, maxValue, nil
+}
+
+// DisplayKey возвращает ключ для вывода: кортеж, если у коллекции есть
+// схема ключей, иначе саму строку.
+func (tc *TreeCollection) DisplayKey(key string) interface{} {
+	schema := tc.KeySchema()
+	if schema == nil {
+		return key
+	}
+	parts, err := schema.Decode(key)
+	if err != nil {
+		return key
+	}
+	return parts
+}
+
+// GetPrefix возвращает пары, ключи которых начинаются с кортежа prefix,
+// по возрастанию ключа.
+func (tc *TreeCollection) GetPrefix(prefix []interface{}) ([]KeyValue, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if tc.keySchema == nil {
+		return nil, errors.New("у коллекции не объявлена схема ключей")
+	}
+	prefix, err := tc.keySchema.Coerce(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+	encoded := tc.keySchema.Encode(prefix)
+	entries := []KeyValue{}
+	err = tc.scanRange(encoded, encoded+maxKey, func(key string, value interface{}) bool {
+		entries = append(entries, KeyValue{Key: key, Value: value})
+		return true
+	})
+	return entries, err
+}
+
+// formatKey выводит ключ коллекции: кортеж - в виде JSON-массива.
+func (tc *TreeCollection) formatKey(key string) string {
+	display := tc.DisplayKey(key)
+	if parts, ok := display.([]interface{}); ok {
+		data, _ := json.Marshal(parts)
+		return string(data)
+	}
+	return key
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compareTuples - эталонный порядок кортежей ключа: по частям, строки
+// побайтово, короткая строка раньше своих продолжений.
+func compareTuples(a, b []interface{}) int {
+	for i := range a {
+		var result int
+		switch x := a[i].(type) {
+		case int64:
+			result = compareInt64(x, b[i].(int64))
+		case float64:
+			y := b[i].(float64)
+			switch {
+			case x < y:
+				result = -1
+			case x > y:
+				result = 1
+			}
+		case bool:
+			result = compareInts(boolInt(x), boolInt(b[i].(bool)))
+		case string:
+			result = strings.Compare(x, b[i].(string))
+		case time.Time:
+			result = x.Compare(b[i].(time.Time))
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Побайтовый порядок закодированных ключей совпадает с порядком кортежей,
+// в том числе для отрицательных чисел, целых больше 2^53 и строк с байтами
+// 0x00 и 0x01, а Decode восстанавливает кортеж.
+func TestKeySchemaEncodingPreservesOrder(t *testing.T) {
+	schema, err := ParseKeySchema(`{"parts": [
+		{"name": "tenant", "type": "string"},
+		{"name": "n", "type": "int"},
+		{"name": "x", "type": "float"},
+		{"name": "flag", "type": "bool"},
+		{"name": "at", "type": "timestamp"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := []string{"", "a", "a\x00", "a\x00b", "a\x01", "a\x02", "ab", "abc", "b", "я"}
+	ints := []int64{math.MinInt64, -(1 << 53) - 1, -(1 << 53), -1, 0, 1, 1 << 53, 1<<53 + 1, 1<<53 + 2, math.MaxInt64}
+	floats := []float64{math.Inf(-1), -1e300, -1.5, -math.SmallestNonzeroFloat64, 0, math.SmallestNonzeroFloat64, 1.5, 1 << 53, 1e300, math.Inf(1)}
+	times := []time.Time{time.Unix(-1e9, 0).UTC(), time.Unix(0, -1).UTC(), time.Unix(0, 0).UTC(), time.Unix(1e9, 5).UTC()}
+
+	rng := rand.New(rand.NewSource(1))
+	tuples := make([][]interface{}, 500)
+	for i := range tuples {
+		tuples[i] = []interface{}{
+			strs[rng.Intn(len(strs))],
+			ints[rng.Intn(len(ints))],
+			floats[rng.Intn(len(floats))],
+			rng.Intn(2) == 1,
+			times[rng.Intn(len(times))],
+		}
+	}
+	keys := make([]string, len(tuples))
+	for i, tuple := range tuples {
+		keys[i] = schema.Encode(tuple)
+		decoded, err := schema.Decode(keys[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, tuple) {
+			t.Fatalf("Decode(Encode(%v)) = %v", tuple, decoded)
+		}
+	}
+	for i := range tuples {
+		for j := range tuples {
+			if got, want := strings.Compare(keys[i], keys[j]), compareTuples(tuples[i], tuples[j]); got != want {
+				t.Fatalf("порядок ключей %v и %v: %d, ожидалось %d", tuples[i], tuples[j], got, want)
+			}
+		}
+	}
+
+	// префикс кортежа ограничивает диапазон ровно его продолжениями
+	prefix := schema.Encode([]interface{}{"a"})
+	for i, key := range keys {
+		if got, want := strings.HasPrefix(key, prefix), tuples[i][0] == "a"; got != want {
+			t.Errorf("ключ %v: префикс %q = %v", tuples[i], prefix, got)
+		}
+	}
+}
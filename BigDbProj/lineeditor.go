@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var errInterrupted = errors.New("ввод прерван")
+
+// lineEditor читает строки с терминала с редактированием, историей
+// (стрелки вверх/вниз) и дополнением по Tab. Если stdin не терминал,
+// строки читаются как есть.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	raw      bool
+	history  []string
+	complete func(line string) (prefix string, candidates []string)
+}
+
+func newLineEditor() *lineEditor {
+	fd := int(os.Stdin.Fd())
+	return &lineEditor{
+		in:  bufio.NewReader(os.Stdin),
+		out: os.Stdout,
+		fd:  fd,
+		raw: isTerminal(fd),
+	}
+}
+
+func (e *lineEditor) AddHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+// ReadLine выводит приглашение и возвращает введенную строку. На Ctrl-D в
+// пустой строке возвращается io.EOF, на Ctrl-C - errInterrupted.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	if !e.raw {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	state, err := makeRaw(e.fd)
+	if err != nil {
+		e.raw = false
+		return e.ReadLine(prompt)
+	}
+	defer restoreTerminal(e.fd, state)
+
+	var line []rune
+	pos := 0
+	historyPos := len(e.history)
+	draft := ""
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	showHistory := func(i int) {
+		if historyPos == len(e.history) {
+			draft = string(line)
+		}
+		historyPos = i
+		if i == len(e.history) {
+			line = []rune(draft)
+		} else {
+			line = []rune(e.history[i])
+		}
+		pos = len(line)
+		redraw()
+	}
+	redraw()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 21: // Ctrl-U
+			line = line[pos:]
+			pos = 0
+		case '\t':
+			line, pos = e.completeLine(prompt, line, pos)
+		case 27: // ESC-последовательности стрелок и Home/End/Delete
+			seq := e.readEscape()
+			switch seq {
+			case "[A":
+				if historyPos > 0 {
+					showHistory(historyPos - 1)
+				}
+			case "[B":
+				if historyPos < len(e.history) {
+					showHistory(historyPos + 1)
+				}
+			case "[C":
+				if pos < len(line) {
+					pos++
+				}
+			case "[D":
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "[1~", "OH":
+				pos = 0
+			case "[F", "[4~", "OF":
+				pos = len(line)
+			case "[3~":
+				if pos < len(line) {
+					line = append(line[:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if r >= 32 {
+				line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+func (e *lineEditor) readEscape() string {
+	var seq []rune
+	for len(seq) < 4 {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			break
+		}
+		seq = append(seq, r)
+		// последовательность заканчивается буквой или ~
+		if len(seq) > 1 && (r == '~' || (r >= 'A' && r <= 'Z')) {
+			break
+		}
+	}
+	return string(seq)
+}
+
+// completeLine дополняет слово перед курсором. Если вариантов несколько,
+// дописывается их общий префикс, а при его отсутствии варианты выводятся
+// списком.
+func (e *lineEditor) completeLine(prompt string, line []rune, pos int) ([]rune, int) {
+	if e.complete == nil {
+		return line, pos
+	}
+	word, candidates := e.complete(string(line[:pos]))
+	if len(candidates) == 0 {
+		return line, pos
+	}
+	common := []rune(candidates[0])
+	for _, candidate := range candidates[1:] {
+		other := []rune(candidate)
+		n := 0
+		for n < len(common) && n < len(other) && common[n] == other[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	insert := append([]rune(nil), common[len([]rune(word)):]...)
+	if len(candidates) == 1 {
+		insert = append(insert, ' ')
+	}
+	if len(insert) == 0 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+		return line, pos
+	}
+	line = append(line[:pos], append(insert, line[pos:]...)...)
+	return line, pos + len(insert)
+}
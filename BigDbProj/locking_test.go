@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestPools(t *testing.T, commands ...string) (*AllPools, *ChainOfResponsibility) {
+	t.Helper()
+	pools := InitPools()
+	cr := &ChainOfResponsibility{}
+	for _, command := range commands {
+		if err := RunCommand(pools, command, cr); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	return pools, cr
+}
+
+// Команды данных выполняются одновременно с добавлением и удалением схем и
+// коллекций и с сохранением состояния; запускать с -race.
+func TestConcurrentDataAndStructureCommands(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c btree",
+		"add-collection p s d avl",
+	)
+	const (
+		writers = 4
+		keys    = 50
+		rounds  = 20
+	)
+	state := filepath.Join(t.TempDir(), "state.json")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*keys*4+rounds*8)
+	run := func(command string) {
+		if err := RunCommand(pools, command, cr); err != nil {
+			errs <- fmt.Errorf("%s: %w", command, err)
+		}
+	}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				run(fmt.Sprintf("insert-data p s c k%d-%d v%d", w, i, i))
+				run(fmt.Sprintf("insert-data p s d k%d-%d v%d", w, i, i))
+				run(fmt.Sprintf("update-data p s c k%d-%d w%d", w, i, i))
+				if i%2 == 0 {
+					run(fmt.Sprintf("delete-data p s d k%d-%d", w, i))
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			run("add-collection p s tmp map")
+			run("remove-collection p s tmp")
+			run(fmt.Sprintf("add-schema p s%d", i))
+			run(fmt.Sprintf("add-collection p s%d c redblack", i))
+			run(fmt.Sprintf("remove-schema p s%d", i))
+			run("save-state " + state)
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for name, want := range map[string]int{"c": writers * keys, "d": writers * keys / 2} {
+		tc, err := pools.GetCollection("p", "s", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := tc.GetRange("", maxKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != want {
+			t.Errorf("в коллекции %s %d ключей, ожидалось %d", name, len(found), want)
+		}
+	}
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tc.Get("k0-7"); err != nil || value != "w7" {
+		t.Errorf("k0-7 = %v, %v; ожидалось w7", value, err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	MigrationAddField    = "add-field"
+	MigrationDropField   = "drop-field"
+	MigrationRenameField = "rename-field"
+	MigrationChangeType  = "change-type"
+)
+
+// SchemaMigration переводит значения коллекции из версии схемы From в
+// следующую. Изменяются только поля верхнего уровня; Fields и Items задают
+// вложенную структуру поля типа object или array.
+type SchemaMigration struct {
+	From    int
+	Op      string
+	Field   string
+	NewName string
+	Type    string
+	Default interface{}
+	Fields  []FieldSpec
+	Items   *FieldSpec
+}
+
+func (m SchemaMigration) fieldIndex(schema *ValueSchema) int {
+	for i, field := range schema.Fields {
+		if field.Name == m.Field {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSchema возвращает схему следующей версии, не меняя текущую.
+func (m SchemaMigration) nextSchema(schema *ValueSchema) (*ValueSchema, error) {
+	next := &ValueSchema{Version: schema.Version + 1, Fields: append([]FieldSpec(nil), schema.Fields...)}
+	i := m.fieldIndex(schema)
+	switch m.Op {
+	case MigrationAddField:
+		if i >= 0 {
+			return nil, fmt.Errorf("поле %s уже есть в схеме", m.Field)
+		}
+		field := FieldSpec{Name: m.Field, Type: m.Type, Default: m.Default, Fields: m.Fields, Items: m.Items}
+		if err := checkFieldSpec(field); err != nil {
+			return nil, err
+		}
+		next.Fields = append(next.Fields, field)
+		return next, nil
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("поле %s не найдено в схеме", m.Field)
+	}
+	switch m.Op {
+	case MigrationDropField:
+		next.Fields = append(next.Fields[:i], next.Fields[i+1:]...)
+	case MigrationRenameField:
+		if (SchemaMigration{Field: m.NewName}).fieldIndex(schema) >= 0 {
+			return nil, fmt.Errorf("поле %s уже есть в схеме", m.NewName)
+		}
+		next.Fields[i].Name = m.NewName
+	case MigrationChangeType:
+		old := next.Fields[i]
+		field := FieldSpec{Name: m.Field, Type: m.Type, Required: old.Required, Default: m.Default, Fields: m.Fields, Items: m.Items}
+		// без новой вложенной структуры поле того же типа сохраняет прежнюю
+		if m.Fields == nil && m.Items == nil && m.Type == old.Type {
+			field.Fields, field.Items = old.Fields, old.Items
+		}
+		if err := checkFieldSpec(field); err != nil {
+			return nil, err
+		}
+		next.Fields[i] = field
+	default:
+		return nil, fmt.Errorf("неизвестная операция изменения схемы: %s", m.Op)
+	}
+	return next, nil
+}
+
+// apply переводит значение в следующую версию схемы. target - схема
+// следующей версии. Исходное значение не изменяется.
+func (m SchemaMigration) apply(value interface{}, target *ValueSchema) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	result := make(map[string]interface{}, len(object)+1)
+	for name, fieldValue := range object {
+		result[name] = fieldValue
+	}
+	switch m.Op {
+	case MigrationAddField:
+		if m.Default != nil {
+			result[m.Field], _ = coerceField(FieldSpec{Name: m.Field, Type: m.Type}, m.Default, m.Field)
+		}
+	case MigrationDropField:
+		delete(result, m.Field)
+	case MigrationRenameField:
+		if fieldValue, exists := result[m.Field]; exists {
+			result[m.NewName] = fieldValue
+			delete(result, m.Field)
+		}
+	case MigrationChangeType:
+		fieldValue, exists := result[m.Field]
+		if !exists {
+			break
+		}
+		field := target.Fields[m.fieldIndex(target)]
+		if converted, ok := convertValue(fieldValue, field); ok {
+			result[m.Field] = converted
+		} else if field.Default != nil {
+			result[m.Field], _ = coerceField(field, field.Default, field.Name)
+		} else {
+			delete(result, m.Field)
+		}
+	}
+	return result
+}
+
+// migrate переводит значение в следующую версию схемы и проверяет его по
+// ней.
+func (m SchemaMigration) migrate(value interface{}, target *ValueSchema) (interface{}, error) {
+	return target.Coerce(m.apply(value, target))
+}
+
+// convertValue приводит значение поля к новому типу, при необходимости через
+// его строковое представление.
+func convertValue(value interface{}, field FieldSpec) (interface{}, bool) {
+	if typed, err := coerceField(field, value, field.Name); err == nil {
+		return typed, true
+	}
+	var s string
+	switch v := value.(type) {
+	case time.Time:
+		s = v.Format(time.RFC3339Nano)
+	default:
+		s = fmt.Sprint(v)
+	}
+	switch field.Type {
+	case FieldString:
+		return s, true
+	case FieldInt:
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return int64(f), true
+		}
+	case FieldFloat:
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, true
+		}
+	case FieldBool:
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b, true
+		}
+	case FieldTimestamp:
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// upgrade доводит значение ключа до текущей версии схемы, последовательно
+// применяя миграции. Вызывается под блокировкой коллекции.
+func (tc *TreeCollection) upgrade(key string, value interface{}) interface{} {
+	if tc.valueSchema == nil {
+		return value
+	}
+	version, ok := tc.schemaVersions[key]
+	if !ok {
+		return value
+	}
+	for ; version < tc.valueSchema.Version; version++ {
+		m, target := tc.migrations[version], tc.schemaAt(version+1)
+		value, _ = tc.mapElements(value, func(item interface{}) (interface{}, error) {
+			// AlterValueSchema уже проверил, что значение подходит под target
+			if migrated, err := m.migrate(item, target); err == nil {
+				return migrated, nil
+			}
+			return m.apply(item, target), nil
+		})
+	}
+	return value
+}
+
+// schemaAt возвращает схему версии version из истории коллекции.
+func (tc *TreeCollection) schemaAt(version int) *ValueSchema {
+	return &ValueSchema{Version: version, Fields: tc.schemaHistory[version]}
+}
+
+// ValueSchema возвращает текущую версию схемы значений или nil.
+func (tc *TreeCollection) ValueSchema() *ValueSchema {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.valueSchema
+}
+
+func (tc *TreeCollection) stampSchemaVersion(key string) {
+	if tc.valueSchema != nil {
+		tc.schemaVersions[key] = tc.valueSchema.Version
+	}
+}
+
+// AlterValueSchema добавляет версию схемы значений. В обоих режимах все
+// значения сразу переводятся и проверяются по новой схеме, бюджету памяти и
+// ограничениям уникальности, а индексы перестраиваются; при ошибке коллекция
+// не меняется. Без eager откладывается только запись переведенных значений:
+// дерево хранит старые до следующей записи ключа, а чтения переводят их на
+// лету.
+func (tc *TreeCollection) AlterValueSchema(m SchemaMigration, eager bool) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.valueSchema == nil {
+		return errors.New("У коллекции нет схемы значений!")
+	}
+	next, err := m.nextSchema(tc.valueSchema)
+	if err != nil {
+		return err
+	}
+	m.From = tc.valueSchema.Version
+
+	indexes, err := tc.emptyIndexes()
+	if err != nil {
+		return err
+	}
+	switch m.Op {
+	case MigrationDropField:
+		delete(indexes, m.Field)
+	case MigrationRenameField:
+		if idx, exists := indexes[m.Field]; exists {
+			delete(indexes, m.Field)
+			idx.Field = m.NewName
+			indexes[m.NewName] = idx
+		}
+	}
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return err
+	}
+	migrated := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		// ключи с истекшим сроком жизни тоже переводятся: до удаления
+		// они остаются в индексах
+		value, err := tc.stored(key)
+		if err != nil {
+			return err
+		}
+		migrated[key], err = tc.mapElements(value, func(item interface{}) (interface{}, error) {
+			return m.migrate(item, next)
+		})
+		if err != nil {
+			return fmt.Errorf("ключ %s: %w", key, err)
+		}
+		if err := tc.checkBudget(key, migrated[key]); err != nil {
+			return fmt.Errorf("ключ %s: %w", key, err)
+		}
+	}
+	if err := tc.checkUniqueValues(indexes, migrated); err != nil {
+		return err
+	}
+	for key, value := range migrated {
+		if err := tc.addToIndexes(indexes, key, value); err != nil {
+			return err
+		}
+	}
+
+	tc.migrations[m.From] = m
+	tc.schemaHistory[next.Version] = next.Fields
+	tc.valueSchema = next
+	tc.indexes = indexes
+	if eager {
+		for key, value := range migrated {
+			if err := tc.rewrite(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
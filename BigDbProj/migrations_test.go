@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newSchemaCollection(t *testing.T) *TreeCollection {
+	t.Helper()
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SetValueSchema(&ValueSchema{Fields: []FieldSpec{{Name: "name", Type: FieldString}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Insert("k", map[string]interface{}{"name": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// Без eager дерево хранит старое значение, а чтение переводит его на лету.
+func TestLazyAlterDefersWriteBack(t *testing.T) {
+	tc := newSchemaCollection(t)
+	m := SchemaMigration{Op: MigrationAddField, Field: "note", Type: FieldString, Default: "-"}
+	if err := tc.AlterValueSchema(m, false); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"name": "x", "note": "-"}
+	if value, err := tc.Get("k"); err != nil || !reflect.DeepEqual(value, want) {
+		t.Errorf("Get = %v, %v; ожидалось %v", value, err, want)
+	}
+	if raw, _ := tc.Tree.Get("k"); reflect.DeepEqual(raw, want) {
+		t.Error("переведенное значение записано в дерево без eager")
+	}
+}
+
+func TestAlterChecksBudget(t *testing.T) {
+	tc := newSchemaCollection(t)
+	if err := tc.SetCacheLimit(200, ""); err != nil {
+		t.Fatal(err)
+	}
+	m := SchemaMigration{Op: MigrationAddField, Field: "note", Type: FieldString, Default: strings.Repeat("x", 300)}
+	if err := tc.AlterValueSchema(m, false); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("AlterValueSchema = %v, ожидалось ErrValueTooLarge", err)
+	}
+	if version := tc.ValueSchema().Version; version != 1 {
+		t.Errorf("версия схемы после ошибки %d, ожидалась 1", version)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Мультиотображение - режим коллекции, в котором ключу соответствует
+// упорядоченный список значений: вставка дописывает значение в конец
+// списка, удалить можно одно значение или ключ целиком, а диапазоны
+// возвращают каждую пару ключ-значение. Режим включается параметром
+// multimap=true при создании коллекции. Движок хранит под ключом весь
+// список, поэтому режим работает на любом движке; схема значений,
+// индексы и агрегаты применяются к каждому значению списка отдельно.
+
+var ErrValueNotFound = errors.New("Значение не найдено!")
+
+var ErrNotMultimap = errors.New("Коллекция не является мультиотображением!")
+
+// splitMultimap отделяет от параметров движка параметр multimap.
+func splitMultimap(options map[string]string) (map[string]string, bool, error) {
+	value, ok := options["multimap"]
+	if !ok {
+		return options, false, nil
+	}
+	multimap, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("некорректное значение параметра multimap: %s", value)
+	}
+	rest := make(map[string]string, len(options)-1)
+	for option, value := range options {
+		if option != "multimap" {
+			rest[option] = value
+		}
+	}
+	return rest, multimap, nil
+}
+
+// Multimap сообщает, что коллекция - мультиотображение.
+func (tc *TreeCollection) Multimap() bool {
+	return tc.multimap
+}
+
+// elements возвращает значения ключа по отдельности: список
+// мультиотображения или само значение обычной коллекции.
+func (tc *TreeCollection) elements(value interface{}) []interface{} {
+	if list, ok := value.([]interface{}); ok && tc.multimap {
+		return list
+	}
+	return []interface{}{value}
+}
+
+// mapElements применяет fn к каждому значению списка мультиотображения, а в
+// обычной коллекции - к самому значению.
+func (tc *TreeCollection) mapElements(value interface{}, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	if !tc.multimap {
+		return fn(value)
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: значение мультиотображения должно быть списком", ErrSchemaViolation)
+	}
+	result := make([]interface{}, len(list))
+	for i, item := range list {
+		typed, err := fn(item)
+		if err != nil {
+			return nil, fmt.Errorf("значение %d: %w", i+1, err)
+		}
+		result[i] = typed
+	}
+	return result, nil
+}
+
+// sameValue сравнивает значения по их JSON-представлению.
+func sameValue(a, b interface{}) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(dataA) == string(dataB)
+}
+
+// Add дописывает значение в конец списка ключа, создавая ключ при
+// необходимости.
+func (tc *TreeCollection) Add(key string, value interface{}) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	_, err := tc.add(key, value, time.Time{})
+	return err
+}
+
+// add возвращает действие, отменяющее добавление. Ненулевой expiresAt
+// задает срок жизни ключа целиком. Вызывается под исключительной
+// блокировкой коллекции.
+func (tc *TreeCollection) add(key string, value interface{}, expiresAt time.Time) (func(), error) {
+	if !tc.multimap {
+		return nil, ErrNotMultimap
+	}
+	if _, ok := tc.version(key); !ok {
+		if err := tc.insert(key, []interface{}{value}); err != nil {
+			return nil, err
+		}
+		tc.setExpiry(key, expiresAt)
+		return func() { tc.drop(key) }, nil
+	}
+	old, err := tc.get(key)
+	if err != nil {
+		return nil, err
+	}
+	oldExpiry := tc.expires[key]
+	list := old.([]interface{})
+	if err := tc.update(key, append(list[:len(list):len(list)], value)); err != nil {
+		return nil, err
+	}
+	if !expiresAt.IsZero() {
+		tc.setExpiry(key, expiresAt)
+	}
+	return func() {
+		tc.update(key, old)
+		tc.setExpiry(key, oldExpiry)
+	}, nil
+}
+
+// Values возвращает список значений ключа в порядке добавления.
+func (tc *TreeCollection) Values(key string) ([]interface{}, error) {
+	if !tc.multimap {
+		return nil, ErrNotMultimap
+	}
+	value, err := tc.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return value.([]interface{}), nil
+}
+
+// RemoveValue удаляет из списка ключа первое значение, равное value.
+// Ключ, у которого не осталось значений, удаляется.
+func (tc *TreeCollection) RemoveValue(key string, value interface{}) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	_, err := tc.removeValue(key, value)
+	return err
+}
+
+// removeValue возвращает действие, отменяющее удаление. Вызывается под
+// исключительной блокировкой коллекции.
+func (tc *TreeCollection) removeValue(key string, value interface{}) (func(), error) {
+	if !tc.multimap {
+		return nil, ErrNotMultimap
+	}
+	if _, ok := tc.version(key); !ok {
+		return nil, ErrKeyNotFound
+	}
+	if tc.valueSchema != nil {
+		typed, err := tc.valueSchema.Coerce(value)
+		if err != nil {
+			return nil, err
+		}
+		value = typed
+	}
+	old, err := tc.get(key)
+	if err != nil {
+		return nil, err
+	}
+	list := old.([]interface{})
+	for i, item := range list {
+		if !sameValue(item, value) {
+			continue
+		}
+		if len(list) == 1 {
+			oldExpiry := tc.expires[key]
+			if err := tc.drop(key); err != nil {
+				return nil, err
+			}
+			return func() {
+				if tc.insert(key, old) == nil {
+					tc.setExpiry(key, oldExpiry)
+				}
+			}, nil
+		}
+		rest := append(append([]interface{}{}, list[:i]...), list[i+1:]...)
+		if err := tc.update(key, rest); err != nil {
+			return nil, err
+		}
+		return func() { tc.update(key, old) }, nil
+	}
+	return nil, ErrValueNotFound
+}
+
+// GetPairs возвращает каждую пару ключ-значение диапазона: для
+// мультиотображения ключ повторяется для каждого значения своего списка.
+func (tc *TreeCollection) GetPairs(minValue, maxValue string) ([]KeyValue, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	pairs := []KeyValue{}
+	err := tc.scanRange(minValue, maxValue, func(key string, value interface{}) bool {
+		for _, item := range tc.elements(value) {
+			pairs = append(pairs, KeyValue{Key: key, Value: item})
+		}
+		return true
+	})
+	return pairs, err
+}
+
+// Add дописывает значение в список ключа мультиотображения в транзакции.
+func (tx *Transaction) Add(tc *TreeCollection, key string, value interface{}, expiresAt time.Time) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	undo, err := tc.add(key, value, expiresAt)
+	tc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		undo()
+	})
+	return nil
+}
+
+// RemoveValue удаляет одно значение ключа мультиотображения в транзакции.
+func (tx *Transaction) RemoveValue(tc *TreeCollection, key string, value interface{}) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	undo, err := tc.removeValue(key, value)
+	tc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		undo()
+	})
+	return nil
+}
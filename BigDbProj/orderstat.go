@@ -0,0 +1,66 @@
+package main
+
+import "errors"
+
+// OrderStatistics - необязательная возможность движка: ранг ключа, k-й
+// ключ и число ключей диапазона за O(log n) по размерам поддеревьев.
+type OrderStatistics interface {
+	RangeCounter
+	Rank(key string) int
+	Select(k int) (string, bool)
+}
+
+var ErrIndexOutOfRange = errors.New("Номер ключа вне диапазона!")
+
+// Rank возвращает число ключей коллекции, меньших key. Ключ может
+// отсутствовать - тогда это позиция, на которую он встал бы.
+func (tc *TreeCollection) Rank(key string) (int, error) {
+	tc.PurgeExpired()
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if stats, ok := tc.Tree.(OrderStatistics); ok {
+		return stats.Rank(key), nil
+	}
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return 0, err
+	}
+	rank := 0
+	for _, k := range keys {
+		if tc.collation.Compare(k, key) < 0 {
+			rank++
+		}
+	}
+	return rank, nil
+}
+
+// KeyAt возвращает k-й по возрастанию ключ коллекции (с нуля).
+func (tc *TreeCollection) KeyAt(k int) (string, error) {
+	tc.PurgeExpired()
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if stats, ok := tc.Tree.(OrderStatistics); ok {
+		key, found := stats.Select(k)
+		if !found {
+			return "", ErrIndexOutOfRange
+		}
+		return key, nil
+	}
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return "", err
+	}
+	if k < 0 || k >= len(keys) {
+		return "", ErrIndexOutOfRange
+	}
+	tc.collation.Sort(keys)
+	return keys[k], nil
+}
+
+// CountRange возвращает число ключей в диапазоне [minValue, maxValue].
+func (tc *TreeCollection) CountRange(minValue, maxValue string) (int, error) {
+	tc.PurgeExpired()
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.countRange(minValue, maxValue)
+}
@@ -0,0 +1,1146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Язык запросов:
+//
+//	SELECT key, value.age FROM pool.schema.collection
+//	    WHERE key BETWEEN 'a' AND 'm' AND value.age > 30
+//	    ORDER BY key DESC LIMIT 10
+//	INSERT INTO pool.schema.collection VALUES ('k1', '{"age": 31}'), ('k2', '...')
+//	UPDATE pool.schema.collection SET value.age = 32 WHERE key = 'k1'
+//	DELETE FROM pool.schema.collection WHERE value.age < 18
+
+type queryTokenKind int
+
+const (
+	tokenEOF queryTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenSymbol
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+}
+
+func lexQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'' || r == '"':
+			// 'строка' или "идентификатор"; кавычка удваивается для экранирования
+			start := i
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("позиция %d: незакрытая кавычка", start+1)
+				}
+				if runes[i] == r {
+					if i+1 < len(runes) && runes[i+1] == r {
+						sb.WriteRune(r)
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			kind := tokenString
+			if r == '"' {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, queryToken{kind: kind, text: sb.String(), pos: start + 1})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			// цифры[.цифры][(e|E)[+|-]цифры]
+			start := i
+			i++
+			digits := func() {
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			digits()
+			if i < len(runes) && runes[i] == '.' {
+				i++
+				digits()
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				digits()
+			}
+			tokens = append(tokens, queryToken{kind: tokenNumber, text: string(runes[start:i]), pos: start + 1})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, queryToken{kind: tokenIdent, text: string(runes[start:i]), pos: start + 1})
+		default:
+			start := i
+			symbol := string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "<=", ">=", "!=", "<>":
+					symbol = two
+				}
+			}
+			if !strings.Contains("=<>!,().*", string(r)) || symbol == "!" {
+				return nil, fmt.Errorf("позиция %d: неожиданный символ %q", start+1, r)
+			}
+			i += len([]rune(symbol))
+			tokens = append(tokens, queryToken{kind: tokenSymbol, text: symbol, pos: start + 1})
+		}
+	}
+	return append(tokens, queryToken{kind: tokenEOF, pos: len(runes) + 1}), nil
+}
+
+const (
+	operandKey = iota
+	operandValue
+	operandLiteral
+)
+
+type queryOperand struct {
+	kind    int
+	path    string
+	literal interface{}
+}
+
+func (o queryOperand) name() string {
+	switch o.kind {
+	case operandKey:
+		return "key"
+	case operandValue:
+		if o.path == "" {
+			return "value"
+		}
+		return "value." + o.path
+	}
+	return fmt.Sprint(o.literal)
+}
+
+func (o queryOperand) resolve(key string, value interface{}) (interface{}, bool) {
+	switch o.kind {
+	case operandKey:
+		return key, true
+	case operandValue:
+		if o.path == "" {
+			return value, true
+		}
+		return fieldValue(value, o.path)
+	}
+	return o.literal, true
+}
+
+type queryExpr interface {
+	eval(key string, value interface{}) bool
+}
+
+type andExpr struct{ left, right queryExpr }
+type orExpr struct{ left, right queryExpr }
+type notExpr struct{ expr queryExpr }
+
+// collation в compareExpr и betweenExpr - правила сравнения ключей
+// коллекции для условий на key; задается withCollation перед выполнением.
+type compareExpr struct {
+	op          string
+	left, right queryOperand
+	collation   *Collation
+}
+
+type betweenExpr struct {
+	operand   queryOperand
+	low       queryOperand
+	high      queryOperand
+	collation *Collation
+}
+
+func (e andExpr) eval(key string, value interface{}) bool {
+	return e.left.eval(key, value) && e.right.eval(key, value)
+}
+
+func (e orExpr) eval(key string, value interface{}) bool {
+	return e.left.eval(key, value) || e.right.eval(key, value)
+}
+
+func (e notExpr) eval(key string, value interface{}) bool {
+	return !e.expr.eval(key, value)
+}
+
+func (e compareExpr) eval(key string, value interface{}) bool {
+	left, ok := e.left.resolve(key, value)
+	if !ok {
+		return false
+	}
+	right, ok := e.right.resolve(key, value)
+	if !ok {
+		return false
+	}
+	c, ok := e.compare(left, right)
+	if !ok {
+		return e.op == "!=" || e.op == "<>"
+	}
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// compare сравнивает key со строкой как границу диапазона ключей (без
+// разбора чисел: закодированный ключ может выглядеть как число), а остальные
+// операнды - через compareValues.
+func (e compareExpr) compare(left, right interface{}) (int, bool) {
+	if e.left.kind == operandKey || e.right.kind == operandKey {
+		a, okLeft := left.(string)
+		b, okRight := right.(string)
+		if okLeft && okRight {
+			return e.collation.compareBound(a, b), true
+		}
+	}
+	return compareValues(left, right)
+}
+
+func (e betweenExpr) eval(key string, value interface{}) bool {
+	return compareExpr{op: ">=", left: e.operand, right: e.low, collation: e.collation}.eval(key, value) &&
+		compareExpr{op: "<=", left: e.operand, right: e.high, collation: e.collation}.eval(key, value)
+}
+
+// withCollation возвращает условие, в котором key сравнивается по правилам
+// сравнения ключей коллекции.
+func withCollation(expr queryExpr, collation *Collation) queryExpr {
+	switch e := expr.(type) {
+	case andExpr:
+		return andExpr{withCollation(e.left, collation), withCollation(e.right, collation)}
+	case orExpr:
+		return orExpr{withCollation(e.left, collation), withCollation(e.right, collation)}
+	case notExpr:
+		return notExpr{withCollation(e.expr, collation)}
+	case compareExpr:
+		e.collation = collation
+		return e
+	case betweenExpr:
+		e.collation = collation
+		return e
+	}
+	return expr
+}
+
+// resolveKeyLiterals переводит литералы в условиях на key в ключи коллекции:
+// при схеме ключей литерал - кортеж или его префикс, во временном ряду -
+// время[/серия]. Для сравнений < и >= берется начало диапазона ключей с этим
+// префиксом, для <= и > - его конец, поэтому условие совпадает с тем, что
+// выбрали бы get-range и get-prefix.
+func resolveKeyLiterals(expr queryExpr, tc *TreeCollection) (queryExpr, error) {
+	if tc.KeySchema() == nil && tc.Engine() != timeSeriesEngine {
+		return expr, nil
+	}
+	var resolve func(expr queryExpr) (queryExpr, error)
+	resolve = func(expr queryExpr) (queryExpr, error) {
+		switch e := expr.(type) {
+		case andExpr:
+			left, err := resolve(e.left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := resolve(e.right)
+			if err != nil {
+				return nil, err
+			}
+			return andExpr{left, right}, nil
+		case orExpr:
+			left, err := resolve(e.left)
+			if err != nil {
+				return nil, err
+			}
+			right, err := resolve(e.right)
+			if err != nil {
+				return nil, err
+			}
+			return orExpr{left, right}, nil
+		case notExpr:
+			inner, err := resolve(e.expr)
+			if err != nil {
+				return nil, err
+			}
+			return notExpr{inner}, nil
+		case compareExpr:
+			if e.left.kind == operandKey && e.right.kind == operandLiteral {
+				literal, err := tc.resolveKeyLiteral(e.op, e.right)
+				e.right = literal
+				return e, err
+			}
+			if e.right.kind == operandKey && e.left.kind == operandLiteral {
+				op := e.op
+				if flipped, ok := flippedOperators[op]; ok {
+					op = flipped
+				}
+				literal, err := tc.resolveKeyLiteral(op, e.left)
+				e.left = literal
+				return e, err
+			}
+			return e, nil
+		case betweenExpr:
+			if e.operand.kind != operandKey {
+				return e, nil
+			}
+			var err error
+			if e.low.kind == operandLiteral {
+				if e.low, err = tc.resolveKeyLiteral(">=", e.low); err != nil {
+					return nil, err
+				}
+			}
+			if e.high.kind == operandLiteral {
+				if e.high, err = tc.resolveKeyLiteral("<=", e.high); err != nil {
+					return nil, err
+				}
+			}
+			return e, nil
+		}
+		return expr, nil
+	}
+	return resolve(expr)
+}
+
+// resolveKeyLiteral переводит литерал условия "key op литерал" в ключ
+// коллекции.
+func (tc *TreeCollection) resolveKeyLiteral(op string, literal queryOperand) (queryOperand, error) {
+	s, ok := literal.literal.(string)
+	if !ok {
+		s = fmt.Sprint(literal.literal)
+	}
+	var err error
+	switch op {
+	case "<", ">=":
+		s, _, err = tc.ResolveRange(s, maxKey)
+	case "<=", ">":
+		_, s, err = tc.ResolveRange("", s)
+	default:
+		s, err = tc.ResolveKey(s)
+	}
+	if err != nil {
+		return literal, fmt.Errorf("условие на key: %w", err)
+	}
+	return queryOperand{kind: operandLiteral, literal: s}, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		// значения без схемы хранятся строками
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// compareValues сравнивает значения разных типов; ok=false, если они
+// несравнимы.
+func compareValues(a, b interface{}) (int, bool) {
+	if ta, ok := a.(time.Time); ok {
+		if s, ok := b.(string); ok {
+			tb, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return 0, false
+			}
+			b = tb
+		}
+		tb, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		return ta.Compare(tb), true
+	}
+	if _, ok := b.(time.Time); ok {
+		c, ok := compareValues(b, a)
+		return -c, ok
+	}
+	if sa, ok := a.(string); ok {
+		if sb, ok := b.(string); ok {
+			return strings.Compare(sa, sb), true
+		}
+	}
+	if ba, ok := a.(bool); ok {
+		bb, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case ba == bb:
+			return 0, true
+		case !ba:
+			return -1, true
+		}
+		return 1, true
+	}
+	fa, okA := toFloat(a)
+	fb, okB := toFloat(b)
+	if !okA || !okB {
+		if a == nil && b == nil {
+			return 0, true
+		}
+		return 0, false
+	}
+	switch {
+	case fa < fb:
+		return -1, true
+	case fa > fb:
+		return 1, true
+	}
+	return 0, true
+}
+
+type queryStmt struct {
+	kind    string
+	target  [3]string
+	columns []queryOperand
+	where   queryExpr
+	orderBy *queryOperand
+	desc    bool
+	limit   int
+	rows    [][2]interface{}
+	setPath string
+	setTo   interface{}
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *queryParser) errorf(tok queryToken, format string, args ...interface{}) error {
+	return fmt.Errorf("позиция %d: %s", tok.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokenIdent && strings.EqualFold(tok.text, word)
+}
+
+func (p *queryParser) acceptKeyword(word string) bool {
+	if p.isKeyword(word) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectKeyword(word string) error {
+	if !p.acceptKeyword(word) {
+		return p.errorf(p.peek(), "ожидается %s", word)
+	}
+	return nil
+}
+
+func (p *queryParser) acceptSymbol(symbol string) bool {
+	tok := p.peek()
+	if tok.kind == tokenSymbol && tok.text == symbol {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) expectSymbol(symbol string) error {
+	if !p.acceptSymbol(symbol) {
+		return p.errorf(p.peek(), "ожидается %q", symbol)
+	}
+	return nil
+}
+
+func (p *queryParser) ident() (string, error) {
+	tok := p.next()
+	if tok.kind != tokenIdent {
+		return "", p.errorf(tok, "ожидается имя")
+	}
+	return tok.text, nil
+}
+
+func parseQuery(text string) (*queryStmt, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	stmt := &queryStmt{limit: -1}
+	first := p.next()
+	if first.kind != tokenIdent {
+		return nil, p.errorf(first, "ожидается SELECT, INSERT, UPDATE или DELETE")
+	}
+	stmt.kind = strings.ToUpper(first.text)
+	switch stmt.kind {
+	case "SELECT":
+		err = p.parseSelect(stmt)
+	case "INSERT":
+		err = p.parseInsert(stmt)
+	case "UPDATE":
+		err = p.parseUpdate(stmt)
+	case "DELETE":
+		err = p.parseDelete(stmt)
+	default:
+		return nil, p.errorf(first, "ожидается SELECT, INSERT, UPDATE или DELETE")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "лишний текст %q", tok.text)
+	}
+	return stmt, nil
+}
+
+func (p *queryParser) parseTarget(stmt *queryStmt) error {
+	for i := range stmt.target {
+		if i > 0 {
+			if err := p.expectSymbol("."); err != nil {
+				return err
+			}
+		}
+		name, err := p.ident()
+		if err != nil {
+			return err
+		}
+		stmt.target[i] = name
+	}
+	return nil
+}
+
+func (p *queryParser) parseSelect(stmt *queryStmt) error {
+	if !p.acceptSymbol("*") {
+		for {
+			operand, err := p.parseOperand()
+			if err != nil {
+				return err
+			}
+			if operand.kind == operandLiteral {
+				return p.errorf(p.tokens[p.pos-1], "в списке выборки ожидается key или value")
+			}
+			stmt.columns = append(stmt.columns, operand)
+			if !p.acceptSymbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return err
+	}
+	if err := p.parseTarget(stmt); err != nil {
+		return err
+	}
+	if err := p.parseWhere(stmt); err != nil {
+		return err
+	}
+	if p.acceptKeyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return err
+		}
+		operand, err := p.parseOperand()
+		if err != nil {
+			return err
+		}
+		stmt.orderBy = &operand
+		if p.acceptKeyword("DESC") {
+			stmt.desc = true
+		} else {
+			p.acceptKeyword("ASC")
+		}
+	}
+	if p.acceptKeyword("LIMIT") {
+		tok := p.next()
+		limit, err := strconv.Atoi(tok.text)
+		if tok.kind != tokenNumber || err != nil || limit < 0 {
+			return p.errorf(tok, "LIMIT должен быть неотрицательным целым числом")
+		}
+		stmt.limit = limit
+	}
+	return nil
+}
+
+func (p *queryParser) parseInsert(stmt *queryStmt) error {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return err
+	}
+	if err := p.parseTarget(stmt); err != nil {
+		return err
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return err
+		}
+		keyTok := p.next()
+		if keyTok.kind != tokenString {
+			return p.errorf(keyTok, "ключ должен быть строкой")
+		}
+		if err := p.expectSymbol(","); err != nil {
+			return err
+		}
+		value, err := p.parseLiteral()
+		if err != nil {
+			return err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return err
+		}
+		stmt.rows = append(stmt.rows, [2]interface{}{keyTok.text, value})
+		if !p.acceptSymbol(",") {
+			return nil
+		}
+	}
+}
+
+func (p *queryParser) parseUpdate(stmt *queryStmt) error {
+	if err := p.parseTarget(stmt); err != nil {
+		return err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return err
+	}
+	operand, err := p.parseOperand()
+	if err != nil {
+		return err
+	}
+	if operand.kind != operandValue {
+		return p.errorf(p.tokens[p.pos-1], "в SET можно менять только value или value.поле")
+	}
+	stmt.setPath = operand.path
+	if err := p.expectSymbol("="); err != nil {
+		return err
+	}
+	if stmt.setTo, err = p.parseLiteral(); err != nil {
+		return err
+	}
+	return p.parseWhere(stmt)
+}
+
+func (p *queryParser) parseDelete(stmt *queryStmt) error {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return err
+	}
+	if err := p.parseTarget(stmt); err != nil {
+		return err
+	}
+	return p.parseWhere(stmt)
+}
+
+func (p *queryParser) parseWhere(stmt *queryStmt) error {
+	if !p.acceptKeyword("WHERE") {
+		return nil
+	}
+	expr, err := p.parseOr()
+	stmt.where = expr
+	return err
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseNot() (queryExpr, error) {
+	if p.acceptKeyword("NOT") {
+		expr, err := p.parseNot()
+		return notExpr{expr}, err
+	}
+	if p.acceptSymbol("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expectSymbol(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (queryExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("BETWEEN") {
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return betweenExpr{operand: left, low: low, high: high}, nil
+	}
+	tok := p.next()
+	switch tok.text {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+		if tok.kind != tokenSymbol {
+			break
+		}
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{op: tok.text, left: left, right: right}, nil
+	}
+	return nil, p.errorf(tok, "ожидается оператор сравнения")
+}
+
+func (p *queryParser) parseOperand() (queryOperand, error) {
+	if p.acceptKeyword("KEY") {
+		return queryOperand{kind: operandKey}, nil
+	}
+	if p.acceptKeyword("VALUE") {
+		var path []string
+		for p.acceptSymbol(".") {
+			name, err := p.ident()
+			if err != nil {
+				return queryOperand{}, err
+			}
+			path = append(path, name)
+		}
+		return queryOperand{kind: operandValue, path: strings.Join(path, ".")}, nil
+	}
+	literal, err := p.parseLiteral()
+	return queryOperand{kind: operandLiteral, literal: literal}, err
+}
+
+func (p *queryParser) parseLiteral() (interface{}, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenString:
+		return tok.text, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "некорректное число %s", tok.text)
+		}
+		return f, nil
+	case tokenIdent:
+		switch strings.ToUpper(tok.text) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		case "NULL":
+			return nil, nil
+		}
+	}
+	return nil, p.errorf(tok, "ожидается значение")
+}
+
+// queryPlan - способ получения кандидатов: диапазон ключей через GetRange
+// или вторичный индекс по полю значения.
+type queryPlan struct {
+	low, high  string
+	indexField string
+	indexLow   interface{}
+	indexHigh  interface{}
+	collation  *Collation
+}
+
+func (plan queryPlan) String() string {
+	if plan.indexField != "" {
+		return fmt.Sprintf("index %s [%v, %v]", plan.indexField, plan.indexLow, plan.indexHigh)
+	}
+	if plan.low == "" && plan.high == maxKey {
+		return "full scan"
+	}
+	if plan.high == maxKey {
+		return fmt.Sprintf("key range [%q, ...]", plan.low)
+	}
+	return fmt.Sprintf("key range [%q, %q]", plan.low, plan.high)
+}
+
+// conjuncts раскладывает условие на части, соединенные AND.
+func conjuncts(expr queryExpr) []queryExpr {
+	if and, ok := expr.(andExpr); ok {
+		return append(conjuncts(and.left), conjuncts(and.right)...)
+	}
+	if expr == nil {
+		return nil
+	}
+	return []queryExpr{expr}
+}
+
+// flippedOperators - операторы для условия, записанного как "литерал op поле".
+var flippedOperators = map[string]string{"<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// planQuery сужает диапазон ключей по условиям на key, а если их нет -
+// ищет условие равенства или BETWEEN по индексированному полю.
+func planQuery(where queryExpr, tc *TreeCollection) queryPlan {
+	plan := queryPlan{low: "", high: maxKey, collation: tc.keyCollation()}
+	narrowLow := func(v string) {
+		if plan.collation.compareBound(v, plan.low) > 0 {
+			plan.low = v
+		}
+	}
+	narrowHigh := func(v string) {
+		if plan.collation.compareBound(v, plan.high) < 0 {
+			plan.high = v
+		}
+	}
+	var indexCandidate *queryPlan
+	for _, expr := range conjuncts(where) {
+		switch e := expr.(type) {
+		case compareExpr:
+			operand, literal, op := e.left, e.right, e.op
+			if operand.kind == operandLiteral {
+				operand, literal = literal, operand
+				if flipped, ok := flippedOperators[op]; ok {
+					op = flipped
+				}
+			}
+			if literal.kind != operandLiteral {
+				continue
+			}
+			if operand.kind == operandKey {
+				s, ok := literal.literal.(string)
+				if !ok {
+					continue
+				}
+				switch op {
+				case "=":
+					narrowLow(s)
+					narrowHigh(s)
+				case ">", ">=":
+					narrowLow(s)
+				case "<", "<=":
+					narrowHigh(s)
+				}
+			} else if operand.kind == operandValue && op == "=" && tc.hasIndex(operand.path) {
+				indexCandidate = &queryPlan{indexField: operand.path, indexLow: literal.literal, indexHigh: literal.literal}
+			}
+		case betweenExpr:
+			if e.low.kind != operandLiteral || e.high.kind != operandLiteral {
+				continue
+			}
+			if e.operand.kind == operandKey {
+				low, okLow := e.low.literal.(string)
+				high, okHigh := e.high.literal.(string)
+				if okLow && okHigh {
+					narrowLow(low)
+					narrowHigh(high)
+				}
+			} else if e.operand.kind == operandValue && tc.hasIndex(e.operand.path) {
+				indexCandidate = &queryPlan{indexField: e.operand.path, indexLow: e.low.literal, indexHigh: e.high.literal}
+			}
+		}
+	}
+	if plan.low == "" && plan.high == maxKey && indexCandidate != nil {
+		return *indexCandidate
+	}
+	return plan
+}
+
+func (tc *TreeCollection) hasIndex(field string) bool {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	_, exists := tc.indexes[field]
+	return exists
+}
+
+func (plan queryPlan) keys(tc *TreeCollection) ([]string, error) {
+	if plan.indexField != "" {
+		return tc.FindByIndex(plan.indexField, plan.indexLow, plan.indexHigh)
+	}
+	if plan.collation.compareBound(plan.low, plan.high) > 0 {
+		return nil, nil
+	}
+	keys, err := tc.GetRange(plan.low, plan.high)
+	if err != nil {
+		return nil, err
+	}
+	plan.collation.Sort(keys)
+	return keys, nil
+}
+
+// QueryResult - результат запроса: строки выборки или число измененных
+// ключей, а также выбранный план.
+type QueryResult struct {
+	Columns  []string                 `json:"columns,omitempty"`
+	Rows     []map[string]interface{} `json:"rows,omitempty"`
+	Affected int                      `json:"affected"`
+	Plan     string                   `json:"plan"`
+}
+
+type queryRow struct {
+	key   string
+	value interface{}
+}
+
+// ExecuteQuery разбирает и выполняет запрос в транзакции сессии.
+func ExecuteQuery(pools *AllPools, session commandSession, text string) (*QueryResult, error) {
+	stmt, err := parseQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := pools.GetCollection(stmt.target[0], stmt.target[1], stmt.target[2])
+	if err != nil {
+		return nil, err
+	}
+	var result *QueryResult
+	err = session.run(pools, func(tx *Transaction) error {
+		result, err = stmt.execute(tx, tc)
+		return err
+	})
+	return result, err
+}
+
+func (stmt *queryStmt) execute(tx *Transaction, tc *TreeCollection) (*QueryResult, error) {
+	mode := ExclusiveLock
+	if stmt.kind == "SELECT" {
+		mode = SharedLock
+	}
+	if err := tx.Lock(tc, mode); err != nil {
+		return nil, err
+	}
+	result := &QueryResult{}
+	if stmt.kind == "INSERT" {
+		result.Plan = "insert"
+		for _, row := range stmt.rows {
+			key, err := tc.ResolveKey(row[0].(string))
+			if err != nil {
+				return nil, err
+			}
+			if tc.Multimap() {
+				err = tx.Add(tc, key, row[1], time.Time{})
+			} else {
+				err = tx.Insert(tc, key, row[1])
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Affected++
+		}
+		return result, nil
+	}
+
+	if stmt.kind == "UPDATE" && tc.Multimap() {
+		return nil, fmt.Errorf("UPDATE не поддерживается для мультиотображений: удалите значение и вставьте новое")
+	}
+	collation := tc.keyCollation()
+	where, err := resolveKeyLiterals(stmt.where, tc)
+	if err != nil {
+		return nil, err
+	}
+	where = withCollation(where, collation)
+	plan := planQuery(where, tc)
+	result.Plan = plan.String()
+	keys, err := plan.keys(tc)
+	if err != nil {
+		return nil, err
+	}
+	var rows []queryRow
+	for _, key := range keys {
+		value, err := tc.Get(key)
+		if err != nil {
+			continue
+		}
+		// в мультиотображении строка результата - каждое значение ключа
+		for _, item := range tc.elements(value) {
+			if where == nil || where.eval(key, item) {
+				rows = append(rows, queryRow{key: key, value: item})
+			}
+		}
+	}
+
+	switch stmt.kind {
+	case "SELECT":
+		stmt.project(rows, result, collation)
+		// составные ключи выводятся кортежами
+		if tc.KeySchema() != nil {
+			for _, row := range result.Rows {
+				if key, ok := row["key"].(string); ok {
+					row["key"] = tc.DisplayKey(key)
+				}
+			}
+		}
+	case "UPDATE":
+		for _, row := range rows {
+			value, err := setFieldValue(row.value, stmt.setPath, stmt.setTo)
+			if err != nil {
+				return nil, fmt.Errorf("ключ %s: %v", row.key, err)
+			}
+			if err := tx.Update(tc, row.key, value); err != nil {
+				return nil, err
+			}
+			result.Affected++
+		}
+	case "DELETE":
+		for _, row := range rows {
+			if tc.Multimap() {
+				err = tx.RemoveValue(tc, row.key, row.value)
+			} else {
+				err = tx.Remove(tc, row.key)
+			}
+			if err != nil {
+				return nil, err
+			}
+			result.Affected++
+		}
+	}
+	return result, nil
+}
+
+func (stmt *queryStmt) project(rows []queryRow, result *QueryResult, collation *Collation) {
+	if stmt.orderBy != nil {
+		order := *stmt.orderBy
+		sort.SliceStable(rows, func(i, j int) bool {
+			a, _ := order.resolve(rows[i].key, rows[i].value)
+			b, _ := order.resolve(rows[j].key, rows[j].value)
+			c, _ := compareValues(a, b)
+			if order.kind == operandKey {
+				c = collation.Compare(rows[i].key, rows[j].key)
+			}
+			if stmt.desc {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+	if stmt.limit >= 0 && len(rows) > stmt.limit {
+		rows = rows[:stmt.limit]
+	}
+	columns := stmt.columns
+	if len(columns) == 0 {
+		columns = []queryOperand{{kind: operandKey}, {kind: operandValue}}
+	}
+	for _, column := range columns {
+		result.Columns = append(result.Columns, column.name())
+	}
+	for _, row := range rows {
+		projected := make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			projected[column.name()], _ = column.resolve(row.key, row.value)
+		}
+		result.Rows = append(result.Rows, projected)
+	}
+	result.Affected = len(result.Rows)
+}
+
+// setFieldValue возвращает копию значения, в которой поле path заменено на
+// newValue. Пустой путь заменяет значение целиком.
+func setFieldValue(value interface{}, path string, newValue interface{}) (interface{}, error) {
+	if path == "" {
+		return newValue, nil
+	}
+	if s, ok := value.(string); ok {
+		// значение без схемы остается JSON-строкой
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(s), &parsed); err != nil {
+			return nil, fmt.Errorf("значение не является JSON-объектом")
+		}
+		updated, err := setFieldValue(parsed, path, newValue)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(updated)
+		return string(data), err
+	}
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("значение не является объектом")
+	}
+	name, rest, nested := strings.Cut(path, ".")
+	result := make(map[string]interface{}, len(object)+1)
+	for k, v := range object {
+		result[k] = v
+	}
+	if !nested {
+		if f, ok := newValue.(float64); ok && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			if _, isInt := object[name].(int64); isInt {
+				newValue = int64(f)
+			}
+		}
+		result[name] = newValue
+		return result, nil
+	}
+	child, err := setFieldValue(object[name], rest, newValue)
+	if err != nil {
+		return nil, err
+	}
+	result[name] = child
+	return result, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLexQueryNumbers(t *testing.T) {
+	for text, want := range map[string][]string{
+		"1e-5":      {"1e-5"},
+		"-2.5E+3":   {"-2.5E+3"},
+		"3.25e7":    {"3.25e7"},
+		"42":        {"42"},
+		"1e-5,2":    {"1e-5", ",", "2"},
+		"x>=-1.5e2": {"x", ">=", "-1.5e2"},
+	} {
+		tokens, err := lexQuery(text)
+		if err != nil {
+			t.Errorf("%s: %v", text, err)
+			continue
+		}
+		var got []string
+		for _, tok := range tokens[:len(tokens)-1] {
+			got = append(got, tok.text)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: лексемы %q, ожидалось %q", text, got, want)
+		}
+	}
+}
+
+func TestParseQueryNumbers(t *testing.T) {
+	stmt, err := parseQuery("SELECT key FROM p.s.c WHERE value.x < 1e-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmp, ok := stmt.where.(compareExpr); !ok || cmp.right.literal != 1e-5 {
+		t.Errorf("условие %#v, ожидалось value.x < 1e-5", stmt.where)
+	}
+
+	stmt, err = parseQuery("UPDATE p.s.c SET value.x = -2.5E+3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt.setTo != -2500.0 {
+		t.Errorf("SET = %v, ожидалось -2500", stmt.setTo)
+	}
+
+	for _, text := range []string{
+		"SELECT key FROM p.s.c WHERE value.x < 1e",
+		"SELECT key FROM p.s.c WHERE value.x < 1e+",
+	} {
+		if _, err := parseQuery(text); err == nil {
+			t.Errorf("%s: разобрано без ошибки", text)
+		}
+	}
+}
+
+func TestSplitCommandKeepsQueryText(t *testing.T) {
+	for command, want := range map[string][]string{
+		"query SELECT * FROM p.s.c WHERE key = 'al'": {"query", "SELECT * FROM p.s.c WHERE key = 'al'"},
+		`in-tx 7 query SELECT "value" FROM p.s.c`:    {"in-tx", "7", "query", `SELECT "value" FROM p.s.c`},
+		"insert-data p s c 'bob smith' v":            {"insert-data", "p", "s", "c", "bob smith", "v"},
+		"query":                                      {"query"},
+	} {
+		args, err := SplitCommand(command)
+		if err != nil {
+			t.Errorf("%s: %v", command, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("%s: аргументы %q, ожидалось %q", command, args, want)
+		}
+	}
+}
+
+// Строковые литералы запроса доходят до ExecuteQuery вместе с кавычками.
+func TestQueryCommandWithQuotedLiterals(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+		"insert-data p s c al 1",
+		"insert-data p s c 'bob smith' 2",
+		"insert-data p s c carol 3",
+	)
+	run := func(command string, session commandSession) {
+		t.Helper()
+		args, err := SplitCommand(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := runCommand(pools, args, cr, session); err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+	}
+	run("query DELETE FROM p.s.c WHERE key = 'al'", commandSession{})
+	tx := pools.Transactions().Begin()
+	run(fmt.Sprintf("in-tx %d query UPDATE p.s.c SET value = 'new' WHERE key = 'bob smith'", tx.ID), commandSession{})
+	if err := pools.Transactions().Commit(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.Get("al"); err == nil {
+		t.Error("ключ al не удален запросом")
+	}
+	if value, err := tc.Get("bob smith"); err != nil || value != "new" {
+		t.Errorf("bob smith = %v, %v; ожидалось new", value, err)
+	}
+	if value, err := tc.Get("carol"); err != nil || value != "3" {
+		t.Errorf("carol = %v, %v; ожидалось 3", value, err)
+	}
+}
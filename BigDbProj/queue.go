@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+// Очередь (FIFO) и стек (LIFO) - движки, ключи которых - номера добавления
+// из 20 цифр, поэтому порядок ключей совпадает с порядком добавления.
+// Извлечение идет с начала для очереди и с конца для стека и гарантирует
+// доставку хотя бы один раз: извлеченный элемент не удаляется, а скрывается
+// на время visibility; если за это время его не подтвердили командой ack,
+// он снова становится доступен. Выданные элементы не сохраняются в файле
+// состояния как выданные: после загрузки они доставляются повторно.
+
+const (
+	queueEngine = "queue"
+	stackEngine = "stack"
+
+	defaultVisibilityTimeout = 30 * time.Second
+)
+
+var (
+	ErrQueueEmpty  = errors.New("Очередь пуста!")
+	ErrNotQueue    = errors.New("Коллекция не является очередью или стеком!")
+	ErrNotInFlight = errors.New("Элемент не выдан или уже подтвержден!")
+)
+
+// Deque хранит элементы очереди или стека по возрастанию номера добавления.
+type Deque struct {
+	lifo bool
+	sortedPairs
+	keyVersions
+}
+
+// QueueMessage - извлеченный элемент. VisibleAt - момент, когда элемент
+// без подтверждения будет выдан снова; nil, если он удален при извлечении.
+type QueueMessage struct {
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Deliveries int         `json:"deliveries"`
+	VisibleAt  *time.Time  `json:"visibleAt,omitempty"`
+}
+
+// PopOptions - параметры извлечения: Wait - сколько ждать появления
+// элемента, Visibility - на сколько скрыть выданный элемент, AutoAck -
+// удалить элемент сразу, без подтверждения.
+type PopOptions struct {
+	Wait       time.Duration
+	Visibility time.Duration
+	AutoAck    bool
+}
+
+// queueState - выдача элементов очереди коллекции.
+type queueState struct {
+	// last - номер последнего добавленного элемента
+	last uint64
+	// inFlight - выданные без подтверждения элементы и моменты их повторной
+	// выдачи, deliveries - число выдач каждого элемента
+	inFlight   map[string]time.Time
+	deliveries map[string]int
+	// wake закрывается и заменяется при добавлении элемента
+	wake chan struct{}
+}
+
+func newDeque(lifo bool, collation *Collation) (*Deque, error) {
+	if collation != nil {
+		return nil, fmt.Errorf("ключи очереди - номера добавления, правила %s недоступны", collation.Name)
+	}
+	return &Deque{lifo: lifo}, nil
+}
+
+func queueKey(n uint64) string {
+	return fmt.Sprintf("%020d", n)
+}
+
+// ValidateKey проверяет, что ключ - номер добавления.
+func (d *Deque) ValidateKey(key string) error {
+	if len(key) != 20 {
+		return fmt.Errorf("ключ очереди должен быть номером из 20 цифр: %s", key)
+	}
+	if _, err := strconv.ParseUint(key, 10, 64); err != nil {
+		return fmt.Errorf("ключ очереди должен быть номером из 20 цифр: %s", key)
+	}
+	return nil
+}
+
+func (d *Deque) Insert(key string, value interface{}) error {
+	if err := d.ValidateKey(key); err != nil {
+		return err
+	}
+	if err := d.insert(key, value); err != nil {
+		return err
+	}
+	d.bump(key)
+	return nil
+}
+
+func (d *Deque) Get(key string) (interface{}, error) {
+	i, found := d.find(key)
+	if !found {
+		return nil, errors.New("Элемент не найден!")
+	}
+	return d.values[i], nil
+}
+
+func (d *Deque) Update(key string, value interface{}) error {
+	i, found := d.find(key)
+	if !found {
+		return errors.New("Элемент не найден!")
+	}
+	d.values[i] = value
+	d.bump(key)
+	return nil
+}
+
+func (d *Deque) Remove(key string) error {
+	i, found := d.find(key)
+	if !found {
+		return errors.New("Элемент не найден!")
+	}
+	d.removeAt(i)
+	d.forget(key)
+	return nil
+}
+
+func (d *Deque) GetVersioned(key string) (interface{}, uint64, error) {
+	return getVersioned(d, key)
+}
+
+func (d *Deque) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return compareAndSet(d, key, expectedVersion, value)
+}
+
+func (d *Deque) GetRange(minValue, maxValue string) ([]string, error) {
+	low, high := d.bounds(minValue, maxValue)
+	return append([]string(nil), d.keys[low:high]...), nil
+}
+
+func (d *Deque) ScanRange(minValue, maxValue string, fn func(key string, value interface{}) bool) {
+	low, high := d.bounds(minValue, maxValue)
+	for i := low; i < high; i++ {
+		if !fn(d.keys[i], d.values[i]) {
+			return
+		}
+	}
+}
+
+func (d *Deque) CountRange(minValue, maxValue string) int {
+	low, high := d.bounds(minValue, maxValue)
+	return high - low
+}
+
+func (d *Deque) FirstKey(minValue, maxValue string) (string, bool) {
+	low, high := d.bounds(minValue, maxValue)
+	if low == high {
+		return "", false
+	}
+	return d.keys[low], true
+}
+
+func (d *Deque) LastKey(minValue, maxValue string) (string, bool) {
+	low, high := d.bounds(minValue, maxValue)
+	if low == high {
+		return "", false
+	}
+	return d.keys[high-1], true
+}
+
+func (d *Deque) Rank(key string) int {
+	i, _ := d.find(key)
+	return i
+}
+
+func (d *Deque) Select(k int) (string, bool) {
+	if k < 0 || k >= len(d.keys) {
+		return "", false
+	}
+	return d.keys[k], true
+}
+
+// BulkLoad дописывает упорядоченные пары. Ключи уже проверены через
+// ValidateKey.
+func (d *Deque) BulkLoad(keys []string, values []interface{}) {
+	d.keys = append(d.keys, keys...)
+	d.values = append(d.values, values...)
+	for _, key := range keys {
+		d.bump(key)
+	}
+}
+
+func (d *Deque) SaveToFile(filename string) error {
+	entries := make([]KeyValue, len(d.keys))
+	for i, key := range d.keys {
+		entries[i] = KeyValue{Key: key, Value: d.values[i]}
+	}
+	data, err := json.Marshal(map[string]interface{}{"lifo": d.lifo, "entries": entries})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// each обходит элементы в порядке извлечения.
+func (d *Deque) each(fn func(key string, value interface{}) bool) {
+	for n := 0; n < len(d.keys); n++ {
+		i := n
+		if d.lifo {
+			i = len(d.keys) - 1 - n
+		}
+		if !fn(d.keys[i], d.values[i]) {
+			return
+		}
+	}
+}
+
+// deque возвращает движок очереди коллекции и состояние выдачи, создавая
+// его при первом обращении. Вызывается под исключительной блокировкой
+// коллекции.
+func (tc *TreeCollection) deque() (*Deque, *queueState, error) {
+	d, ok := tc.Tree.(*Deque)
+	if !ok {
+		return nil, nil, ErrNotQueue
+	}
+	if tc.queue == nil {
+		tc.queue = &queueState{
+			inFlight:   make(map[string]time.Time),
+			deliveries: make(map[string]int),
+			wake:       make(chan struct{}),
+		}
+	}
+	// ключи могли быть вставлены напрямую или загружены из файла
+	if n := len(d.keys); n > 0 {
+		if last, _ := strconv.ParseUint(d.keys[n-1], 10, 64); last > tc.queue.last {
+			tc.queue.last = last
+		}
+	}
+	return d, tc.queue, nil
+}
+
+// next возвращает первый доступный для выдачи элемент.
+func (tc *TreeCollection) next(d *Deque, now time.Time) (string, interface{}, bool) {
+	var key string
+	var value interface{}
+	found := false
+	d.each(func(k string, v interface{}) bool {
+		if tc.expired(k) {
+			return true
+		}
+		if tc.queue != nil {
+			if at, ok := tc.queue.inFlight[k]; ok && at.After(now) {
+				return true
+			}
+		}
+		key, value, found = k, tc.upgrade(k, v), true
+		return false
+	})
+	return key, value, found
+}
+
+// push добавляет элемент и возвращает его ключ и действие отмены.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) push(value interface{}) (string, func(), error) {
+	_, state, err := tc.deque()
+	if err != nil {
+		return "", nil, err
+	}
+	key := queueKey(state.last + 1)
+	if err := tc.insert(key, value); err != nil {
+		return "", nil, err
+	}
+	state.last++
+	close(state.wake)
+	state.wake = make(chan struct{})
+	return key, func() { tc.drop(key) }, nil
+}
+
+// pop выдает первый доступный элемент. Вызывается под исключительной
+// блокировкой коллекции.
+func (tc *TreeCollection) pop(visibility time.Duration, autoAck bool) (*QueueMessage, func(), error) {
+	d, state, err := tc.deque()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	key, value, found := tc.next(d, now)
+	if !found {
+		return nil, nil, ErrQueueEmpty
+	}
+	oldAt, wasInFlight := state.inFlight[key]
+	oldCount := state.deliveries[key]
+	message := &QueueMessage{Key: key, Value: value, Deliveries: oldCount + 1}
+	if autoAck {
+		oldExpiry := tc.expires[key]
+		if err := tc.drop(key); err != nil {
+			return nil, nil, err
+		}
+		return message, func() {
+			if tc.insert(key, value) == nil {
+				tc.setExpiry(key, oldExpiry)
+				state.deliveries[key] = oldCount
+				if wasInFlight {
+					state.inFlight[key] = oldAt
+				}
+			}
+		}, nil
+	}
+	visibleAt := now.Add(visibility)
+	state.inFlight[key], state.deliveries[key] = visibleAt, oldCount+1
+	message.VisibleAt = &visibleAt
+	return message, func() {
+		if wasInFlight {
+			state.inFlight[key] = oldAt
+		} else {
+			delete(state.inFlight, key)
+		}
+		state.deliveries[key] = oldCount
+	}, nil
+}
+
+// ack подтверждает обработку выданного элемента и удаляет его.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) ack(key string) (func(), error) {
+	_, state, err := tc.deque()
+	if err != nil {
+		return nil, err
+	}
+	at, ok := state.inFlight[key]
+	if !ok {
+		return nil, ErrNotInFlight
+	}
+	count := state.deliveries[key]
+	value, err := tc.get(key)
+	if err != nil {
+		return nil, err
+	}
+	oldExpiry := tc.expires[key]
+	if err := tc.drop(key); err != nil {
+		return nil, err
+	}
+	return func() {
+		if tc.insert(key, value) == nil {
+			tc.setExpiry(key, oldExpiry)
+			state.inFlight[key], state.deliveries[key] = at, count
+		}
+	}, nil
+}
+
+// Peek возвращает элемент, который будет выдан следующим, не выдавая его.
+func (tc *TreeCollection) Peek() (*QueueMessage, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	d, ok := tc.Tree.(*Deque)
+	if !ok {
+		return nil, ErrNotQueue
+	}
+	key, value, found := tc.next(d, time.Now())
+	if !found {
+		return nil, ErrQueueEmpty
+	}
+	message := &QueueMessage{Key: key, Value: value}
+	if tc.queue != nil {
+		message.Deliveries = tc.queue.deliveries[key]
+	}
+	return message, nil
+}
+
+func (tc *TreeCollection) Push(value interface{}) (string, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	key, _, err := tc.push(value)
+	return key, err
+}
+
+func (tc *TreeCollection) Pop(visibility time.Duration, autoAck bool) (*QueueMessage, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	message, _, err := tc.pop(visibility, autoAck)
+	return message, err
+}
+
+func (tc *TreeCollection) Ack(key string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	_, err := tc.ack(key)
+	return err
+}
+
+// queueWake возвращает канал, который закроется при добавлении элемента, и
+// ближайший момент повторной выдачи неподтвержденного элемента.
+func (tc *TreeCollection) queueWake() (<-chan struct{}, time.Time, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	_, state, err := tc.deque()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	now := time.Now()
+	var retry time.Time
+	for _, at := range state.inFlight {
+		if at.After(now) && (retry.IsZero() || at.Before(retry)) {
+			retry = at
+		}
+	}
+	return state.wake, retry, nil
+}
+
+// Push добавляет элемент в очередь в транзакции.
+func (tx *Transaction) Push(tc *TreeCollection, value interface{}) (string, error) {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return "", err
+	}
+	tc.mu.Lock()
+	key, undo, err := tc.push(value)
+	tc.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		undo()
+	})
+	return key, nil
+}
+
+// Pop выдает элемент в транзакции; при откате элемент снова доступен.
+func (tx *Transaction) Pop(tc *TreeCollection, visibility time.Duration, autoAck bool) (*QueueMessage, error) {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return nil, err
+	}
+	tc.mu.Lock()
+	message, undo, err := tc.pop(visibility, autoAck)
+	tc.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		undo()
+	})
+	return message, nil
+}
+
+// Ack подтверждает элемент в транзакции.
+func (tx *Transaction) Ack(tc *TreeCollection, key string) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	tc.mu.Lock()
+	undo, err := tc.ack(key)
+	tc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		undo()
+	})
+	return nil
+}
+
+// PopWait извлекает элемент из коллекции args[1:4], ожидая его появления
+// до opts.Wait. Каждая попытка - отдельная транзакция, поэтому ожидание не
+// держит блокировок, а внутри явной транзакции ждать нельзя. Закрытие
+// cancel прекращает ожидание. Если элемент так и не появился, возвращается
+// ErrQueueEmpty.
+func PopWait(pools *AllPools, session commandSession, args []string, opts PopOptions, cancel <-chan struct{}) (*QueueMessage, error) {
+	if opts.Visibility <= 0 {
+		opts.Visibility = defaultVisibilityTimeout
+	}
+	if opts.Wait > 0 && session.tx != nil {
+		return nil, errors.New("ожидание элемента недоступно внутри транзакции")
+	}
+	tc, err := pools.GetCollection(args[1], args[2], args[3])
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		// канал берется до попытки, чтобы не пропустить добавление между
+		// неудачной попыткой и началом ожидания
+		wake, retry, err := tc.queueWake()
+		if err != nil {
+			return nil, err
+		}
+		var message *QueueMessage
+		err = session.run(pools, func(tx *Transaction) error {
+			var err error
+			message, err = tx.Pop(tc, opts.Visibility, opts.AutoAck)
+			return err
+		})
+		if !errors.Is(err, ErrQueueEmpty) {
+			return message, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, err
+		}
+		if !retry.IsZero() && time.Until(retry) < wait {
+			wait = time.Until(retry)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-cancel:
+			timer.Stop()
+			return nil, err
+		}
+		timer.Stop()
+	}
+}
+
+// parsePopFlags читает флаги команды pop: --wait, --visibility и
+// --auto-ack.
+func parsePopFlags(flags []string) (PopOptions, error) {
+	var opts PopOptions
+	for i := 0; i < len(flags); i++ {
+		switch flags[i] {
+		case "--auto-ack":
+			opts.AutoAck = true
+		case "--wait", "--visibility":
+			if i+1 >= len(flags) {
+				return opts, fmt.Errorf("не указано значение флага %s", flags[i])
+			}
+			d, err := time.ParseDuration(flags[i+1])
+			if err != nil || d < 0 {
+				return opts, fmt.Errorf("некорректное значение флага %s: %s", flags[i], flags[i+1])
+			}
+			if flags[i] == "--wait" {
+				opts.Wait = d
+			} else {
+				opts.Visibility = d
+			}
+			i++
+		default:
+			return opts, fmt.Errorf("неизвестный флаг %s", flags[i])
+		}
+	}
+	return opts, nil
+}
+
+// printMessage выводит извлеченный или просмотренный элемент очереди.
+func printMessage(message *QueueMessage) {
+	fmt.Printf("%s: %v (выдач: %d)\n", message.Key, message.Value, message.Deliveries)
+	if message.VisibleAt != nil {
+		fmt.Println("Без подтверждения будет выдан снова в", message.VisibleAt.Format("2006-01-02 15:04:05"))
+	}
+}
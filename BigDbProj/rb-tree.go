@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/bits"
 )
 
 type Color int
@@ -18,6 +19,7 @@ type NodeRB struct {
 	key        string
 	value      interface{}
 	color      Color
+	size       int // число узлов в поддереве
 	leftChild  *NodeRB
 	rightChild *NodeRB
 	parent     *NodeRB
@@ -25,7 +27,9 @@ type NodeRB struct {
 
 // RedBlackTree представляет Красно-Черное дерево
 type RedBlackTree struct {
-	root *NodeRB
+	root      *NodeRB
+	collation *Collation
+	keyVersions
 }
 
 // NewRedBlackTree создает новое пустое Красно-Черное дерево
@@ -35,7 +39,11 @@ func NewRedBlackTree() *RedBlackTree {
 
 func (rb *RedBlackTree) Insert(key string, value interface{}) error {
 	// Implementation of RB Tree Insert operation
+	if rb.SearchRB(rb.root, key) != nil {
+		return fmt.Errorf("Элемент с таким ключом уже существует!")
+	}
 	rb.InsertRB(key, value)
+	rb.bump(key)
 	return nil
 }
 
@@ -54,13 +62,13 @@ func (rb *RedBlackTree) GetRange(minValue, maxValue string) ([]string, error) {
 		if node == nil {
 			return
 		}
-		if node.key >= minValue {
+		if rb.collation.compareBound(node.key, minValue) >= 0 {
 			getRangeHelper(node.leftChild, minValue, maxValue)
 		}
-		if node.key >= minValue && node.key <= maxValue {
+		if rb.collation.inRange(node.key, minValue, maxValue) {
 			result = append(result, node.key)
 		}
-		if node.key <= maxValue {
+		if rb.collation.compareBound(node.key, maxValue) <= 0 {
 			getRangeHelper(node.rightChild, minValue, maxValue)
 		}
 	}
@@ -69,44 +77,50 @@ func (rb *RedBlackTree) GetRange(minValue, maxValue string) ([]string, error) {
 }
 
 func (rb *RedBlackTree) Update(key string, value interface{}) error {
-	node, err := getNodeRB(rb.root, key)
+	node, err := getNodeRB(rb.root, key, rb.collation)
 	if err != nil {
 		return err
 	}
 	node.value = value
+	rb.bump(key)
 	return nil
 }
 
 func (rb *RedBlackTree) Remove(key string) error {
-	// Implementation of RB Tree Delete operation
+	if rb.SearchRB(rb.root, key) == nil {
+		return fmt.Errorf("Элемент не найден!")
+	}
 	rb.DeleteRB(key)
+	rb.forget(key)
 	return nil
 }
 
+func (rb *RedBlackTree) GetVersioned(key string) (interface{}, uint64, error) {
+	return getVersioned(rb, key)
+}
+
+func (rb *RedBlackTree) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return compareAndSet(rb, key, expectedVersion, value)
+}
+
+// SaveToFile сохраняет пары в порядке ключей; LoadFromFile строит из них
+// дерево заново.
 func (rb *RedBlackTree) SaveToFile(filename string) error {
-	data, err := json.Marshal(rb)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(filename, data, 0644)
+	return saveEntries(filename, rb)
 }
 
 func (rb *RedBlackTree) LoadFromFile(filename string) error {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	return json.Unmarshal(data, rb)
+	return loadEntries(filename, rb)
 }
 
-func getNodeRB(root *NodeRB, key string) (*NodeRB, error) {
+func getNodeRB(root *NodeRB, key string, c *Collation) (*NodeRB, error) {
 	if root == nil {
 		return nil, fmt.Errorf("key not found")
 	}
-	if key < root.key {
-		return getNodeRB(root.leftChild, key)
-	} else if key > root.key {
-		return getNodeRB(root.rightChild, key)
+	if c.Compare(key, root.key) < 0 {
+		return getNodeRB(root.leftChild, key, c)
+	} else if c.Compare(key, root.key) > 0 {
+		return getNodeRB(root.rightChild, key, c)
 	} else {
 		return root, nil
 	}
@@ -117,11 +131,13 @@ func (tree *RedBlackTree) InsertRB(key string, value interface{}) {
 		key:        key,
 		value:      value,
 		color:      RED,
+		size:       1,
 		leftChild:  nil,
 		rightChild: nil,
 		parent:     nil,
 	}
 	if tree.root == nil {
+		newNode.color = BLACK
 		tree.root = newNode
 	} else {
 		tree.InsertNodeRB(tree.root, newNode)
@@ -130,7 +146,8 @@ func (tree *RedBlackTree) InsertRB(key string, value interface{}) {
 }
 
 func (tree *RedBlackTree) InsertNodeRB(root, newNode *NodeRB) {
-	if newNode.key < root.key {
+	root.size++
+	if tree.collation.Compare(newNode.key, root.key) < 0 {
 		if root.leftChild == nil {
 			root.leftChild = newNode
 			newNode.parent = root
@@ -167,6 +184,9 @@ func (tree *RedBlackTree) RotateLeftRB(node *NodeRB) {
 	}
 	rightChild.leftChild = node
 	node.parent = rightChild
+
+	rightChild.size = node.size
+	node.size = sizeRB(node.leftChild) + sizeRB(node.rightChild) + 1
 }
 
 func (tree *RedBlackTree) RotateRightRB(node *NodeRB) {
@@ -189,6 +209,9 @@ func (tree *RedBlackTree) RotateRightRB(node *NodeRB) {
 	}
 	leftChild.rightChild = node
 	node.parent = leftChild
+
+	leftChild.size = node.size
+	node.size = sizeRB(node.leftChild) + sizeRB(node.rightChild) + 1
 }
 
 func (tree *RedBlackTree) FixInsertionRB(node *NodeRB) {
@@ -230,6 +253,8 @@ func (tree *RedBlackTree) FixInsertionRB(node *NodeRB) {
 	tree.root.color = BLACK
 }
 
+// DeleteRB удаляет узел с ключом key. Из дерева физически вырезается узел
+// с не более чем одним потомком: сам узел или его преемник.
 func (tree *RedBlackTree) DeleteRB(key string) {
 	nodeToDelete := tree.SearchRB(tree.root, key)
 	if nodeToDelete == nil {
@@ -250,16 +275,18 @@ func (tree *RedBlackTree) DeleteRB(key string) {
 		replacement = child.rightChild
 	}
 
+	// replacement может быть nil, поэтому его родитель запоминается отдельно
+	parent := child.parent
 	if replacement != nil {
-		replacement.parent = child.parent
+		replacement.parent = parent
 	}
 
-	if child.parent == nil {
+	if parent == nil {
 		tree.root = replacement
-	} else if child == child.parent.leftChild {
-		child.parent.leftChild = replacement
+	} else if child == parent.leftChild {
+		parent.leftChild = replacement
 	} else {
-		child.parent.rightChild = replacement
+		parent.rightChild = replacement
 	}
 
 	if child != nodeToDelete {
@@ -267,8 +294,12 @@ func (tree *RedBlackTree) DeleteRB(key string) {
 		nodeToDelete.value = child.value
 	}
 
-	if child.color == BLACK && replacement != nil {
-		tree.FixDeletionRB(replacement)
+	for node := parent; node != nil; node = node.parent {
+		node.size--
+	}
+
+	if child.color == BLACK {
+		tree.FixDeletionRB(replacement, parent)
 	}
 }
 
@@ -277,7 +308,7 @@ func (tree *RedBlackTree) SearchRB(root *NodeRB, key string) *NodeRB {
 		return root
 	}
 
-	if root.key < key {
+	if tree.collation.Compare(root.key, key) < 0 {
 		return tree.SearchRB(root.rightChild, key)
 	}
 	return tree.SearchRB(root.leftChild, key)
@@ -303,54 +334,72 @@ func (tree *RedBlackTree) Minimum(node *NodeRB) *NodeRB {
 	return node
 }
 
-func (tree *RedBlackTree) FixDeletionRB(node *NodeRB) {
-	for node != nil && node != tree.root && node.color == BLACK {
-		if node == node.parent.leftChild {
-			sibling := node.parent.rightChild
-			if sibling.color == RED {
+func colorRB(node *NodeRB) Color {
+	if node == nil {
+		return BLACK
+	}
+	return node.color
+}
+
+func sizeRB(node *NodeRB) int {
+	if node == nil {
+		return 0
+	}
+	return node.size
+}
+
+// FixDeletionRB восстанавливает свойства дерева после удаления черного узла.
+// node - занявший его место потомок (возможно nil), parent - его родитель.
+func (tree *RedBlackTree) FixDeletionRB(node, parent *NodeRB) {
+	for node != tree.root && colorRB(node) == BLACK {
+		if node == parent.leftChild {
+			sibling := parent.rightChild
+			if colorRB(sibling) == RED {
 				sibling.color = BLACK
-				node.parent.color = RED
-				tree.RotateLeftRB(node.parent)
-				sibling = node.parent.rightChild
+				parent.color = RED
+				tree.RotateLeftRB(parent)
+				sibling = parent.rightChild
 			}
-			if sibling.leftChild.color == BLACK && sibling.rightChild.color == BLACK {
+			if colorRB(sibling.leftChild) == BLACK && colorRB(sibling.rightChild) == BLACK {
 				sibling.color = RED
-				node = node.parent
+				node = parent
+				parent = node.parent
 			} else {
-				if sibling.rightChild.color == BLACK {
+				if colorRB(sibling.rightChild) == BLACK {
 					sibling.leftChild.color = BLACK
 					sibling.color = RED
 					tree.RotateRightRB(sibling)
-					sibling = node.parent.rightChild
+					sibling = parent.rightChild
 				}
-				sibling.color = node.parent.color
-				node.parent.color = BLACK
+				sibling.color = parent.color
+				parent.color = BLACK
 				sibling.rightChild.color = BLACK
-				tree.RotateLeftRB(node.parent)
+				tree.RotateLeftRB(parent)
 				node = tree.root
 			}
 		} else {
-			sibling := node.parent.leftChild
-			if sibling.color == RED {
+			sibling := parent.leftChild
+			if colorRB(sibling) == RED {
 				sibling.color = BLACK
-				node.parent.color = RED
-				tree.RotateRightRB(node.parent)
-				sibling = node.parent.leftChild
+				parent.color = RED
+				tree.RotateRightRB(parent)
+				sibling = parent.leftChild
 			}
-			if sibling.rightChild.color == BLACK && sibling.leftChild.color == BLACK {
+			if colorRB(sibling.rightChild) == BLACK && colorRB(sibling.leftChild) == BLACK {
 				sibling.color = RED
-				node = node.parent
+				node = parent
+				parent = node.parent
 			} else {
-				if sibling.leftChild.color == BLACK {
+				if colorRB(sibling.leftChild) == BLACK {
 					sibling.rightChild.color = BLACK
 					sibling.color = RED
 					tree.RotateLeftRB(sibling)
-					sibling = node.parent.leftChild
+					sibling = parent.leftChild
 				}
-				sibling.color = node.parent.color
-				node.parent.color = BLACK
+				sibling.color = parent.color
+				parent.color = BLACK
 				sibling.leftChild.color = BLACK
-				tree.RotateRightRB(node.parent)
+				tree.RotateRightRB(parent)
 				node = tree.root
 			}
 		}
@@ -406,3 +455,135 @@ func (rb *RedBlackCollection) LoadFromFile(filename string) error {
 	}
 	return json.Unmarshal(data, rb)
 }
+
+// FirstKey возвращает наименьший ключ диапазона спуском по дереву
+func (rb *RedBlackTree) FirstKey(minValue, maxValue string) (string, bool) {
+	var best *NodeRB
+	for node := rb.root; node != nil; {
+		if rb.collation.compareBound(node.key, minValue) >= 0 {
+			best = node
+			node = node.leftChild
+		} else {
+			node = node.rightChild
+		}
+	}
+	if best == nil || rb.collation.compareBound(best.key, maxValue) > 0 {
+		return "", false
+	}
+	return best.key, true
+}
+
+// LastKey возвращает наибольший ключ диапазона спуском по дереву
+func (rb *RedBlackTree) LastKey(minValue, maxValue string) (string, bool) {
+	var best *NodeRB
+	for node := rb.root; node != nil; {
+		if rb.collation.compareBound(node.key, maxValue) <= 0 {
+			best = node
+			node = node.rightChild
+		} else {
+			node = node.leftChild
+		}
+	}
+	if best == nil || rb.collation.compareBound(best.key, minValue) < 0 {
+		return "", false
+	}
+	return best.key, true
+}
+
+// ScanRange обходит пары ключ-значение диапазона по возрастанию ключа, пока
+// fn возвращает true
+func (rb *RedBlackTree) ScanRange(minValue, maxValue string, fn func(key string, value interface{}) bool) {
+	var scan func(node *NodeRB) bool
+	scan = func(node *NodeRB) bool {
+		if node == nil {
+			return true
+		}
+		if rb.collation.compareBound(node.key, minValue) >= 0 && !scan(node.leftChild) {
+			return false
+		}
+		if rb.collation.inRange(node.key, minValue, maxValue) && !fn(node.key, node.value) {
+			return false
+		}
+		if rb.collation.compareBound(node.key, maxValue) <= 0 {
+			return scan(node.rightChild)
+		}
+		return true
+	}
+	scan(rb.root)
+}
+
+// countBefore возвращает число ключей меньше key, а при inclusive - не
+// больше key; compare - полное сравнение ключей или сравнение с границей
+// диапазона
+func (rb *RedBlackTree) countBefore(key string, inclusive bool, compare func(a, b string) int) int {
+	count := 0
+	for node := rb.root; node != nil; {
+		if c := compare(node.key, key); c < 0 || (inclusive && c == 0) {
+			count += sizeRB(node.leftChild) + 1
+			node = node.rightChild
+		} else {
+			node = node.leftChild
+		}
+	}
+	return count
+}
+
+// Rank возвращает число ключей меньше key
+func (rb *RedBlackTree) Rank(key string) int {
+	return rb.countBefore(key, false, rb.collation.Compare)
+}
+
+// Select возвращает k-й по возрастанию ключ (с нуля)
+func (rb *RedBlackTree) Select(k int) (string, bool) {
+	for node := rb.root; node != nil; {
+		leftSize := sizeRB(node.leftChild)
+		switch {
+		case k < leftSize:
+			node = node.leftChild
+		case k == leftSize:
+			return node.key, true
+		default:
+			k -= leftSize + 1
+			node = node.rightChild
+		}
+	}
+	return "", false
+}
+
+// CountRange возвращает число ключей диапазона по размерам поддеревьев
+func (rb *RedBlackTree) CountRange(minValue, maxValue string) int {
+	if rb.collation.compareBound(minValue, maxValue) > 0 {
+		return 0
+	}
+	return rb.countBefore(maxValue, true, rb.collation.compareBound) - rb.countBefore(minValue, false, rb.collation.compareBound)
+}
+
+// BulkLoad заменяет содержимое дерева ключами keys, отсортированными по
+// возрастанию, и строит сбалансированное дерево за O(n). Все узлы черные,
+// кроме нижнего уровня, если он заполнен не полностью: тогда его узлы
+// красные, и черная высота всех путей одинакова.
+func (rb *RedBlackTree) BulkLoad(keys []string, values []interface{}) {
+	redDepth := -1
+	if n := len(keys); n > 0 {
+		depth := bits.Len(uint(n)) - 1
+		if n != 1<<(depth+1)-1 {
+			redDepth = depth
+		}
+	}
+	rb.root = buildRB(keys, values, nil, 0, redDepth)
+	rb.reset(keys)
+}
+
+func buildRB(keys []string, values []interface{}, parent *NodeRB, depth, redDepth int) *NodeRB {
+	if len(keys) == 0 {
+		return nil
+	}
+	mid := len(keys) / 2
+	node := &NodeRB{key: keys[mid], value: values[mid], color: BLACK, size: len(keys), parent: parent}
+	if depth == redDepth {
+		node.color = RED
+	}
+	node.leftChild = buildRB(keys[:mid], values[:mid], node, depth+1, redDepth)
+	node.rightChild = buildRB(keys[mid+1:], values[mid+1:], node, depth+1, redDepth)
+	return node
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// commandNames - команды RunCommand и REPL для дополнения по Tab.
+var commandNames = []string{
+	"add-pool", "remove-pool", "add-schema", "remove-schema", "add-collection", "remove-collection",
+	"insert-data", "update-data", "delete-data", "get-range",
+	"create-index", "drop-index", "find-by-index", "add-unique",
+	"set-value-schema", "alter-collection", "show-value-schema", "set-key-schema", "get-prefix", "get-values", "window", "downsample", "set-retention",
+	"push", "pop", "peek", "ack",
+	"aggregate", "rank", "key-at", "count-range", "set-cache", "cache-stats", "string-pool-stats", "list-engines", "list-collations", "convert-collection", "conversion-status", "query", "begin-tx", "commit-tx", "rollback-tx", "in-tx",
+	"import-data", "get-data", "execute", "save-state", "load-state", "help", "exit",
+}
+
+// withoutPathArguments - команды, аргументы которых не являются путем
+// пул/схема/коллекция.
+var withoutPathArguments = map[string]bool{
+	"query": true, "string-pool-stats": true, "list-engines": true, "list-collations": true, "begin-tx": true, "commit-tx": true, "rollback-tx": true, "in-tx": true,
+	"execute": true, "save-state": true, "load-state": true, "help": true, "exit": true,
+}
+
+// replBackend выполняет команды REPL в этом процессе или на удаленном
+// сервере.
+type replBackend interface {
+	Run(command string) error
+	Query(text string) (*QueryResult, error)
+	Names() (map[string]map[string][]string, error)
+}
+
+type localBackend struct {
+	pools *AllPools
+	cr    *ChainOfResponsibility
+}
+
+func (b *localBackend) Run(command string) error {
+	return RunCommand(b.pools, command, b.cr)
+}
+
+func (b *localBackend) Query(text string) (*QueryResult, error) {
+	return ExecuteQuery(b.pools, commandSession{}, text)
+}
+
+func (b *localBackend) Names() (map[string]map[string][]string, error) {
+	return collectNames(b.pools), nil
+}
+
+// remoteBackend обращается к серверу через /run-command, /query и /names.
+type remoteBackend struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (b *remoteBackend) do(request *http.Request, result interface{}) error {
+	response, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &message) == nil && message.Error != "" {
+			return errors.New(message.Error)
+		}
+		return fmt.Errorf("сервер вернул %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, result)
+}
+
+func (b *remoteBackend) Run(command string) error {
+	request, err := http.NewRequest(http.MethodGet, b.baseURL+"/run-command?command="+url.QueryEscape(command), nil)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Message string `json:"message"`
+	}
+	if err := b.do(request, &result); err != nil {
+		return err
+	}
+	fmt.Println(result.Message)
+	return nil
+}
+
+func (b *remoteBackend) Query(text string) (*QueryResult, error) {
+	request, err := http.NewRequest(http.MethodPost, b.baseURL+"/query", strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	var result QueryResult
+	return &result, b.do(request, &result)
+}
+
+func (b *remoteBackend) Names() (map[string]map[string][]string, error) {
+	request, err := http.NewRequest(http.MethodGet, b.baseURL+"/names", nil)
+	if err != nil {
+		return nil, err
+	}
+	var names map[string]map[string][]string
+	return names, b.do(request, &names)
+}
+
+// collectNames возвращает имена пулов, их схем и коллекций.
+func collectNames(pools *AllPools) map[string]map[string][]string {
+	names := make(map[string]map[string][]string)
+	for _, poolName := range pools.PoolNames() {
+		schemas := make(map[string][]string)
+		pools.WithPool(poolName, func(pool *Pools) error {
+			for _, schemaName := range pool.SchemaNames() {
+				pools.WithSchema(poolName, schemaName, func(schema *Schema) error {
+					schemas[schemaName] = schema.CollectionNames()
+					return nil
+				})
+			}
+			return nil
+		})
+		names[poolName] = schemas
+	}
+	return names
+}
+
+type repl struct {
+	backend     replBackend
+	editor      *lineEditor
+	historyFile string
+}
+
+// runREPL выполняет режим "BigDbProj repl [--remote http://host:port]".
+func runREPL(pools *AllPools, cr *ChainOfResponsibility, args []string) int {
+	var backend replBackend = &localBackend{pools: pools, cr: cr}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--remote" && i+1 < len(args):
+			backend = &remoteBackend{baseURL: strings.TrimRight(args[i+1], "/"), client: &http.Client{}}
+			i++
+		default:
+			fmt.Println("Использование: BigDbProj repl [--remote http://localhost:8080]")
+			return 2
+		}
+	}
+
+	r := &repl{backend: backend, editor: newLineEditor()}
+	r.editor.complete = r.complete
+	if home, err := os.UserHomeDir(); err == nil {
+		r.historyFile = filepath.Join(home, ".bigdb_history")
+		r.loadHistory()
+	}
+	fmt.Println("BigDb REPL. Введите help для списка команд, exit или Ctrl-D для выхода.")
+
+	for {
+		command, err := r.readCommand()
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("Ошибка чтения:", err)
+				return 1
+			}
+			return 0
+		}
+		if command == "" {
+			continue
+		}
+		r.editor.AddHistory(command)
+		r.appendHistory(command)
+		args, err := SplitCommand(command)
+		if err != nil {
+			fmt.Println("Ошибка:", err)
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return 0
+		}
+		if err := r.execute(command, args); err != nil {
+			fmt.Println("Ошибка:", err)
+		}
+	}
+}
+
+// readCommand читает команду, продолжая ввод на следующих строках, пока
+// не закрыты кавычки и скобки JSON или строка оканчивается на \.
+func (r *repl) readCommand() (string, error) {
+	prompt := "bigdb> "
+	var command string
+	for {
+		line, err := r.editor.ReadLine(prompt)
+		if err != nil {
+			return "", err
+		}
+		if command == "" {
+			command = line
+		} else {
+			command += "\n" + line
+		}
+		if strings.HasSuffix(command, "\\") && !strings.HasSuffix(command, "\\\\") {
+			command = strings.TrimSuffix(command, "\\")
+			prompt = "   ...> "
+			continue
+		}
+		var syntaxErr *CommandSyntaxError
+		if _, err := SplitCommand(command); errors.As(err, &syntaxErr) && syntaxErr.Incomplete {
+			prompt = "   ...> "
+			continue
+		}
+		return strings.TrimSpace(command), nil
+	}
+}
+
+func (r *repl) execute(command string, args []string) error {
+	switch args[0] {
+	case "help":
+		fmt.Println("Команды:", strings.Join(commandNames, ", "))
+		fmt.Println("get-range пул схема коллекция [от] [до] - ключи и значения диапазона в виде таблицы")
+		fmt.Println("query SELECT ... - запрос с выводом таблицы")
+		return nil
+	case "query":
+		if len(args) < 2 {
+			return fmt.Errorf("недостаточно аргументов для команды query")
+		}
+		return r.query(strings.Join(args[1:], " "))
+	case "get-range":
+		if len(args) < 4 {
+			return fmt.Errorf("недостаточно аргументов для команды get-range")
+		}
+		text := fmt.Sprintf("SELECT key, value FROM %s.%s.%s", quoteIdentifier(args[1]), quoteIdentifier(args[2]), quoteIdentifier(args[3]))
+		switch len(args) {
+		case 4:
+		case 5:
+			text += fmt.Sprintf(" WHERE key >= %s", quoteLiteral(args[4]))
+		default:
+			text += fmt.Sprintf(" WHERE key BETWEEN %s AND %s", quoteLiteral(args[4]), quoteLiteral(args[5]))
+		}
+		return r.query(text)
+	}
+	return r.backend.Run(command)
+}
+
+func (r *repl) query(text string) error {
+	result, err := r.backend.Query(text)
+	if err != nil {
+		return err
+	}
+	if len(result.Columns) > 0 {
+		printTable(os.Stdout, result.Columns, result.Rows)
+	}
+	fmt.Printf("Затронуто ключей: %d (план: %s)\n", result.Affected, result.Plan)
+	return nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// printTable выводит строки результата выровненными столбцами.
+func printTable(w io.Writer, columns []string, rows []map[string]interface{}) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	separators := make([]string, len(columns))
+	for i, column := range columns {
+		separators[i] = strings.Repeat("-", len([]rune(column)))
+	}
+	fmt.Fprintln(tw, strings.Join(separators, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(columns))
+		for i, column := range columns {
+			cells[i] = formatCell(row[column])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	tw.Flush()
+}
+
+func formatCell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return strings.NewReplacer("\t", " ", "\n", " ").Replace(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// complete возвращает слово перед курсором и варианты его дополнения:
+// имя команды, затем имена пула, схемы и коллекции.
+func (r *repl) complete(line string) (string, []string) {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	// in-tx ID команда ...
+	if len(words) > 3 && words[0] == "in-tx" {
+		words = words[2:]
+	}
+	word := words[len(words)-1]
+	position := len(words) - 1
+
+	var options []string
+	switch {
+	case position == 0:
+		options = commandNames
+	case position <= 3 && !withoutPathArguments[words[0]]:
+		names, err := r.backend.Names()
+		if err != nil {
+			return word, nil
+		}
+		switch position {
+		case 1:
+			for pool := range names {
+				options = append(options, pool)
+			}
+		case 2:
+			for schema := range names[words[1]] {
+				options = append(options, schema)
+			}
+		case 3:
+			options = names[words[1]][words[2]]
+		}
+	}
+
+	var candidates []string
+	for _, option := range options {
+		if strings.HasPrefix(option, word) {
+			candidates = append(candidates, option)
+		}
+	}
+	sort.Strings(candidates)
+	return word, candidates
+}
+
+func (r *repl) loadHistory() {
+	data, err := os.ReadFile(r.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		r.editor.AddHistory(line)
+	}
+}
+
+func (r *repl) appendHistory(command string) {
+	if r.historyFile == "" {
+		return
+	}
+	file, err := os.OpenFile(r.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	// многострочная команда сохраняется одной строкой
+	fmt.Fprintln(file, strings.ReplaceAll(command, "\n", " "))
+}
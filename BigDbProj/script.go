@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ScriptOptions задает режим выполнения файла команд. При StopOnError
+// выполнение прекращается на первой ошибке, иначе ошибочная строка
+// пропускается. При InTransaction весь скрипт выполняется в одной
+// транзакции и откатывается, если он был прерван.
+type ScriptOptions struct {
+	StopOnError   bool
+	InTransaction bool
+}
+
+type ScriptLineResult struct {
+	Line    int    `json:"line"`
+	Command string `json:"command"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ScriptReport struct {
+	Results    []ScriptLineResult `json:"results"`
+	Executed   int                `json:"executed"`
+	Failed     int                `json:"failed"`
+	Stopped    bool               `json:"stopped"`
+	Tx         uint64             `json:"tx,omitempty"`
+	Committed  bool               `json:"committed,omitempty"`
+	RolledBack bool               `json:"rolledBack,omitempty"`
+}
+
+// RunScript выполняет команды из r по одной на строку. Пустые строки и
+// строки, начинающиеся с # или --, пропускаются.
+func RunScript(pools *AllPools, cr *ChainOfResponsibility, r io.Reader, opts ScriptOptions) (*ScriptReport, error) {
+	report := &ScriptReport{}
+	var session commandSession
+	if opts.InTransaction {
+		session.tx = pools.Transactions().Begin()
+		report.Tx = session.tx.ID
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "--") {
+			continue
+		}
+		result := ScriptLineResult{Line: lineNumber, Command: line}
+		args, err := SplitCommand(line)
+		if err == nil {
+			err = runCommand(pools, args, cr, session)
+		}
+		report.Executed++
+		if err != nil {
+			result.Error = err.Error()
+			report.Failed++
+		}
+		report.Results = append(report.Results, result)
+		// транзакция, прерванная взаимоблокировкой, уже откачена
+		aborted := session.tx != nil && !session.tx.Active()
+		if err != nil && (opts.StopOnError || aborted) {
+			report.Stopped = true
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if session.tx != nil {
+			pools.Transactions().Rollback(session.tx.ID)
+		}
+		return report, err
+	}
+
+	if session.tx != nil {
+		if report.Stopped {
+			// при откате уже завершенной транзакции возвращается ErrTxNotFound
+			pools.Transactions().Rollback(session.tx.ID)
+			report.RolledBack = true
+		} else if err := pools.Transactions().Commit(session.tx.ID); err != nil {
+			return report, err
+		} else {
+			report.Committed = true
+		}
+	}
+	return report, nil
+}
+
+// Print выводит построчный отчет о выполнении скрипта.
+func (report *ScriptReport) Print(w io.Writer) {
+	for _, result := range report.Results {
+		if result.Error != "" {
+			fmt.Fprintf(w, "Строка %d: ошибка: %s\n", result.Line, result.Error)
+		} else {
+			fmt.Fprintf(w, "Строка %d: выполнено\n", result.Line)
+		}
+	}
+	fmt.Fprintf(w, "Выполнено команд: %d, с ошибкой: %d\n", report.Executed, report.Failed)
+	if report.Stopped {
+		fmt.Fprintln(w, "Выполнение скрипта прервано")
+	}
+	switch {
+	case report.Committed:
+		fmt.Fprintln(w, "Транзакция", report.Tx, "зафиксирована")
+	case report.RolledBack:
+		fmt.Fprintln(w, "Транзакция", report.Tx, "откачена")
+	}
+}
+
+// parseScriptFlags разбирает флаги --stop-on-error, --continue и --tx.
+func parseScriptFlags(flags []string) (ScriptOptions, error) {
+	opts := ScriptOptions{StopOnError: true}
+	for _, flag := range flags {
+		switch flag {
+		case "--stop-on-error":
+			opts.StopOnError = true
+		case "--continue":
+			opts.StopOnError = false
+		case "--tx":
+			opts.InTransaction = true
+		default:
+			return opts, fmt.Errorf("неизвестный флаг %s", flag)
+		}
+	}
+	return opts, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -70,9 +71,22 @@ func (h *ChainOfResponsibilityHandler) Handle(dataExists *bool, dataToModify *TD
 type ChainOfResponsibility struct {
 	FirstHandler *ChainOfResponsibilityHandler
 	LastHandler  *ChainOfResponsibilityHandler
+	mu           sync.Mutex
+}
+
+// Handle прогоняет данные по всей цепочке; пустая цепочка ничего не делает.
+func (c *ChainOfResponsibility) Handle(dataExists *bool, dataToModify *TData, dateTimeTarget int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.FirstHandler == nil {
+		return
+	}
+	c.FirstHandler.Handle(dataExists, dataToModify, dateTimeTarget)
 }
 
 func (c *ChainOfResponsibility) AddHandler(command Command) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	dateTimeActivityStarted := time.Now().Unix()
 	addedHandler := &ChainOfResponsibilityHandler{
 		Command:                 command,
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// collectionSnapshot - коллекция в файле состояния: движок, пары по
+// возрастанию ключа в текущей версии схемы значений с их версиями, счетчик
+// версий, схема и индексы.
+type collectionSnapshot struct {
+	Engine        string            `json:"engine"`
+	EngineOptions map[string]string `json:"engineOptions,omitempty"`
+	Collation     string            `json:"collation,omitempty"`
+	KeySchema     *KeySchema        `json:"keySchema,omitempty"`
+	Multimap      bool              `json:"multimap,omitempty"`
+	Clock         uint64            `json:"clock,omitempty"`
+	Entries       []snapshotEntry   `json:"entries"`
+	ValueSchema   *ValueSchema      `json:"valueSchema,omitempty"`
+	Indexes       []SecondaryIndex  `json:"indexes,omitempty"`
+}
+
+type snapshotEntry struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	Version   uint64      `json:"version,omitempty"`
+	ExpiresAt *time.Time  `json:"expiresAt,omitempty"`
+}
+
+// MarshalJSON сериализует коллекцию под разделяемой блокировкой, чтобы
+// сохранение состояния не гонялось с параллельной записью. Ключи с
+// истекшим сроком жизни не сохраняются.
+func (tc *TreeCollection) MarshalJSON() ([]byte, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	snapshot := collectionSnapshot{
+		Engine:        tc.engine,
+		EngineOptions: tc.engineOptions,
+		Entries:       []snapshotEntry{},
+		KeySchema:     tc.keySchema,
+		Multimap:      tc.multimap,
+		Clock:         tc.Tree.versionTable().clock,
+		ValueSchema:   tc.valueSchema,
+	}
+	if tc.collation != nil {
+		snapshot.Collation = tc.collation.Name
+	}
+	err := tc.scanRange("", maxKey, func(key string, value interface{}) bool {
+		entry := snapshotEntry{Key: key, Value: value, Version: tc.Tree.versionTable().versions[key]}
+		if at, ok := tc.expires[key]; ok {
+			entry.ExpiresAt = &at
+		}
+		snapshot.Entries = append(snapshot.Entries, entry)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range tc.indexes {
+		snapshot.Indexes = append(snapshot.Indexes, *idx)
+	}
+	sort.Slice(snapshot.Indexes, func(i, j int) bool { return snapshot.Indexes[i].Field < snapshot.Indexes[j].Field })
+	return json.Marshal(snapshot)
+}
+
+// restore создает коллекцию по снимку. Пары загружаются через BulkLoad, так
+// как в снимке они уже упорядочены по ключу.
+func (snapshot *collectionSnapshot) restore() (*TreeCollection, error) {
+	options := make(map[string]string, len(snapshot.EngineOptions)+1)
+	for name, value := range snapshot.EngineOptions {
+		options[name] = value
+	}
+	if snapshot.Collation != "" {
+		options["collation"] = snapshot.Collation
+	}
+	if snapshot.Multimap {
+		options["multimap"] = "true"
+	}
+	tc, err := NewTreeCollection(snapshot.Engine, options)
+	if err != nil {
+		return nil, err
+	}
+	tc.keySchema = snapshot.KeySchema
+	if snapshot.ValueSchema != nil {
+		tc.valueSchema = snapshot.ValueSchema
+		tc.schemaHistory[snapshot.ValueSchema.Version] = snapshot.ValueSchema.Fields
+	}
+	now := time.Now()
+	entries := make([]KeyValue, 0, len(snapshot.Entries))
+	for _, entry := range snapshot.Entries {
+		if entry.ExpiresAt == nil || entry.ExpiresAt.After(now) {
+			entries = append(entries, KeyValue{Key: entry.Key, Value: entry.Value})
+		}
+	}
+	// индексы строятся после загрузки, чтобы BulkLoad не обновлял их по
+	// одному ключу
+	if _, err := tc.BulkLoad(SortedEntries(entries, tc.collation)); err != nil {
+		return nil, err
+	}
+	// версии восстанавливаются, чтобы ETag, выданные до сохранения, не
+	// совпали с версиями других значений
+	versions := tc.Tree.versionTable()
+	if snapshot.Clock > versions.clock {
+		versions.clock = snapshot.Clock
+	}
+	for _, entry := range snapshot.Entries {
+		if _, loaded := versions.versions[entry.Key]; loaded && entry.Version > 0 {
+			versions.versions[entry.Key] = entry.Version
+		}
+		if entry.ExpiresAt != nil && entry.ExpiresAt.After(now) {
+			tc.setExpiry(entry.Key, *entry.ExpiresAt)
+		}
+	}
+	for _, idx := range snapshot.Indexes {
+		if err := tc.CreateIndex(idx.Field, idx.Engine, idx.Unique); err != nil {
+			return nil, err
+		}
+	}
+	return tc, nil
+}
+
+// LoadFromFile заменяет все пулы состоянием, сохраненным SaveToFile. Если
+// файл не удалось прочитать, текущее состояние не меняется.
+func (ap *AllPools) LoadFromFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var state struct {
+		Pools map[string]struct {
+			Schema map[string]struct {
+				Collection map[string]*collectionSnapshot
+			} `json:"schema"`
+		}
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("некорректный файл состояния: %v", err)
+	}
+
+	restored := make(map[string]*Pools, len(state.Pools))
+	for poolName, poolState := range state.Pools {
+		pool := NewPools()
+		for schemaName, schemaState := range poolState.Schema {
+			schema := InitSchema()
+			for collectionName, snapshot := range schemaState.Collection {
+				tc, err := snapshot.restore()
+				if err != nil {
+					return fmt.Errorf("коллекция %s.%s.%s: %w", poolName, schemaName, collectionName, err)
+				}
+				schema.Collection[collectionName] = tc
+			}
+			pool.schema[schemaName] = schema
+		}
+		restored[poolName] = pool
+	}
+
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	for _, pool := range ap.Pools {
+		for _, schemaName := range pool.SchemaNames() {
+			pool.RemoveSchema(schemaName)
+		}
+	}
+	ap.Pools = restored
+	return nil
+}
+
+// ImportData загружает в пустую коллекцию пары из r: JSON Lines вида
+// {"key": "...", "value": ...} или один JSON-объект ключ -> значение.
+// Пары загружаются через BulkLoad целиком или не загружаются вовсе, а в
+// непустую коллекцию импорт не выполняется (ErrCollectionNotEmpty). В
+// мультиотображении ключ может повторяться: значения пар одного ключа
+// собираются в его список в порядке следования.
+func (tc *TreeCollection) ImportData(r io.Reader) (int, error) {
+	entries, err := readImport(r)
+	if err != nil {
+		return 0, err
+	}
+	tc.mu.RLock()
+	collation, multimap := tc.collation, tc.multimap
+	tc.mu.RUnlock()
+	if multimap {
+		entries = groupValues(entries)
+	}
+	return tc.BulkLoad(SortedEntries(entries, collation))
+}
+
+// ImportData импортирует пары в транзакции; откат удаляет все
+// импортированные ключи.
+func (tx *Transaction) ImportData(tc *TreeCollection, r io.Reader) (int, error) {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return 0, err
+	}
+	count, err := tc.ImportData(r)
+	if err != nil {
+		return 0, err
+	}
+	tx.undo = append(tx.undo, func() {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		// более поздние изменения транзакции уже откачены, и в коллекции
+		// остались только импортированные ключи
+		keys, _ := tc.Tree.GetRange("", maxKey)
+		for _, key := range keys {
+			tc.drop(key)
+		}
+	})
+	return count, nil
+}
+
+// groupValues собирает значения пар с одинаковым ключом в список.
+func groupValues(entries []KeyValue) []KeyValue {
+	positions := make(map[string]int, len(entries))
+	var grouped []KeyValue
+	for _, entry := range entries {
+		i, ok := positions[entry.Key]
+		if !ok {
+			i = len(grouped)
+			positions[entry.Key] = i
+			grouped = append(grouped, KeyValue{Key: entry.Key, Value: []interface{}{}})
+		}
+		grouped[i].Value = append(grouped[i].Value.([]interface{}), entry.Value)
+	}
+	return grouped
+}
+
+func readImport(r io.Reader) ([]KeyValue, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(data))
+	var object map[string]interface{}
+	if strings.HasPrefix(text, "{") && json.Unmarshal([]byte(text), &object) == nil {
+		if _, ok := object["key"]; !ok {
+			entries := make([]KeyValue, 0, len(object))
+			for key, value := range object {
+				entries = append(entries, KeyValue{Key: key, Value: value})
+			}
+			return entries, nil
+		}
+	}
+	var entries []KeyValue
+	for lineNumber, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var entry KeyValue
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, fmt.Errorf("строка %d: %v", lineNumber+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
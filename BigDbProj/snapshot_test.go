@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportRejectsNonEmptyCollection(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+		"insert-data p s c a 1",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := `{"key": "b", "value": 2}` + "\n" + `{"key": "c", "value": 3}`
+	if _, err := tc.ImportData(strings.NewReader(input)); !errors.Is(err, ErrCollectionNotEmpty) {
+		t.Fatalf("импорт в непустую коллекцию: %v, ожидалось ErrCollectionNotEmpty", err)
+	}
+	if keys, _ := tc.GetRange("", maxKey); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Errorf("после отказа в коллекции ключи %v", keys)
+	}
+}
+
+// Повторяющиеся ключи мультиотображения собираются в списки.
+func TestImportMultimapRepeatedKeys(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c btree multimap=true",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := strings.Join([]string{
+		`{"key": "b", "value": 1}`,
+		`{"key": "a", "value": 2}`,
+		`{"key": "b", "value": 3}`,
+	}, "\n")
+	count, err := tc.ImportData(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("импортировано %d ключей, ожидалось 2", count)
+	}
+	for key, want := range map[string][]interface{}{"a": {2.0}, "b": {1.0, 3.0}} {
+		if values, err := tc.Values(key); err != nil || !reflect.DeepEqual(values, want) {
+			t.Errorf("%s = %v, %v; ожидалось %v", key, values, err, want)
+		}
+	}
+}
+
+func TestImportRolledBackWithTransaction(t *testing.T) {
+	pools, _ := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := pools.Transactions().Begin()
+	err = tx.Do(func() error {
+		_, err := tx.ImportData(tc, strings.NewReader(`{"a": 1, "b": 2}`))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pools.Transactions().Rollback(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := tc.GetRange("", maxKey); len(keys) != 0 {
+		t.Errorf("после отката в коллекции ключи %v", keys)
+	}
+}
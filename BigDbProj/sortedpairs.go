@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// sortedPairs - пары в двух массивах по возрастанию ключа. Ключ больше
+// последнего дописывается в конец без сдвига, поэтому структура подходит
+// для данных, которые пишутся по порядку ключей: партиций временного ряда
+// и очередей.
+type sortedPairs struct {
+	keys   []string
+	values []interface{}
+}
+
+// find возвращает позицию ключа и признак его наличия.
+func (p *sortedPairs) find(key string) (int, bool) {
+	i := sort.SearchStrings(p.keys, key)
+	return i, i < len(p.keys) && p.keys[i] == key
+}
+
+func (p *sortedPairs) insert(key string, value interface{}) error {
+	if n := len(p.keys); n == 0 || p.keys[n-1] < key {
+		p.keys, p.values = append(p.keys, key), append(p.values, value)
+		return nil
+	}
+	i, found := p.find(key)
+	if found {
+		return errors.New("Элемент с таким ключом уже существует!")
+	}
+	p.keys = append(p.keys, "")
+	copy(p.keys[i+1:], p.keys[i:])
+	p.keys[i] = key
+	p.values = append(p.values, nil)
+	copy(p.values[i+1:], p.values[i:])
+	p.values[i] = value
+	return nil
+}
+
+func (p *sortedPairs) removeAt(i int) {
+	if i == 0 {
+		// удаление из начала - частый случай для очередей
+		p.keys, p.values = p.keys[1:], p.values[1:]
+		return
+	}
+	p.keys = append(p.keys[:i], p.keys[i+1:]...)
+	p.values = append(p.values[:i], p.values[i+1:]...)
+}
+
+// bounds возвращает полуинтервал позиций ключей из [minValue, maxValue].
+func (p *sortedPairs) bounds(minValue, maxValue string) (int, int) {
+	low := sort.SearchStrings(p.keys, minValue)
+	high := sort.Search(len(p.keys), func(i int) bool { return p.keys[i] > maxValue })
+	if high < low {
+		high = low
+	}
+	return low, high
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+const stringPoolShards = 32
+
+// StringPools хранит по одному экземпляру строк, которые используются как
+// ключи и строковые значения коллекций. Каждая строка учитывается со
+// счетчиком ссылок и освобождается, когда ее больше не хранит ни одна
+// коллекция. Пул разбит на шарды со своими мьютексами, чтобы вставки в
+// разные коллекции не ждали друг друга.
+type StringPools struct {
+	seed    maphash.Seed
+	shards  [stringPoolShards]stringPoolShard
+	lookups atomic.Uint64
+	hits    atomic.Uint64
+}
+
+type stringPoolShard struct {
+	mu      sync.Mutex
+	entries map[string]*internedString
+}
+
+type internedString struct {
+	value string
+	refs  int
+}
+
+// StringPoolStats - состояние пула строк. BytesSaved - байты, которые
+// заняли бы повторные копии строк без пула.
+type StringPoolStats struct {
+	Entries    int     `json:"entries"`
+	References int     `json:"references"`
+	Bytes      int64   `json:"bytes"`
+	BytesSaved int64   `json:"bytesSaved"`
+	Lookups    uint64  `json:"lookups"`
+	Hits       uint64  `json:"hits"`
+	HitRate    float64 `json:"hitRate"`
+}
+
+var instance *StringPools
+var once sync.Once
+
+func GetStringPools() *StringPools {
+	once.Do(func() {
+		instance = &StringPools{seed: maphash.MakeSeed()}
+		for i := range instance.shards {
+			instance.shards[i].entries = make(map[string]*internedString)
+		}
+	})
+	return instance
+}
+
+func (sp *StringPools) shard(str string) *stringPoolShard {
+	return &sp.shards[maphash.String(sp.seed, str)%stringPoolShards]
+}
+
+// Acquire возвращает общий экземпляр строки и увеличивает число ссылок на
+// него. Каждому Acquire должен соответствовать Release.
+func (sp *StringPools) Acquire(str string) string {
+	shard := sp.shard(str)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	sp.lookups.Add(1)
+	if entry, exists := shard.entries[str]; exists {
+		sp.hits.Add(1)
+		entry.refs++
+		return entry.value
+	}
+	shard.entries[str] = &internedString{value: str, refs: 1}
+	return str
+}
+
+// Release уменьшает число ссылок на строку и удаляет ее из пула, когда
+// ссылок не осталось.
+func (sp *StringPools) Release(str string) {
+	shard := sp.shard(str)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entry, exists := shard.entries[str]
+	if !exists {
+		return
+	}
+	entry.refs--
+	if entry.refs <= 0 {
+		delete(shard.entries, str)
+	}
+}
+
+// Stats собирает статистику по всем шардам.
+func (sp *StringPools) Stats() StringPoolStats {
+	var stats StringPoolStats
+	for i := range sp.shards {
+		shard := &sp.shards[i]
+		shard.mu.Lock()
+		for _, entry := range shard.entries {
+			stats.Entries++
+			stats.References += entry.refs
+			stats.Bytes += int64(len(entry.value))
+			stats.BytesSaved += int64(len(entry.value)) * int64(entry.refs-1)
+		}
+		shard.mu.Unlock()
+	}
+	stats.Lookups, stats.Hits = sp.lookups.Load(), sp.hits.Load()
+	if stats.Lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(stats.Lookups)
+	}
+	return stats
+}
+
+// internValue заменяет строки значения, в том числе вложенные в объекты и
+// массивы, на экземпляры из пула. Объекты и массивы копируются, чтобы не
+// менять значение вызывающего.
+func (sp *StringPools) internValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return sp.Acquire(v)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = sp.internValue(item)
+		}
+		return items
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for field, item := range v {
+			fields[field] = sp.internValue(item)
+		}
+		return fields
+	}
+	return value
+}
+
+// releaseValue освобождает строки, захваченные internValue.
+func (sp *StringPools) releaseValue(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		sp.Release(v)
+	case []interface{}:
+		for _, item := range v {
+			sp.releaseValue(item)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			sp.releaseValue(item)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// На других платформах REPL читает строки без редактирования.
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("посимвольный режим терминала не поддерживается")
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return nil
+}
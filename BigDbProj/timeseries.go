@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Временной ряд - движок для данных, которые в основном дописываются по
+// времени. Ключ - метка времени в UTC с наносекундами фиксированной ширины
+// и необязательный тег серии через "/": "2024-05-01T10:00:00.000000000Z/cpu".
+// Такие ключи побайтово упорядочены по времени, а внутри одного момента -
+// по серии. Пары хранятся в партициях шириной partition, каждая - два
+// отсортированных массива, поэтому запись нового по времени ключа - это
+// добавление в конец последней партиции, а срок хранения retention удаляет
+// устаревшие партиции целиком.
+
+const timeSeriesEngine = "timeseries"
+
+// timeSeriesLayout - формат метки времени в ключе временного ряда.
+const timeSeriesLayout = "2006-01-02T15:04:05.000000000Z"
+
+var ErrNotTimeSeries = errors.New("Коллекция не является временным рядом!")
+
+type TimeSeries struct {
+	partition time.Duration
+	retention time.Duration
+	chunks    []*timeChunk
+	keyVersions
+}
+
+// timeChunk - партиция ряда: ключи с метками из [start, start+partition).
+type timeChunk struct {
+	start time.Time
+	sortedPairs
+}
+
+// TimePoint - точка временного ряда.
+type TimePoint struct {
+	Time   time.Time   `json:"time"`
+	Series string      `json:"series,omitempty"`
+	Value  interface{} `json:"value"`
+}
+
+// TimeBucket - интервал прореживания ряда и агрегаты его числовых значений.
+type TimeBucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Avg   float64   `json:"avg"`
+}
+
+func NewTimeSeries(partition, retention time.Duration) *TimeSeries {
+	return &TimeSeries{partition: partition, retention: retention}
+}
+
+// timeSeriesKey составляет ключ ряда из метки времени и серии.
+func timeSeriesKey(t time.Time, series string) string {
+	key := t.UTC().Format(timeSeriesLayout)
+	if series != "" {
+		key += "/" + series
+	}
+	return key
+}
+
+// parseTimeSeriesKey разбирает ключ ряда в каноническом виде.
+func parseTimeSeriesKey(key string) (time.Time, string, error) {
+	stamp, series, _ := strings.Cut(key, "/")
+	t, err := time.Parse(timeSeriesLayout, stamp)
+	if err != nil || timeSeriesKey(t, series) != key {
+		return time.Time{}, "", fmt.Errorf("ключ временного ряда должен иметь вид %s[/серия]: %s", timeSeriesLayout, key)
+	}
+	return t, series, nil
+}
+
+// parseTimeArgument разбирает метку времени из аргумента команды: RFC 3339,
+// now или now-длительность, например now-1h.
+func parseTimeArgument(arg string) (time.Time, error) {
+	if arg == "now" {
+		return time.Now(), nil
+	}
+	if ago, ok := strings.CutPrefix(arg, "now-"); ok {
+		d, err := time.ParseDuration(ago)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("некорректная длительность в метке времени %s", arg)
+		}
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, arg)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("некорректная метка времени %s: ожидается RFC 3339, now или now-1h", arg)
+	}
+	return t, nil
+}
+
+// canonicalTimeSeriesKey переводит аргумент вида время[/серия] в ключ ряда.
+func canonicalTimeSeriesKey(arg string) (string, error) {
+	stamp, series, _ := strings.Cut(arg, "/")
+	t, err := parseTimeArgument(stamp)
+	if err != nil {
+		return "", err
+	}
+	return timeSeriesKey(t, series), nil
+}
+
+// ValidateKey проверяет, что ключ записан в каноническом виде.
+func (ts *TimeSeries) ValidateKey(key string) error {
+	_, _, err := parseTimeSeriesKey(key)
+	return err
+}
+
+// chunk находит партицию ключа; при create недостающая партиция создается.
+func (ts *TimeSeries) chunk(key string, create bool) (*timeChunk, error) {
+	t, _, err := parseTimeSeriesKey(key)
+	if err != nil {
+		return nil, err
+	}
+	start := t.Truncate(ts.partition)
+	i := sort.Search(len(ts.chunks), func(i int) bool { return !ts.chunks[i].start.Before(start) })
+	if i < len(ts.chunks) && ts.chunks[i].start.Equal(start) {
+		return ts.chunks[i], nil
+	}
+	if !create {
+		return nil, errors.New("Элемент не найден!")
+	}
+	c := &timeChunk{start: start}
+	ts.chunks = append(ts.chunks, nil)
+	copy(ts.chunks[i+1:], ts.chunks[i:])
+	ts.chunks[i] = c
+	return c, nil
+}
+
+func (ts *TimeSeries) Insert(key string, value interface{}) error {
+	c, err := ts.chunk(key, true)
+	if err != nil {
+		return err
+	}
+	if err := c.insert(key, value); err != nil {
+		return err
+	}
+	ts.bump(key)
+	return nil
+}
+
+func (ts *TimeSeries) Get(key string) (interface{}, error) {
+	c, err := ts.chunk(key, false)
+	if err != nil {
+		return nil, err
+	}
+	i, found := c.find(key)
+	if !found {
+		return nil, errors.New("Элемент не найден!")
+	}
+	return c.values[i], nil
+}
+
+func (ts *TimeSeries) Update(key string, value interface{}) error {
+	c, err := ts.chunk(key, false)
+	if err != nil {
+		return err
+	}
+	i, found := c.find(key)
+	if !found {
+		return errors.New("Элемент не найден!")
+	}
+	c.values[i] = value
+	ts.bump(key)
+	return nil
+}
+
+func (ts *TimeSeries) Remove(key string) error {
+	c, err := ts.chunk(key, false)
+	if err != nil {
+		return err
+	}
+	i, found := c.find(key)
+	if !found {
+		return errors.New("Элемент не найден!")
+	}
+	c.removeAt(i)
+	if len(c.keys) == 0 {
+		for j, other := range ts.chunks {
+			if other == c {
+				ts.chunks = append(ts.chunks[:j], ts.chunks[j+1:]...)
+				break
+			}
+		}
+	}
+	ts.forget(key)
+	return nil
+}
+
+func (ts *TimeSeries) GetVersioned(key string) (interface{}, uint64, error) {
+	return getVersioned(ts, key)
+}
+
+func (ts *TimeSeries) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return compareAndSet(ts, key, expectedVersion, value)
+}
+
+func (ts *TimeSeries) GetRange(minValue, maxValue string) ([]string, error) {
+	var keys []string
+	ts.ScanRange(minValue, maxValue, func(key string, _ interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys, nil
+}
+
+// ScanRange обходит партиции по порядку, пропуская целиком те, что лежат
+// вне диапазона.
+func (ts *TimeSeries) ScanRange(minValue, maxValue string, fn func(key string, value interface{}) bool) {
+	for _, c := range ts.chunks {
+		if c.keys[len(c.keys)-1] < minValue {
+			continue
+		}
+		if c.keys[0] > maxValue {
+			return
+		}
+		low, high := c.bounds(minValue, maxValue)
+		for i := low; i < high; i++ {
+			if !fn(c.keys[i], c.values[i]) {
+				return
+			}
+		}
+	}
+}
+
+func (ts *TimeSeries) CountRange(minValue, maxValue string) int {
+	count := 0
+	for _, c := range ts.chunks {
+		low, high := c.bounds(minValue, maxValue)
+		count += high - low
+	}
+	return count
+}
+
+func (ts *TimeSeries) FirstKey(minValue, maxValue string) (string, bool) {
+	var first string
+	found := false
+	ts.ScanRange(minValue, maxValue, func(key string, _ interface{}) bool {
+		first, found = key, true
+		return false
+	})
+	return first, found
+}
+
+func (ts *TimeSeries) LastKey(minValue, maxValue string) (string, bool) {
+	for j := len(ts.chunks) - 1; j >= 0; j-- {
+		c := ts.chunks[j]
+		i := sort.Search(len(c.keys), func(i int) bool { return c.keys[i] > maxValue }) - 1
+		if i >= 0 {
+			if c.keys[i] < minValue {
+				return "", false
+			}
+			return c.keys[i], true
+		}
+	}
+	return "", false
+}
+
+func (ts *TimeSeries) Rank(key string) int {
+	rank := 0
+	for _, c := range ts.chunks {
+		i := sort.SearchStrings(c.keys, key)
+		rank += i
+		if i < len(c.keys) {
+			break
+		}
+	}
+	return rank
+}
+
+func (ts *TimeSeries) Select(k int) (string, bool) {
+	if k < 0 {
+		return "", false
+	}
+	for _, c := range ts.chunks {
+		if k < len(c.keys) {
+			return c.keys[k], true
+		}
+		k -= len(c.keys)
+	}
+	return "", false
+}
+
+// BulkLoad раскладывает упорядоченные пары по партициям дописыванием.
+// Ключи уже проверены через ValidateKey.
+func (ts *TimeSeries) BulkLoad(keys []string, values []interface{}) {
+	for i, key := range keys {
+		ts.Insert(key, values[i])
+	}
+}
+
+func (ts *TimeSeries) SaveToFile(filename string) error {
+	type savedChunk struct {
+		Start   time.Time  `json:"start"`
+		Entries []KeyValue `json:"entries"`
+	}
+	saved := make([]savedChunk, len(ts.chunks))
+	for i, c := range ts.chunks {
+		saved[i] = savedChunk{Start: c.start, Entries: make([]KeyValue, len(c.keys))}
+		for j, key := range c.keys {
+			saved[i].Entries[j] = KeyValue{Key: key, Value: c.values[j]}
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"partition": ts.partition.String(), "chunks": saved})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+// retentionDue сообщает, что самая старая партиция вышла за срок хранения.
+func (ts *TimeSeries) retentionDue(now time.Time) bool {
+	return ts.retention > 0 && len(ts.chunks) > 0 && !ts.chunks[0].start.Add(ts.partition).After(now.Add(-ts.retention))
+}
+
+// DropBefore удаляет партиции, целиком лежащие раньше cutoff, и возвращает
+// их пары.
+func (ts *TimeSeries) DropBefore(cutoff time.Time) []KeyValue {
+	var dropped []KeyValue
+	n := 0
+	for n < len(ts.chunks) && !ts.chunks[n].start.Add(ts.partition).After(cutoff) {
+		c := ts.chunks[n]
+		for i, key := range c.keys {
+			dropped = append(dropped, KeyValue{Key: key, Value: c.values[i]})
+			ts.forget(key)
+		}
+		n++
+	}
+	ts.chunks = ts.chunks[n:]
+	return dropped
+}
+
+// timeSeries возвращает движок временного ряда коллекции. Вызывается под
+// блокировкой коллекции.
+func (tc *TreeCollection) timeSeries() (*TimeSeries, error) {
+	ts, ok := tc.Tree.(*TimeSeries)
+	if !ok {
+		return nil, ErrNotTimeSeries
+	}
+	return ts, nil
+}
+
+// EnforceRetention удаляет партиции временного ряда старше срока хранения.
+// Исключительная блокировка берется, только если такие партиции есть.
+func (tc *TreeCollection) EnforceRetention() int {
+	now := time.Now()
+	tc.mu.RLock()
+	ts, err := tc.timeSeries()
+	due := err == nil && ts.retentionDue(now)
+	tc.mu.RUnlock()
+	if !due {
+		return 0
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if ts, err = tc.timeSeries(); err != nil {
+		return 0
+	}
+	dropped := ts.DropBefore(now.Add(-ts.retention))
+	for _, entry := range dropped {
+		// партиция уже удалена, поэтому ошибка индекса не откатывается
+		if err := tc.indexRemove(entry.Key, tc.upgrade(entry.Key, entry.Value)); err != nil {
+			fmt.Println("Ошибка удаления ключа", entry.Key, "из индекса:", err)
+		}
+		tc.forget(entry.Key, entry.Value)
+	}
+	return len(dropped)
+}
+
+// SetRetention меняет срок хранения временного ряда; 0 - хранить всё.
+func (tc *TreeCollection) SetRetention(retention time.Duration) error {
+	if retention < 0 {
+		return fmt.Errorf("некорректный срок хранения: %s", retention)
+	}
+	tc.mu.Lock()
+	ts, err := tc.timeSeries()
+	if err == nil {
+		ts.retention = retention
+		options := make(map[string]string, len(tc.engineOptions)+1)
+		for name, value := range tc.engineOptions {
+			options[name] = value
+		}
+		options["retention"] = retention.String()
+		tc.engineOptions = options
+	}
+	tc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tc.EnforceRetention()
+	return nil
+}
+
+// Window возвращает точки ряда с метками из [from, to] по возрастанию
+// времени; непустая series оставляет только точки этой серии.
+func (tc *TreeCollection) Window(series string, from, to time.Time) ([]TimePoint, error) {
+	tc.EnforceRetention()
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if _, err := tc.timeSeries(); err != nil {
+		return nil, err
+	}
+	points := []TimePoint{}
+	err := tc.scanRange(timeSeriesKey(from, ""), timeSeriesKey(to, "")+maxKey, func(key string, value interface{}) bool {
+		t, s, err := parseTimeSeriesKey(key)
+		if err != nil || (series != "" && s != series) {
+			return true
+		}
+		for _, item := range tc.elements(value) {
+			points = append(points, TimePoint{Time: t, Series: s, Value: item})
+		}
+		return true
+	})
+	return points, err
+}
+
+// Downsample прореживает окно ряда: точки группируются в интервалы длины
+// bucket, и для каждого непустого интервала считаются min, max и avg
+// числовых значений (или поля field значений). Нечисловые значения
+// пропускаются.
+func (tc *TreeCollection) Downsample(series string, from, to time.Time, bucket time.Duration, field string) ([]TimeBucket, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("некорректный интервал прореживания: %s", bucket)
+	}
+	points, err := tc.Window(series, from, to)
+	if err != nil {
+		return nil, err
+	}
+	buckets := []TimeBucket{}
+	var sum float64
+	for _, point := range points {
+		value := point.Value
+		if field != "" {
+			var ok bool
+			if value, ok = fieldValue(value, field); !ok {
+				continue
+			}
+		}
+		number, ok := toFloat(value)
+		if !ok {
+			continue
+		}
+		start := point.Time.Truncate(bucket)
+		if n := len(buckets); n == 0 || !buckets[n-1].Start.Equal(start) {
+			if n > 0 {
+				buckets[n-1].Avg = sum / float64(buckets[n-1].Count)
+			}
+			buckets = append(buckets, TimeBucket{Start: start, Min: number, Max: number})
+			sum = 0
+		}
+		b := &buckets[len(buckets)-1]
+		if number < b.Min {
+			b.Min = number
+		}
+		if number > b.Max {
+			b.Max = number
+		}
+		sum += number
+		b.Count++
+	}
+	if n := len(buckets); n > 0 {
+		buckets[n-1].Avg = sum / float64(buckets[n-1].Count)
+	}
+	return buckets, nil
+}
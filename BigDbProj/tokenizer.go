@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// CommandSyntaxError - ошибка разбора команды. Incomplete означает, что
+// строка оборвалась внутри кавычек, JSON или после \, и ее можно продолжить.
+type CommandSyntaxError struct {
+	Pos        int
+	Message    string
+	Incomplete bool
+}
+
+func (e *CommandSyntaxError) Error() string {
+	return fmt.Sprintf("позиция %d: %s", e.Pos, e.Message)
+}
+
+// SplitCommand разбивает строку команды на аргументы.
+//
+//   - аргументы разделяются пробельными символами;
+//   - в 'одинарных кавычках' текст берется как есть, кроме \' и \\;
+//   - в "двойных кавычках" работают \" \\ \n \t \r;
+//   - вне кавычек \ экранирует следующий символ;
+//   - аргумент, начинающийся с { или [, читается до парной скобки и
+//     проверяется как JSON, поэтому пробелы и кавычки внутри допустимы;
+//   - после query, в том числе в in-tx, остаток строки берется одним
+//     аргументом как есть: кавычки в нем разбирает язык запросов. Запрос,
+//     целиком взятый в кавычки, как раньше, из них извлекается.
+//
+// Соседние части склеиваются: ab"c d" дает один аргумент "abc d".
+func SplitCommand(command string) ([]string, error) {
+	var args []string
+	runes := []rune(command)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		if runes[i] == '{' || runes[i] == '[' {
+			end, err := scanJSON(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			if end < len(runes) && !unicode.IsSpace(runes[end]) {
+				return nil, &CommandSyntaxError{Pos: end + 1, Message: "после JSON ожидается пробел"}
+			}
+			args = append(args, string(runes[i:end]))
+			i = end
+			continue
+		}
+
+		var sb strings.Builder
+		for i < len(runes) && !unicode.IsSpace(runes[i]) {
+			switch r := runes[i]; r {
+			case '\'', '"':
+				start := i
+				i++
+				for {
+					if i >= len(runes) {
+						return nil, &CommandSyntaxError{Pos: start + 1, Message: "незакрытая кавычка", Incomplete: true}
+					}
+					c := runes[i]
+					if c == r {
+						i++
+						break
+					}
+					if c == '\\' && i+1 < len(runes) {
+						if escaped, ok := unescape(r, runes[i+1]); ok {
+							sb.WriteRune(escaped)
+							i += 2
+							continue
+						}
+					}
+					sb.WriteRune(c)
+					i++
+				}
+			case '\\':
+				if i+1 >= len(runes) {
+					return nil, &CommandSyntaxError{Pos: i + 1, Message: "команда оканчивается на \\", Incomplete: true}
+				}
+				sb.WriteRune(runes[i+1])
+				i += 2
+			default:
+				sb.WriteRune(r)
+				i++
+			}
+		}
+		args = append(args, sb.String())
+		if rawTail(args) {
+			rest := strings.TrimSpace(string(runes[i:]))
+			if rest == "" {
+				break
+			}
+			// запрос языка не может состоять из одной строки в кавычках
+			if quoted, err := SplitCommand(rest); err == nil && len(quoted) == 1 && (rest[0] == '\'' || rest[0] == '"') {
+				rest = quoted[0]
+			}
+			args = append(args, rest)
+			break
+		}
+	}
+	return args, nil
+}
+
+// rawTail сообщает, что после аргументов args идет текст запроса.
+func rawTail(args []string) bool {
+	switch len(args) {
+	case 1:
+		return args[0] == "query"
+	case 3:
+		return args[0] == "in-tx" && args[2] == "query"
+	}
+	return false
+}
+
+// unescape возвращает символ для последовательности \c внутри кавычек quote.
+func unescape(quote, c rune) (rune, bool) {
+	if c == quote || c == '\\' {
+		return c, true
+	}
+	if quote == '\'' {
+		return 0, false
+	}
+	switch c {
+	case 'n':
+		return '\n', true
+	case 't':
+		return '\t', true
+	case 'r':
+		return '\r', true
+	}
+	return 0, false
+}
+
+// scanJSON находит конец JSON-объекта или массива, начинающегося в позиции
+// start, и проверяет его синтаксис.
+func scanJSON(runes []rune, start int) (int, error) {
+	depth := 0
+	inString := false
+	for i := start; i < len(runes); i++ {
+		r := runes[i]
+		if inString {
+			switch r {
+			case '\\':
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch r {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				var value interface{}
+				if err := json.Unmarshal([]byte(string(runes[start:i+1])), &value); err != nil {
+					return 0, &CommandSyntaxError{Pos: start + 1, Message: "некорректный JSON: " + err.Error()}
+				}
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, &CommandSyntaxError{Pos: start + 1, Message: "незакрытая скобка JSON", Incomplete: true}
+}
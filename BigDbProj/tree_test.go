@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// checkAVL проверяет баланс, высоты и размеры поддеревьев AVL-дерева и
+// возвращает высоту и размер node.
+func checkAVL(t *testing.T, node *Node) (int, int) {
+	t.Helper()
+	if node == nil {
+		return 0, 0
+	}
+	lh, ls := checkAVL(t, node.left)
+	rh, rs := checkAVL(t, node.right)
+	if lh-rh > 1 || rh-lh > 1 {
+		t.Fatalf("узел %s разбалансирован: высоты %d и %d", node.key, lh, rh)
+	}
+	if h := 1 + max(lh, rh); node.height != h {
+		t.Fatalf("высота узла %s %d, ожидалась %d", node.key, node.height, h)
+	}
+	if node.size != 1+ls+rs {
+		t.Fatalf("размер узла %s %d, ожидался %d", node.key, node.size, 1+ls+rs)
+	}
+	return node.height, node.size
+}
+
+// checkRB проверяет цвета, ссылки на родителя и размеры поддеревьев
+// красно-черного дерева и возвращает черную высоту и размер node.
+func checkRB(t *testing.T, node, parent *NodeRB) (int, int) {
+	t.Helper()
+	if node == nil {
+		return 1, 0
+	}
+	if node.parent != parent {
+		t.Fatalf("у узла %s неверная ссылка на родителя", node.key)
+	}
+	if node.color == RED {
+		for _, child := range []*NodeRB{node.leftChild, node.rightChild} {
+			if child != nil && child.color == RED {
+				t.Fatalf("у красного узла %s красный потомок %s", node.key, child.key)
+			}
+		}
+	}
+	lb, ls := checkRB(t, node.leftChild, node)
+	rb, rs := checkRB(t, node.rightChild, node)
+	if lb != rb {
+		t.Fatalf("у узла %s черные высоты поддеревьев %d и %d", node.key, lb, rb)
+	}
+	if node.size != 1+ls+rs {
+		t.Fatalf("размер узла %s %d, ожидался %d", node.key, node.size, 1+ls+rs)
+	}
+	if node.color == BLACK {
+		lb++
+	}
+	return lb, node.size
+}
+
+// checkB проверяет заполнение узлов, глубину листьев и размеры поддеревьев
+// B-дерева и возвращает глубину листьев и размер node.
+func checkB(t *testing.T, tree *BTree, node *NodeB, root bool) (int, int) {
+	t.Helper()
+	if len(node.keys) > 2*tree.degree-1 || (!root && len(node.keys) < tree.degree-1) {
+		t.Fatalf("в узле %v %d ключей при степени %d", node.keys, len(node.keys), tree.degree)
+	}
+	if node.leaf {
+		if node.size != len(node.keys) {
+			t.Fatalf("размер листа %v %d", node.keys, node.size)
+		}
+		return 0, node.size
+	}
+	if len(node.children) != len(node.keys)+1 {
+		t.Fatalf("у узла %v %d потомков", node.keys, len(node.children))
+	}
+	depth, size := -1, len(node.keys)
+	for _, child := range node.children {
+		d, s := checkB(t, tree, child, false)
+		if depth >= 0 && d != depth {
+			t.Fatalf("листья под узлом %v на разной глубине", node.keys)
+		}
+		depth = d
+		size += s
+	}
+	if node.size != size {
+		t.Fatalf("размер узла %v %d, ожидался %d", node.keys, node.size, size)
+	}
+	return depth + 1, size
+}
+
+type orderedTree interface {
+	Tree
+	OrderStatistics
+}
+
+// Случайные вставки и удаления сверяются с отсортированным срезом: после
+// каждой операции проверяются инварианты дерева, размеры поддеревьев,
+// GetRange, Rank, Select и CountRange.
+func TestTreeEnginesAgainstSortedSlice(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		tree  func() orderedTree
+		check func(t *testing.T, tree orderedTree) int
+	}{
+		{"avl", func() orderedTree { return NewAVLTree() }, func(t *testing.T, tree orderedTree) int {
+			_, size := checkAVL(t, tree.(*AVLTree).root)
+			return size
+		}},
+		{"redblack", func() orderedTree { return NewRedBlackTree() }, func(t *testing.T, tree orderedTree) int {
+			root := tree.(*RedBlackTree).root
+			if root != nil && root.color != BLACK {
+				t.Fatal("корень красно-черного дерева красный")
+			}
+			_, size := checkRB(t, root, nil)
+			return size
+		}},
+		{"btree-2", func() orderedTree { return NewBTreeWithDegree(2) }, func(t *testing.T, tree orderedTree) int {
+			b := tree.(*BTree)
+			_, size := checkB(t, b, b.root, true)
+			return size
+		}},
+		{"btree-3", func() orderedTree { return NewBTreeWithDegree(3) }, func(t *testing.T, tree orderedTree) int {
+			b := tree.(*BTree)
+			_, size := checkB(t, b, b.root, true)
+			return size
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+			tree := tt.tree()
+			var sorted []string
+			for step := 0; step < 3000; step++ {
+				key := fmt.Sprintf("k%03d", rng.Intn(400))
+				i := sort.SearchStrings(sorted, key)
+				present := i < len(sorted) && sorted[i] == key
+				// вставки чаще удалений, пока дерево не наберет размер
+				if rng.Intn(10) < 6 {
+					err := tree.Insert(key, key)
+					if present != (err != nil) {
+						t.Fatalf("шаг %d: Insert(%s) = %v при наличии ключа %v", step, key, err, present)
+					}
+					if !present {
+						sorted = append(sorted[:i], append([]string{key}, sorted[i:]...)...)
+					}
+				} else {
+					err := tree.Remove(key)
+					if present != (err == nil) {
+						t.Fatalf("шаг %d: Remove(%s) = %v при наличии ключа %v", step, key, err, present)
+					}
+					if present {
+						sorted = append(sorted[:i], sorted[i+1:]...)
+					}
+				}
+
+				if size := tt.check(t, tree); size != len(sorted) {
+					t.Fatalf("шаг %d: размер дерева %d, ожидался %d", step, size, len(sorted))
+				}
+				if step%50 != 0 {
+					continue
+				}
+				keys, err := tree.GetRange("", maxKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(keys) != len(sorted) || (len(keys) > 0 && !reflect.DeepEqual(keys, sorted)) {
+					t.Fatalf("шаг %d: GetRange = %v, ожидалось %v", step, keys, sorted)
+				}
+				for k, want := range sorted {
+					if got, ok := tree.Select(k); !ok || got != want {
+						t.Fatalf("шаг %d: Select(%d) = %s, %v; ожидалось %s", step, k, got, ok, want)
+					}
+				}
+				if _, ok := tree.Select(len(sorted)); ok {
+					t.Fatalf("шаг %d: Select(%d) за концом дерева", step, len(sorted))
+				}
+				for probe := 0; probe < 20; probe++ {
+					key := fmt.Sprintf("k%03d", rng.Intn(400))
+					if got, want := tree.Rank(key), sort.SearchStrings(sorted, key); got != want {
+						t.Fatalf("шаг %d: Rank(%s) = %d, ожидалось %d", step, key, got, want)
+					}
+					low, high := key, fmt.Sprintf("k%03d", rng.Intn(400))
+					want := 0
+					if low <= high {
+						want = sort.SearchStrings(sorted, high+"\x00") - sort.SearchStrings(sorted, low)
+					}
+					if got := tree.CountRange(low, high); got != want {
+						t.Fatalf("шаг %d: CountRange(%s, %s) = %d, ожидалось %d", step, low, high, got, want)
+					}
+				}
+			}
+		})
+	}
+}
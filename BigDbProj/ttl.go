@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+)
+
+const expirySweepInterval = time.Second
+
+// expiryEntry - срок жизни ключа в очереди на удаление. Записи не удаляются
+// из очереди при смене срока: устаревшая запись узнается по несовпадению с
+// tc.expires и пропускается.
+type expiryEntry struct {
+	key string
+	at  time.Time
+}
+
+type expiryQueue []expiryEntry
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryEntry)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	entry := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// expired сообщает, истек ли срок жизни ключа. Истекший ключ невидим для
+// чтения, хотя физически может еще лежать в дереве.
+// Вызывается под блокировкой коллекции.
+func (tc *TreeCollection) expired(key string) bool {
+	at, ok := tc.expires[key]
+	return ok && !time.Now().Before(at)
+}
+
+// setExpiry задает срок жизни ключа; нулевое время снимает его.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) setExpiry(key string, at time.Time) {
+	if at.IsZero() {
+		delete(tc.expires, key)
+		return
+	}
+	tc.expires[key] = at
+	heap.Push(&tc.expiryQueue, expiryEntry{key: key, at: at})
+}
+
+// purgeDue физически удаляет ключи, срок жизни которых истек к now.
+// Вызывается под исключительной блокировкой коллекции.
+func (tc *TreeCollection) purgeDue(now time.Time) int {
+	purged := 0
+	for tc.expiryQueue.Len() > 0 && !tc.expiryQueue[0].at.After(now) {
+		entry := heap.Pop(&tc.expiryQueue).(expiryEntry)
+		if at, ok := tc.expires[entry.key]; ok && at.Equal(entry.at) {
+			if tc.drop(entry.key) == nil {
+				purged++
+			}
+		}
+	}
+	return purged
+}
+
+// PurgeExpired удаляет ключи с истекшим сроком жизни. Исключительная
+// блокировка берется, только если в очереди есть наступивший срок.
+func (tc *TreeCollection) PurgeExpired() int {
+	now := time.Now()
+	tc.mu.RLock()
+	due := tc.expiryQueue.Len() > 0 && !tc.expiryQueue[0].at.After(now)
+	tc.mu.RUnlock()
+	if !due {
+		return 0
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.purgeDue(now)
+}
+
+// InsertWithExpiry вставляет ключ, который перестанет быть виден в момент
+// expiresAt. Нулевое время означает бессрочный ключ.
+func (tc *TreeCollection) InsertWithExpiry(key string, value interface{}, expiresAt time.Time) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if err := tc.insert(key, value); err != nil {
+		return err
+	}
+	tc.setExpiry(key, expiresAt)
+	return nil
+}
+
+// UpdateWithExpiry обновляет значение и срок жизни ключа. Обычный Update
+// срок жизни не меняет.
+func (tc *TreeCollection) UpdateWithExpiry(key string, value interface{}, expiresAt time.Time) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if err := tc.update(key, value); err != nil {
+		return err
+	}
+	tc.setExpiry(key, expiresAt)
+	return nil
+}
+
+// Expire меняет срок жизни существующего ключа.
+func (tc *TreeCollection) Expire(key string, expiresAt time.Time) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.version(key); !ok {
+		return ErrKeyNotFound
+	}
+	tc.setExpiry(key, expiresAt)
+	return nil
+}
+
+// Expiry возвращает срок жизни ключа или нулевое время для бессрочного.
+func (tc *TreeCollection) Expiry(key string) (time.Time, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	if _, ok := tc.version(key); !ok {
+		return time.Time{}, ErrKeyNotFound
+	}
+	return tc.expires[key], nil
+}
+
+// expiresAfter переводит TTL в момент истечения; нулевой TTL - бессрочно.
+func expiresAfter(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// parseTTLFlag разбирает необязательный флаг "--ttl 30s" после значения в
+// командах insert-data и update-data.
+func parseTTLFlag(command string, flags []string) (time.Duration, error) {
+	if len(flags) == 0 {
+		return 0, nil
+	}
+	if len(flags) != 2 || flags[0] != "--ttl" {
+		return 0, fmt.Errorf("лишние аргументы команды %s: значения с пробелами заключите в кавычки", command)
+	}
+	ttl, err := time.ParseDuration(flags[1])
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("некорректный TTL: %s", flags[1])
+	}
+	return ttl, nil
+}
+
+// sweepExpired периодически удаляет истекшие ключи во всех коллекциях и
+// устаревшие партиции временных рядов.
+func (ap *AllPools) sweepExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, tc := range ap.collections() {
+			ap.sweepCollection(tc)
+		}
+	}
+}
+
+// sweepCollection чистит коллекцию под исключительной транзакционной
+// блокировкой. Коллекция, которую держит транзакция, пропускается до
+// следующего прохода: откат транзакции должен найти измененные ею ключи,
+// даже если их срок жизни уже истек.
+func (ap *AllPools) sweepCollection(tc *TreeCollection) {
+	ap.Transactions().Autocommit(func(tx *Transaction) error {
+		if tx.TryLock(tc, ExclusiveLock) {
+			tc.PurgeExpired()
+			tc.EnforceRetention()
+		}
+		return nil
+	})
+}
+
+// collections возвращает все коллекции всех пулов.
+func (ap *AllPools) collections() []*TreeCollection {
+	var result []*TreeCollection
+	for _, poolName := range ap.PoolNames() {
+		ap.WithPool(poolName, func(pool *Pools) error {
+			for _, schemaName := range pool.SchemaNames() {
+				ap.WithSchema(poolName, schemaName, func(schema *Schema) error {
+					schema.mu.RLock()
+					defer schema.mu.RUnlock()
+					for _, tc := range schema.Collection {
+						result = append(result, tc)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+	return result
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type LockMode int
+
+const (
+	SharedLock    LockMode = 0
+	ExclusiveLock LockMode = 1
+)
+
+const (
+	defaultLockTimeout     = 5 * time.Second
+	deadlockDetectInterval = 100 * time.Millisecond
+	defaultIdleTimeout     = 5 * time.Minute
+	idleCheckInterval      = time.Second
+)
+
+var (
+	ErrDeadlock    = errors.New("Транзакция прервана: обнаружена взаимоблокировка!")
+	ErrLockTimeout = errors.New("Истекло время ожидания блокировки коллекции!")
+	ErrTxNotFound  = errors.New("Транзакция не найдена!")
+)
+
+// collectionLock - транзакционная блокировка одной коллекции. Канал released
+// закрывается при каждом освобождении, чтобы разбудить всех ожидающих.
+type collectionLock struct {
+	holders  map[uint64]LockMode
+	released chan struct{}
+}
+
+func (l *collectionLock) conflicts(txID uint64, mode LockMode) []uint64 {
+	var result []uint64
+	for holder, held := range l.holders {
+		if holder != txID && (mode == ExclusiveLock || held == ExclusiveLock) {
+			result = append(result, holder)
+		}
+	}
+	return result
+}
+
+type lockWait struct {
+	collection *TreeCollection
+	mode       LockMode
+}
+
+// Transaction держит блокировки коллекций до фиксации или отката (строгая
+// двухфазная блокировка) и журнал отмены для отката своих изменений.
+// Транзакция, в которой дольше IdleTimeout не выполнялось запросов,
+// откатывается: ее клиент мог отключиться, не освободив блокировки.
+type Transaction struct {
+	ID          uint64
+	LockTimeout time.Duration
+	IdleTimeout time.Duration
+
+	tm       *TransactionManager
+	opMu     sync.Mutex
+	undo     []func()
+	onCommit []func()
+	locks    map[*TreeCollection]LockMode
+	abort    chan struct{}
+	abortErr error
+	done     bool
+	lastUsed time.Time
+}
+
+type TransactionManager struct {
+	mu      sync.Mutex
+	nextID  uint64
+	active  map[uint64]*Transaction
+	locks   map[*TreeCollection]*collectionLock
+	waiting map[uint64]lockWait
+}
+
+func NewTransactionManager() *TransactionManager {
+	tm := &TransactionManager{
+		active:  make(map[uint64]*Transaction),
+		locks:   make(map[*TreeCollection]*collectionLock),
+		waiting: make(map[uint64]lockWait),
+	}
+	go tm.detectDeadlocks(deadlockDetectInterval)
+	go tm.rollbackIdle(idleCheckInterval)
+	return tm
+}
+
+func (tm *TransactionManager) Begin() *Transaction {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.nextID++
+	tx := &Transaction{
+		ID:          tm.nextID,
+		LockTimeout: defaultLockTimeout,
+		IdleTimeout: defaultIdleTimeout,
+		tm:          tm,
+		locks:       make(map[*TreeCollection]LockMode),
+		abort:       make(chan struct{}),
+		lastUsed:    time.Now(),
+	}
+	tm.active[tx.ID] = tx
+	return tx
+}
+
+func (tm *TransactionManager) Get(id uint64) (*Transaction, error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tx, ok := tm.active[id]
+	if !ok {
+		return nil, ErrTxNotFound
+	}
+	return tx, nil
+}
+
+func (tm *TransactionManager) Commit(id uint64) error {
+	tx, err := tm.Get(id)
+	if err != nil {
+		return err
+	}
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+	if tx.done {
+		return ErrTxNotFound
+	}
+	tm.finish(tx)
+	tx.committed()
+	fmt.Println("Транзакция", tx.ID, "зафиксирована.")
+	return nil
+}
+
+func (tm *TransactionManager) Rollback(id uint64) error {
+	tx, err := tm.Get(id)
+	if err != nil {
+		return err
+	}
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+	if tx.done {
+		return ErrTxNotFound
+	}
+	tx.rollback()
+	return nil
+}
+
+// Autocommit выполняет fn в отдельной короткой транзакции: фиксирует ее при
+// успехе и откатывает при ошибке.
+func (tm *TransactionManager) Autocommit(fn func(tx *Transaction) error) error {
+	tx := tm.Begin()
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+	if err := fn(tx); err != nil {
+		if !tx.done {
+			tx.rollback()
+		}
+		return err
+	}
+	if !tx.done {
+		tm.finish(tx)
+		tx.committed()
+	}
+	return nil
+}
+
+// finish снимает все блокировки транзакции и убирает ее из активных.
+// Вызывается под tx.opMu.
+func (tm *TransactionManager) finish(tx *Transaction) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for tc := range tx.locks {
+		l := tm.locks[tc]
+		delete(l.holders, tx.ID)
+		close(l.released)
+		l.released = make(chan struct{})
+		if len(l.holders) == 0 {
+			delete(tm.locks, tc)
+		}
+	}
+	tx.locks = nil
+	tx.done = true
+	delete(tm.active, tx.ID)
+	delete(tm.waiting, tx.ID)
+}
+
+// acquire ждет блокировку коллекции не дольше tx.LockTimeout. Пока
+// транзакция ждет, она видна детектору взаимоблокировок как ребро графа
+// ожиданий.
+func (tm *TransactionManager) acquire(tx *Transaction, tc *TreeCollection, mode LockMode) error {
+	timer := time.NewTimer(tx.LockTimeout)
+	defer timer.Stop()
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	for {
+		if tx.abortErr != nil {
+			delete(tm.waiting, tx.ID)
+			return tx.abortErr
+		}
+		l, ok := tm.locks[tc]
+		if !ok {
+			l = &collectionLock{holders: make(map[uint64]LockMode), released: make(chan struct{})}
+			tm.locks[tc] = l
+		}
+		if len(l.conflicts(tx.ID, mode)) == 0 {
+			if held, ok := l.holders[tx.ID]; !ok || held < mode {
+				l.holders[tx.ID] = mode
+				tx.locks[tc] = mode
+			}
+			delete(tm.waiting, tx.ID)
+			return nil
+		}
+
+		tm.waiting[tx.ID] = lockWait{collection: tc, mode: mode}
+		released := l.released
+		tm.mu.Unlock()
+		select {
+		case <-released:
+			tm.mu.Lock()
+		case <-tx.abort:
+			tm.mu.Lock()
+		case <-timer.C:
+			tm.mu.Lock()
+			delete(tm.waiting, tx.ID)
+			return ErrLockTimeout
+		}
+	}
+}
+
+func (tm *TransactionManager) detectDeadlocks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tm.mu.Lock()
+		for {
+			cycle := tm.findCycle()
+			if cycle == nil {
+				break
+			}
+			// Жертвой становится самая молодая транзакция цикла
+			victim := cycle[0]
+			for _, id := range cycle {
+				if id > victim {
+					victim = id
+				}
+			}
+			tx := tm.active[victim]
+			tx.abortErr = ErrDeadlock
+			close(tx.abort)
+			delete(tm.waiting, victim)
+			fmt.Println("Обнаружена взаимоблокировка, транзакция", victim, "прервана.")
+		}
+		tm.mu.Unlock()
+	}
+}
+
+// rollbackIdle периодически откатывает транзакции, простаивающие дольше
+// IdleTimeout. Транзакция, которая сейчас выполняет запрос (держит opMu),
+// не простаивает и пропускается.
+func (tm *TransactionManager) rollbackIdle(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tm.mu.Lock()
+		candidates := make([]*Transaction, 0, len(tm.active))
+		for _, tx := range tm.active {
+			candidates = append(candidates, tx)
+		}
+		tm.mu.Unlock()
+		for _, tx := range candidates {
+			if !tx.opMu.TryLock() {
+				continue
+			}
+			if !tx.done && tx.IdleTimeout > 0 && time.Since(tx.lastUsed) > tx.IdleTimeout {
+				fmt.Println("Транзакция", tx.ID, "простаивала дольше", tx.IdleTimeout, "и будет откачена.")
+				tx.rollback()
+			}
+			tx.opMu.Unlock()
+		}
+	}
+}
+
+// findCycle ищет цикл в графе ожиданий: ребро ведет от ждущей транзакции к
+// каждому держателю несовместимой блокировки. Вызывается под tm.mu.
+func (tm *TransactionManager) findCycle() []uint64 {
+	const (
+		white = 0
+		grey  = 1
+		black = 2
+	)
+	color := make(map[uint64]int)
+	var stack []uint64
+	var cycle []uint64
+
+	var visit func(id uint64) bool
+	visit = func(id uint64) bool {
+		color[id] = grey
+		stack = append(stack, id)
+		if wait, ok := tm.waiting[id]; ok {
+			if l, ok := tm.locks[wait.collection]; ok {
+				for _, holder := range l.conflicts(id, wait.mode) {
+					if color[holder] == grey {
+						for i := len(stack) - 1; i >= 0; i-- {
+							cycle = append(cycle, stack[i])
+							if stack[i] == holder {
+								break
+							}
+						}
+						return true
+					}
+					if color[holder] == white && visit(holder) {
+						return true
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[id] = black
+		return false
+	}
+
+	for id := range tm.waiting {
+		if color[id] == white && visit(id) {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// tryAcquire берет блокировку коллекции без ожидания и сообщает, удалось ли.
+func (tm *TransactionManager) tryAcquire(tx *Transaction, tc *TreeCollection, mode LockMode) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	l, ok := tm.locks[tc]
+	if !ok {
+		l = &collectionLock{holders: make(map[uint64]LockMode), released: make(chan struct{})}
+		tm.locks[tc] = l
+	} else if len(l.conflicts(tx.ID, mode)) > 0 {
+		return false
+	}
+	if held, ok := l.holders[tx.ID]; !ok || held < mode {
+		l.holders[tx.ID] = mode
+		tx.locks[tc] = mode
+	}
+	return true
+}
+
+// TryLock берет транзакционную блокировку коллекции, только если ее не
+// держат другие транзакции. Вызывается под tx.opMu.
+func (tx *Transaction) TryLock(tc *TreeCollection, mode LockMode) bool {
+	return !tx.done && tx.tm.tryAcquire(tx, tc, mode)
+}
+
+// Lock берет транзакционную блокировку коллекции. Если транзакция выбрана
+// жертвой взаимоблокировки, она сразу откатывается. Вызывается под tx.opMu.
+func (tx *Transaction) Lock(tc *TreeCollection, mode LockMode) error {
+	if tx.done {
+		return ErrTxNotFound
+	}
+	err := tx.tm.acquire(tx, tc, mode)
+	if errors.Is(err, ErrDeadlock) {
+		tx.rollback()
+	}
+	return err
+}
+
+func (tx *Transaction) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	tx.onCommit = nil
+	tx.tm.finish(tx)
+	fmt.Println("Транзакция", tx.ID, "откачена.")
+}
+
+// OnCommit откладывает fn до фиксации транзакции; при откате fn не
+// вызывается. Вызывается под tx.opMu.
+func (tx *Transaction) OnCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+func (tx *Transaction) committed() {
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+	tx.onCommit = nil
+}
+
+// Do выполняет fn под tx.opMu, чтобы запросы одной транзакции из разных
+// соединений не выполнялись одновременно.
+func (tx *Transaction) Do(fn func() error) error {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+	if tx.done {
+		return ErrTxNotFound
+	}
+	defer func() { tx.lastUsed = time.Now() }()
+	return fn()
+}
+
+// SetIdleTimeout задает время простоя, после которого транзакция
+// откатывается.
+func (tx *Transaction) SetIdleTimeout(d time.Duration) {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+	tx.IdleTimeout = d
+}
+
+// Active сообщает, что транзакция не зафиксирована и не откачена.
+func (tx *Transaction) Active() bool {
+	tx.opMu.Lock()
+	defer tx.opMu.Unlock()
+	return !tx.done
+}
+
+func (tx *Transaction) Insert(tc *TreeCollection, key string, value interface{}) error {
+	return tx.InsertWithExpiry(tc, key, value, time.Time{})
+}
+
+// InsertWithExpiry вставляет ключ со сроком жизни; нулевое время - бессрочно.
+func (tx *Transaction) InsertWithExpiry(tc *TreeCollection, key string, value interface{}, expiresAt time.Time) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	if err := tc.InsertWithExpiry(key, value, expiresAt); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() { tc.Remove(key) })
+	return nil
+}
+
+func (tx *Transaction) Update(tc *TreeCollection, key string, value interface{}) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	old, err := tc.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := tc.Update(key, value); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() { tc.Update(key, old) })
+	return nil
+}
+
+// UpdateWithExpiry обновляет значение и срок жизни ключа; при откате
+// восстанавливаются прежние значение и срок.
+func (tx *Transaction) UpdateWithExpiry(tc *TreeCollection, key string, value interface{}, expiresAt time.Time) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	old, err := tc.Get(key)
+	if err != nil {
+		return err
+	}
+	oldExpiry, err := tc.Expiry(key)
+	if err != nil {
+		return err
+	}
+	if err := tc.UpdateWithExpiry(key, value, expiresAt); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() { tc.UpdateWithExpiry(key, old, oldExpiry) })
+	return nil
+}
+
+func (tx *Transaction) Remove(tc *TreeCollection, key string) error {
+	if err := tx.Lock(tc, ExclusiveLock); err != nil {
+		return err
+	}
+	old, err := tc.Get(key)
+	if err != nil {
+		return err
+	}
+	oldExpiry, err := tc.Expiry(key)
+	if err != nil {
+		return err
+	}
+	if err := tc.Remove(key); err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, func() { tc.InsertWithExpiry(key, old, oldExpiry) })
+	return nil
+}
+
+func (tx *Transaction) Get(tc *TreeCollection, key string) (interface{}, error) {
+	if err := tx.Lock(tc, SharedLock); err != nil {
+		return nil, err
+	}
+	return tc.Get(key)
+}
+
+// GetCollection находит коллекцию по пути, удерживая намеренные блокировки
+// только на время поиска.
+func (ap *AllPools) GetCollection(poolName, schemaName, collectionName string) (*TreeCollection, error) {
+	var result *TreeCollection
+	err := ap.WithCollection(poolName, schemaName, collectionName, func(tc *TreeCollection) error {
+		result = tc
+		return nil
+	})
+	return result, err
+}
+
+func (ap *AllPools) Transactions() *TransactionManager {
+	return ap.txm
+}
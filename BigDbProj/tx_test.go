@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// Транзакции берут коллекции в разном порядке; одна из них выбирается
+// жертвой взаимоблокировки и откатывается, другая завершается.
+func TestDeadlockAbortsOneTransaction(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s a avl",
+		"add-collection p s b avl",
+	)
+	first := pools.Transactions().Begin()
+	second := pools.Transactions().Begin()
+	insert := func(tx *Transaction, collection, key string) error {
+		return runCommand(pools, []string{"insert-data", "p", "s", collection, key, "v"}, cr, commandSession{tx: tx})
+	}
+	if err := insert(first, "a", "k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(second, "b", "k2"); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 2)
+	go func() { results <- insert(first, "b", "k3") }()
+	go func() { results <- insert(second, "a", "k4") }()
+	var deadlocks int
+	for i := 0; i < 2; i++ {
+		err := <-results
+		switch {
+		case errors.Is(err, ErrDeadlock):
+			deadlocks++
+		case err != nil:
+			t.Errorf("неожиданная ошибка: %v", err)
+		}
+	}
+	if deadlocks != 1 {
+		t.Fatalf("прервано %d транзакций, ожидалась одна", deadlocks)
+	}
+	// жертва - более молодая транзакция, ее изменения откачены
+	if second.Active() {
+		t.Error("жертва взаимоблокировки осталась активной")
+	}
+	if err := pools.Transactions().Commit(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	b, err := pools.GetCollection("p", "s", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get("k2"); err == nil {
+		t.Error("изменение откаченной транзакции осталось в коллекции")
+	}
+	if _, err := b.Get("k3"); err != nil {
+		t.Errorf("изменение зафиксированной транзакции потеряно: %v", err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+	)
+	tx := pools.Transactions().Begin()
+	if err := runCommand(pools, []string{"insert-data", "p", "s", "c", "k", "v"}, cr, commandSession{tx: tx}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err := runCommand(pools, []string{"insert-data", "p", "s", "c", "other", "v"}, cr, commandSession{lockTimeout: 50 * time.Millisecond})
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("запись под чужой исключительной блокировкой: %v, ожидалось ErrLockTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("таймаут блокировки сработал через %v", elapsed)
+	}
+	if err := pools.Transactions().Rollback(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Изменение схемы коллекции ждет завершения транзакции, которая ее держит.
+func TestDDLWaitsForTransaction(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c btree",
+	)
+	tx := pools.Transactions().Begin()
+	if err := runCommand(pools, []string{"insert-data", "p", "s", "c", "k", "v"}, cr, commandSession{tx: tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- RunCommand(pools, "remove-collection p s c", cr)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("remove-collection выполнен до фиксации транзакции: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := pools.Transactions().Commit(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pools.GetCollection("p", "s", "c"); err == nil {
+		t.Error("коллекция не удалена")
+	}
+}
+
+// Транзакция, клиент которой пропал, откатывается по времени простоя и
+// освобождает блокировки.
+func TestIdleTransactionRolledBack(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+	)
+	tx := pools.Transactions().Begin()
+	tx.SetIdleTimeout(100 * time.Millisecond)
+	if err := runCommand(pools, []string{"insert-data", "p", "s", "c", "k", "v"}, cr, commandSession{tx: tx}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tx.Active() {
+		if time.Now().After(deadline) {
+			t.Fatal("простаивающая транзакция не откачена")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tc.Get("k"); err == nil {
+		t.Error("изменение откаченной транзакции осталось в коллекции")
+	}
+	if err := RunCommand(pools, "insert-data p s c k v", cr); err != nil {
+		t.Errorf("коллекция осталась заблокированной: %v", err)
+	}
+}
+
+// Фоновая очистка не удаляет истекшие ключи коллекции, которую держит
+// транзакция, и удаляет их после ее завершения.
+func TestSweepSkipsLockedCollection(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+		"insert-data p s c k v --ttl 100ms",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ключ читается мимо срока жизни, под блокировкой от фоновой очистки
+	stored := func() bool {
+		tc.mu.RLock()
+		defer tc.mu.RUnlock()
+		_, err := tc.Tree.Get("k")
+		return err == nil
+	}
+	tx := pools.Transactions().Begin()
+	if err := runCommand(pools, []string{"update-data", "p", "s", "c", "k", "w"}, cr, commandSession{tx: tx}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	pools.sweepCollection(tc)
+	if !stored() {
+		t.Error("истекший ключ удален из коллекции, которую держит транзакция")
+	}
+	if err := pools.Transactions().Commit(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+	pools.sweepCollection(tc)
+	if stored() {
+		t.Error("истекший ключ не удален после завершения транзакции")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	FieldInt       = "int"
+	FieldFloat     = "float"
+	FieldString    = "string"
+	FieldBool      = "bool"
+	FieldTimestamp = "timestamp"
+	FieldObject    = "object"
+	FieldArray     = "array"
+)
+
+var ErrSchemaViolation = errors.New("Значение не соответствует схеме коллекции")
+
+// FieldSpec описывает одно поле значения. Для object вложенные поля задаются
+// в Fields, для array тип элементов - в Items.
+type FieldSpec struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Required bool        `json:"required,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+	Fields   []FieldSpec `json:"fields,omitempty"`
+	Items    *FieldSpec  `json:"items,omitempty"`
+}
+
+// ValueSchema - объявленная структура значений коллекции. Значения
+// проверяются при каждой вставке и обновлении и хранятся в типизированном
+// виде: int64, float64, string, bool, time.Time, map и срезы.
+type ValueSchema struct {
+	Version int         `json:"version"`
+	Fields  []FieldSpec `json:"fields"`
+}
+
+func ParseValueSchema(data string) (*ValueSchema, error) {
+	var schema ValueSchema
+	if err := json.Unmarshal([]byte(data), &schema); err != nil {
+		return nil, fmt.Errorf("некорректное описание схемы: %v", err)
+	}
+	if err := checkFieldSpecs(schema.Fields); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func checkFieldSpecs(fields []FieldSpec) error {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		if field.Name == "" {
+			return errors.New("у поля схемы не указано имя")
+		}
+		if seen[field.Name] {
+			return fmt.Errorf("поле %s объявлено дважды", field.Name)
+		}
+		seen[field.Name] = true
+		if err := checkFieldSpec(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkFieldSpec(field FieldSpec) error {
+	switch field.Type {
+	case FieldInt, FieldFloat, FieldString, FieldBool, FieldTimestamp:
+	case FieldObject:
+		return checkFieldSpecs(field.Fields)
+	case FieldArray:
+		if field.Items != nil {
+			return checkFieldSpec(*field.Items)
+		}
+	default:
+		return fmt.Errorf("неизвестный тип %q поля %s", field.Type, field.Name)
+	}
+	if field.Default != nil {
+		if _, err := coerceField(field, field.Default, field.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Coerce проверяет значение по схеме и приводит его к типизированному виду.
+// Строка разбирается как JSON-объект.
+func (vs *ValueSchema) Coerce(value interface{}) (interface{}, error) {
+	if s, ok := value.(string); ok {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+		decoder.UseNumber()
+		var parsed interface{}
+		if err := decoder.Decode(&parsed); err != nil {
+			return nil, fmt.Errorf("%w: значение не является JSON-объектом", ErrSchemaViolation)
+		}
+		value = parsed
+	}
+	return coerceObject(vs.Fields, value, "")
+}
+
+func coerceObject(fields []FieldSpec, value interface{}, path string) (interface{}, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %sожидается объект", ErrSchemaViolation, pathPrefix(path))
+	}
+	result := make(map[string]interface{}, len(fields))
+	declared := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		declared[field.Name] = true
+		fieldPath := field.Name
+		if path != "" {
+			fieldPath = path + "." + field.Name
+		}
+		raw, exists := object[field.Name]
+		if !exists || raw == nil {
+			switch {
+			case field.Default != nil:
+				raw = field.Default
+			case field.Required:
+				return nil, fmt.Errorf("%w: отсутствует обязательное поле %s", ErrSchemaViolation, fieldPath)
+			default:
+				continue
+			}
+		}
+		typed, err := coerceField(field, raw, fieldPath)
+		if err != nil {
+			return nil, err
+		}
+		result[field.Name] = typed
+	}
+	for name := range object {
+		if !declared[name] {
+			return nil, fmt.Errorf("%w: поле %s не объявлено в схеме", ErrSchemaViolation, strings.TrimPrefix(path+"."+name, "."))
+		}
+	}
+	return result, nil
+}
+
+func coerceField(field FieldSpec, value interface{}, path string) (interface{}, error) {
+	mismatch := func() error {
+		return fmt.Errorf("%w: поле %s должно иметь тип %s, получено %v", ErrSchemaViolation, path, field.Type, value)
+	}
+	switch field.Type {
+	case FieldInt:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case int:
+			return int64(v), nil
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				return i, nil
+			}
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+				return int64(v), nil
+			}
+		}
+		return nil, mismatch()
+	case FieldFloat:
+		switch v := value.(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		case int:
+			return float64(v), nil
+		case json.Number:
+			if f, err := v.Float64(); err == nil {
+				return f, nil
+			}
+		}
+		return nil, mismatch()
+	case FieldString:
+		if v, ok := value.(string); ok {
+			return v, nil
+		}
+		return nil, mismatch()
+	case FieldBool:
+		if v, ok := value.(bool); ok {
+			return v, nil
+		}
+		return nil, mismatch()
+	case FieldTimestamp:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t, nil
+			}
+		}
+		return nil, mismatch()
+	case FieldObject:
+		if len(field.Fields) == 0 {
+			if v, ok := value.(map[string]interface{}); ok {
+				return v, nil
+			}
+			return nil, mismatch()
+		}
+		return coerceObject(field.Fields, value, path)
+	case FieldArray:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, mismatch()
+		}
+		if field.Items == nil {
+			return items, nil
+		}
+		result := make([]interface{}, len(items))
+		for i, item := range items {
+			typed, err := coerceField(*field.Items, item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			result[i] = typed
+		}
+		return result, nil
+	}
+	return nil, mismatch()
+}
+
+func pathPrefix(path string) string {
+	if path == "" {
+		return ""
+	}
+	return path + ": "
+}
+
+// coerce приводит значение к схеме коллекции, если она объявлена.
+// Вызывается под блокировкой коллекции.
+func (tc *TreeCollection) coerce(value interface{}) (interface{}, error) {
+	if tc.valueSchema == nil {
+		return tc.mapElements(value, func(item interface{}) (interface{}, error) { return item, nil })
+	}
+	return tc.mapElements(value, tc.valueSchema.Coerce)
+}
+
+// SetValueSchema объявляет новую версию схемы значений коллекции. Все уже
+// хранящиеся значения проверяются и переводятся в типизированный вид; если
+// хоть одно не подходит по схеме, бюджету памяти или ограничениям
+// уникальности, коллекция не меняется.
+func (tc *TreeCollection) SetValueSchema(schema *ValueSchema) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.purgeDue(time.Now())
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return err
+	}
+	typed := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		value, err := tc.get(key)
+		if err != nil {
+			return err
+		}
+		if typed[key], err = tc.mapElements(value, schema.Coerce); err != nil {
+			return fmt.Errorf("ключ %s: %w", key, err)
+		}
+		if err := tc.checkBudget(key, typed[key]); err != nil {
+			return fmt.Errorf("ключ %s: %w", key, err)
+		}
+	}
+	indexes, err := tc.emptyIndexes()
+	if err != nil {
+		return err
+	}
+	if err := tc.checkUniqueValues(indexes, typed); err != nil {
+		return err
+	}
+	for key, value := range typed {
+		if err := tc.addToIndexes(indexes, key, value); err != nil {
+			return err
+		}
+	}
+
+	schema.Version = 1
+	if tc.valueSchema != nil {
+		schema.Version = tc.valueSchema.Version + 1
+	}
+	tc.valueSchema = schema
+	tc.schemaHistory[schema.Version] = schema.Fields
+	tc.indexes = indexes
+	for key, value := range typed {
+		if err := tc.rewrite(key, value); err != nil {
+			return err
+		}
+	}
+	// вытеснение идет после перезаписи, чтобы не удалить еще не
+	// переписанные ключи
+	for key, value := range typed {
+		if _, ok := tc.Tree.versionTable().Version(key); ok {
+			tc.cacheAdd(key, value)
+		}
+	}
+	return nil
+}
+
+// rewrite заменяет значение ключа в дереве значением текущей версии схемы,
+// уже проверенным вызывающим. Индексы не меняются.
+func (tc *TreeCollection) rewrite(key string, value interface{}) error {
+	raw, err := tc.Tree.Get(key)
+	if err != nil {
+		return err
+	}
+	sp := GetStringPools()
+	interned := sp.internValue(value)
+	if err := tc.Tree.Update(key, interned); err != nil {
+		sp.releaseValue(interned)
+		return err
+	}
+	sp.releaseValue(raw)
+	tc.trackWrite(key)
+	tc.stampSchemaVersion(key)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrKeyNotFound     = errors.New("Элемент не найден!")
+	ErrVersionMismatch = errors.New("Версия элемента не совпадает с ожидаемой!")
+)
+
+// keyVersions - версии ключей движка. Версии берутся из общего для движка
+// счетчика clock, поэтому удаленный и заново вставленный ключ никогда не
+// получит прежнюю версию. Движки встраивают keyVersions и вызывают bump при
+// каждой записи ключа и forget при его удалении.
+type keyVersions struct {
+	versions map[string]uint64
+	clock    uint64
+}
+
+func (kv *keyVersions) bump(key string) uint64 {
+	if kv.versions == nil {
+		kv.versions = make(map[string]uint64)
+	}
+	kv.clock++
+	kv.versions[key] = kv.clock
+	return kv.clock
+}
+
+func (kv *keyVersions) forget(key string) {
+	delete(kv.versions, key)
+}
+
+// reset выдает новые версии ключам keys, заменившим все содержимое движка.
+func (kv *keyVersions) reset(keys []string) {
+	kv.versions = make(map[string]uint64, len(keys))
+	for _, key := range keys {
+		kv.bump(key)
+	}
+}
+
+func (kv *keyVersions) clone() keyVersions {
+	versions := make(map[string]uint64, len(kv.versions))
+	for key, version := range kv.versions {
+		versions[key] = version
+	}
+	return keyVersions{versions: versions, clock: kv.clock}
+}
+
+// Version возвращает версию ключа движка.
+func (kv *keyVersions) Version(key string) (uint64, bool) {
+	version, ok := kv.versions[key]
+	return version, ok
+}
+
+func (kv *keyVersions) versionTable() *keyVersions {
+	return kv
+}
+
+// getVersioned и compareAndSet реализуют GetVersioned и CompareAndSet движка
+// через его Get, Insert и Update.
+func getVersioned(t Tree, key string) (interface{}, uint64, error) {
+	version, ok := t.versionTable().Version(key)
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	value, err := t.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, version, nil
+}
+
+func compareAndSet(t Tree, key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	if version, _ := t.versionTable().Version(key); version != expectedVersion {
+		return 0, ErrVersionMismatch
+	}
+	var err error
+	if expectedVersion == 0 {
+		err = t.Insert(key, value)
+	} else {
+		err = t.Update(key, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, _ := t.versionTable().Version(key)
+	return version, nil
+}
+
+// version возвращает версию ключа; ключ с истекшим сроком жизни считается
+// отсутствующим. Вызывается под блокировкой коллекции.
+func (tc *TreeCollection) version(key string) (uint64, bool) {
+	if tc.expired(key) {
+		return 0, false
+	}
+	return tc.Tree.versionTable().Version(key)
+}
+
+// GetVersioned возвращает значение ключа вместе с его текущей версией.
+func (tc *TreeCollection) GetVersioned(key string) (interface{}, uint64, error) {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	version, ok := tc.version(key)
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	value, err := tc.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, version, nil
+}
+
+// CompareAndSet записывает value, только если текущая версия ключа равна
+// expectedVersion. Нулевая ожидаемая версия означает, что ключа еще нет,
+// и тогда выполняется вставка. Возвращает новую версию ключа.
+func (tc *TreeCollection) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if version, _ := tc.version(key); version != expectedVersion {
+		return 0, ErrVersionMismatch
+	}
+	var err error
+	if expectedVersion == 0 {
+		err = tc.insert(key, value)
+	} else {
+		err = tc.update(key, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, _ := tc.Tree.versionTable().Version(key)
+	return version, nil
+}
+
+// Put вставляет или обновляет ключ без проверки версии и возвращает новую.
+func (tc *TreeCollection) Put(key string, value interface{}) (uint64, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	var err error
+	if _, ok := tc.version(key); ok {
+		err = tc.update(key, value)
+	} else {
+		err = tc.insert(key, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, _ := tc.Tree.versionTable().Version(key)
+	return version, nil
+}
+
+// CompareAndRemove удаляет ключ, только если его версия равна expectedVersion.
+func (tc *TreeCollection) CompareAndRemove(key string, expectedVersion uint64) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	version, ok := tc.version(key)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if version != expectedVersion {
+		return ErrVersionMismatch
+	}
+	return tc.remove(key)
+}
+
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// parseETag разбирает значение заголовка If-Match вида "12" или W/"12".
+func parseETag(header string) (uint64, error) {
+	tag := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	tag = strings.Trim(tag, `"`)
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("некорректный ETag: %s", header)
+	}
+	return version, nil
+}
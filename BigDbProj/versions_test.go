@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEngineCompareAndSet(t *testing.T) {
+	for _, engine := range []string{"avl", "redblack", "btree", "map"} {
+		t.Run(engine, func(t *testing.T) {
+			tree, err := newEngine(engine, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v1, err := tree.CompareAndSet("k", 0, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tree.CompareAndSet("k", 0, "b"); !errors.Is(err, ErrVersionMismatch) {
+				t.Fatalf("повторная вставка: %v, ожидалось ErrVersionMismatch", err)
+			}
+			v2, err := tree.CompareAndSet("k", v1, "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v2 <= v1 {
+				t.Errorf("версия после записи %d не больше прежней %d", v2, v1)
+			}
+			if _, err := tree.CompareAndSet("k", v1, "c"); !errors.Is(err, ErrVersionMismatch) {
+				t.Fatalf("запись по устаревшей версии: %v, ожидалось ErrVersionMismatch", err)
+			}
+			value, version, err := tree.GetVersioned("k")
+			if err != nil || value != "b" || version != v2 {
+				t.Errorf("GetVersioned = %v, %d, %v; ожидалось b, %d", value, version, err, v2)
+			}
+
+			// удаленный и заново вставленный ключ не получает прежнюю версию
+			if err := tree.Remove("k"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := tree.GetVersioned("k"); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("GetVersioned удаленного ключа: %v", err)
+			}
+			v3, err := tree.CompareAndSet("k", 0, "c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v3 <= v2 {
+				t.Errorf("версия заново вставленного ключа %d не больше %d", v3, v2)
+			}
+		})
+	}
+}
+
+func TestVersionsSurviveConvertAndSnapshot(t *testing.T) {
+	pools, cr := newTestPools(t,
+		"add-pool p",
+		"add-schema p s",
+		"add-collection p s c avl",
+		"insert-data p s c a 1",
+		"insert-data p s c b 2",
+		"update-data p s c a 3",
+	)
+	tc, err := pools.GetCollection("p", "s", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, before, err := tc.GetVersioned("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunCommand(pools, "convert-collection p s c btree", cr); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ := tc.ConversionStatus()
+		if status.Done {
+			if status.Error != "" {
+				t.Fatal(status.Error)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("перевод коллекции не завершился")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, after, _ := tc.GetVersioned("a"); after != before {
+		t.Errorf("версия после перевода %d, до перевода %d", after, before)
+	}
+
+	state := filepath.Join(t.TempDir(), "state.json")
+	if err := RunCommand(pools, "save-state "+state, cr); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunCommand(pools, "load-state "+state, cr); err != nil {
+		t.Fatal(err)
+	}
+	if tc, err = pools.GetCollection("p", "s", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, after, _ := tc.GetVersioned("a"); after != before {
+		t.Errorf("версия после загрузки %d, до сохранения %d", after, before)
+	}
+	// новая запись получает версию больше любой выданной до сохранения
+	version, err := tc.Put("b", "4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version <= before {
+		t.Errorf("версия после загрузки %d не больше %d", version, before)
+	}
+}
@@ -6,36 +6,13 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-type StringPools struct {
-	Pools map[string]string
-	mu    sync.Mutex
-}
-
-var instance *StringPools
-var once sync.Once
-
-func GetStringPools() *StringPools {
-	once.Do(func() {
-		instance = &StringPools{
-			Pools: make(map[string]string),
-		}
-	})
-	return instance
-}
-
-func (sp *StringPools) Get(str string) string {
-	sp.mu.Lock()
-	defer sp.mu.Unlock()
-
-	if s, exists := sp.Pools[str]; exists {
-		return s
-	}
-	sp.Pools[str] = str
-	return str
-}
-
+// Tree - движок хранения коллекции. Каждый движок ведет версии своих
+// ключей (см. keyVersions): Insert и Update выдают ключу новую версию,
+// Remove ее удаляет.
 type Tree interface {
 	Insert(key string, value interface{}) error
 	Get(key string) (interface{}, error)
@@ -43,55 +20,324 @@ type Tree interface {
 	Update(key string, value interface{}) error
 	Remove(key string) error
 	SaveToFile(filename string) error
-}
 
-type TreeCollection struct {
-	Tree Tree
+	// пакетная запись: пакет применяется целиком или не применяется вовсе
+	InsertMany(entries []KeyValue) error
+	UpdateMany(entries []KeyValue) error
+	RemoveMany(keys []string) error
+	Apply(batch Batch) error
+
+	// GetVersioned возвращает значение ключа вместе с его версией.
+	GetVersioned(key string) (interface{}, uint64, error)
+	// CompareAndSet записывает value, только если версия ключа равна
+	// expectedVersion; нулевая версия означает, что ключа еще нет.
+	// Возвращает новую версию ключа.
+	CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error)
+	versionTable() *keyVersions
 }
 
-func NewTreeCollection(treeType string) *TreeCollection {
-	var tree Tree
-	switch treeType {
-	case "avl":
-		tree = Tree(NewAVLTree())
-	case "redblack":
-		tree = Tree(NewRedBlackTree())
-	case "btree":
-		tree = Tree(NewBTree())
-	case "map":
-		tree = NewMapCollection()
-	default:
-		tree = NewMapCollection()
+type TreeCollection struct {
+	Tree          Tree
+	engine        string
+	engineOptions map[string]string
+	// collation - правила сравнения ключей; nil - побайтово
+	collation *Collation
+	// keySchema - схема составных ключей; nil - ключи произвольные строки
+	keySchema *KeySchema
+	// multimap - под каждым ключом хранится список значений
+	multimap bool
+	mu       sync.RWMutex
+
+	indexes map[string]*SecondaryIndex
+
+	// valueSchema - текущая версия схемы значений, schemaVersions - версия
+	// схемы, по которой записано значение каждого ключа
+	valueSchema    *ValueSchema
+	schemaVersions map[string]int
+	schemaHistory  map[int][]FieldSpec
+	migrations     map[int]SchemaMigration
+
+	// expires - момент истечения срока жизни ключей с TTL, expiryQueue -
+	// очередь этих сроков для фоновой очистки
+	expires     map[string]time.Time
+	expiryQueue expiryQueue
+
+	// cache - учет памяти и вытеснение в режиме кэша; nil, если режим выключен
+	cache *collectionCache
+	// conversion - последний перевод коллекции на другой движок
+	conversion *conversion
+	// queue - выдача элементов очереди или стека; nil до первого обращения
+	queue *queueState
+}
+
+// NewTreeCollection создает коллекцию на зарегистрированном движке engine.
+// Среди options можно задать collation=имя - правила сравнения ключей и
+// multimap=true - режим мультиотображения.
+func NewTreeCollection(engine string, options map[string]string) (*TreeCollection, error) {
+	options, collation, err := splitCollation(options)
+	if err != nil {
+		return nil, err
+	}
+	options, multimap, err := splitMultimap(options)
+	if err != nil {
+		return nil, err
+	}
+	if multimap && (engine == queueEngine || engine == stackEngine) {
+		return nil, errors.New("очередь и стек не могут быть мультиотображением")
+	}
+	tree, err := newEngine(engine, options, collation)
+	if err != nil {
+		return nil, err
 	}
-	return &TreeCollection{Tree: tree}
+	return &TreeCollection{
+		Tree:          tree,
+		engine:        engine,
+		engineOptions: options,
+		collation:     collation,
+		multimap:      multimap,
+		indexes:       make(map[string]*SecondaryIndex),
+
+		schemaVersions: make(map[string]int),
+		schemaHistory:  make(map[int][]FieldSpec),
+		migrations:     make(map[int]SchemaMigration),
+		expires:        make(map[string]time.Time),
+	}, nil
 }
 
 func (tc *TreeCollection) Insert(key string, value interface{}) error {
-	return tc.Tree.Insert(key, value)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.insert(key, value)
 }
 
+// Get и GetRange не видят ключей с истекшим сроком жизни; встретив такой
+// ключ, они сразу удаляют истекшие ключи, не дожидаясь фоновой очистки.
 func (tc *TreeCollection) Get(key string) (interface{}, error) {
-	return tc.Tree.Get(key)
+	tc.mu.RLock()
+	value, err := tc.get(key)
+	expired := tc.expired(key)
+	if tc.cache != nil {
+		tc.cache.lookup(key, err == nil)
+	}
+	tc.mu.RUnlock()
+	if expired {
+		tc.PurgeExpired()
+	}
+	return value, err
 }
 
 func (tc *TreeCollection) GetRange(minValue, maxValue string) ([]string, error) {
-	return tc.Tree.GetRange(minValue, maxValue)
+	tc.mu.RLock()
+	keys, err := tc.Tree.GetRange(minValue, maxValue)
+	live := keys[:0:0]
+	for _, key := range keys {
+		if !tc.expired(key) {
+			live = append(live, key)
+		}
+	}
+	tc.mu.RUnlock()
+	if len(live) < len(keys) {
+		tc.PurgeExpired()
+	}
+	return live, err
 }
 
 func (tc *TreeCollection) Update(key string, value interface{}) error {
-	return tc.Tree.Update(key, value)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.update(key, value)
 }
 
 func (tc *TreeCollection) Remove(key string) error {
-	return tc.Tree.Remove(key)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.remove(key)
+}
+
+// get читает значение ключа в текущей версии схемы значений.
+func (tc *TreeCollection) get(key string) (interface{}, error) {
+	if tc.expired(key) {
+		return nil, ErrKeyNotFound
+	}
+	return tc.stored(key)
+}
+
+// stored читает значение ключа без учета срока жизни.
+func (tc *TreeCollection) stored(key string) (interface{}, error) {
+	value, err := tc.Tree.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return tc.upgrade(key, value), nil
+}
+
+// insert, update и remove - единственные места, где меняется дерево
+// коллекции: здесь же значения приводятся к схеме, проверяются ограничения
+// уникальности и поддерживаются вторичные индексы и учет памяти
+// режима кэша.
+// Вызываются под исключительной блокировкой коллекции.
+func (tc *TreeCollection) insert(key string, value interface{}) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	value, err := tc.coerce(value)
+	if err != nil {
+		return err
+	}
+	if err := tc.checkBudget(key, value); err != nil {
+		return err
+	}
+	if tc.expired(key) {
+		if err := tc.drop(key); err != nil {
+			return err
+		}
+	}
+	if err := tc.checkUnique(key, value); err != nil {
+		return err
+	}
+	sp := GetStringPools()
+	key, value = sp.Acquire(key), sp.internValue(value)
+	if err := tc.Tree.Insert(key, value); err != nil {
+		sp.Release(key)
+		sp.releaseValue(value)
+		return err
+	}
+	if err := tc.indexAdd(key, value); err != nil {
+		tc.indexRemove(key, value)
+		tc.Tree.Remove(key)
+		sp.Release(key)
+		sp.releaseValue(value)
+		return err
+	}
+	tc.trackWrite(key)
+	tc.stampSchemaVersion(key)
+	tc.cacheAdd(key, value)
+	return nil
+}
+
+func (tc *TreeCollection) update(key string, value interface{}) error {
+	value, err := tc.coerce(value)
+	if err != nil {
+		return err
+	}
+	if err := tc.checkBudget(key, value); err != nil {
+		return err
+	}
+	old, err := tc.get(key)
+	if err != nil {
+		return err
+	}
+	if err := tc.checkUnique(key, value); err != nil {
+		return err
+	}
+	raw, err := tc.Tree.Get(key)
+	if err != nil {
+		return err
+	}
+	sp := GetStringPools()
+	value = sp.internValue(value)
+	if err := tc.Tree.Update(key, value); err != nil {
+		sp.releaseValue(value)
+		return err
+	}
+	if err := tc.reindex(key, old, value); err != nil {
+		tc.Tree.Update(key, raw)
+		sp.releaseValue(value)
+		return err
+	}
+	sp.releaseValue(raw)
+	tc.trackWrite(key)
+	tc.stampSchemaVersion(key)
+	tc.cacheAdd(key, value)
+	return nil
+}
+
+func (tc *TreeCollection) remove(key string) error {
+	if _, ok := tc.version(key); !ok {
+		return ErrKeyNotFound
+	}
+	return tc.drop(key)
+}
+
+// drop физически удаляет ключ, в том числе с истекшим сроком жизни.
+func (tc *TreeCollection) drop(key string) error {
+	raw, err := tc.Tree.Get(key)
+	if err != nil {
+		return err
+	}
+	old := tc.upgrade(key, raw)
+	if err := tc.indexRemove(key, old); err != nil {
+		tc.indexAdd(key, old)
+		return err
+	}
+	if err := tc.Tree.Remove(key); err != nil {
+		tc.indexAdd(key, old)
+		return err
+	}
+	tc.forget(key, raw)
+	return nil
+}
+
+// forget освобождает строки и служебные данные ключа, уже удаленного из
+// дерева и индексов; raw - его значение в дереве.
+func (tc *TreeCollection) forget(key string, raw interface{}) {
+	sp := GetStringPools()
+	sp.Release(key)
+	sp.releaseValue(raw)
+	tc.trackWrite(key)
+	delete(tc.schemaVersions, key)
+	delete(tc.expires, key)
+	if tc.cache != nil {
+		tc.cache.remove(key)
+	}
+	if tc.queue != nil {
+		delete(tc.queue.inFlight, key)
+		delete(tc.queue.deliveries, key)
+	}
+}
+
+// releaseStrings освобождает в пуле строк ключи и значения удаляемой
+// коллекции.
+func (tc *TreeCollection) releaseStrings() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	keys, err := tc.Tree.GetRange("", maxKey)
+	if err != nil {
+		return
+	}
+	sp := GetStringPools()
+	for _, key := range keys {
+		if raw, err := tc.Tree.Get(key); err == nil {
+			sp.releaseValue(raw)
+		}
+		sp.Release(key)
+	}
 }
 
 func (tc *TreeCollection) SaveToFile(filename string) error {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
 	return tc.Tree.SaveToFile(filename)
 }
 
+// maxKey больше любого ключа в UTF-8: байт 0xff в UTF-8 не встречается.
+// Поэтому checkKey не пропускает в коллекции ключи, не являющиеся UTF-8,
+// и диапазон ("", maxKey) охватывает все ключи.
+const maxKey = "\xff"
+
+var ErrInvalidKey = errors.New("Ключ должен быть строкой в UTF-8!")
+
+func checkKey(key string) error {
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
+
 type MapCollection struct {
-	Data map[string]interface{}
+	Data      map[string]interface{}
+	collation *Collation
+	keyVersions
 }
 
 func NewMapCollection() *MapCollection {
@@ -101,21 +347,16 @@ func NewMapCollection() *MapCollection {
 }
 
 func (mc *MapCollection) Insert(key string, value interface{}) error {
-	sp := GetStringPools()
-	key = sp.Get(key)
-
 	if _, exists := mc.Data[key]; exists {
 		return errors.New("Элемент с таким ключом уже существует!")
 	}
 	mc.Data[key] = value
+	mc.bump(key)
 	fmt.Println("Элемент успешно добавлен с ключом", key)
 	return nil
 }
 
 func (mc *MapCollection) Get(key string) (interface{}, error) {
-	sp := GetStringPools()
-	key = sp.Get(key)
-
 	value, exists := mc.Data[key]
 	if !exists {
 		return nil, errors.New("Элемент не найден!")
@@ -124,13 +365,9 @@ func (mc *MapCollection) Get(key string) (interface{}, error) {
 }
 
 func (mc *MapCollection) GetRange(minValue, maxValue string) ([]string, error) {
-	sp := GetStringPools()
-	minValue = sp.Get(minValue)
-	maxValue = sp.Get(maxValue)
-
 	var result []string
 	for key := range mc.Data {
-		if key >= minValue && key <= maxValue {
+		if mc.collation.inRange(key, minValue, maxValue) {
 			result = append(result, key)
 		}
 	}
@@ -138,28 +375,32 @@ func (mc *MapCollection) GetRange(minValue, maxValue string) ([]string, error) {
 }
 
 func (mc *MapCollection) Update(key string, value interface{}) error {
-	sp := GetStringPools()
-	key = sp.Get(key)
-
 	if _, exists := mc.Data[key]; !exists {
 		return errors.New("Элемент не найден!")
 	}
 	mc.Data[key] = value
+	mc.bump(key)
 	fmt.Println("Значение элемента с ключом", key, "успешно обновлено.")
 	return nil
 }
 
 func (mc *MapCollection) Remove(key string) error {
-	sp := GetStringPools()
-	key = sp.Get(key)
-
 	if _, exists := mc.Data[key]; !exists {
 		return errors.New("Элемент не найден!")
 	}
 	delete(mc.Data, key)
+	mc.forget(key)
 	return nil
 }
 
+func (mc *MapCollection) GetVersioned(key string) (interface{}, uint64, error) {
+	return getVersioned(mc, key)
+}
+
+func (mc *MapCollection) CompareAndSet(key string, expectedVersion uint64, value interface{}) (uint64, error) {
+	return compareAndSet(mc, key, expectedVersion, value)
+}
+
 func (mc *MapCollection) SaveToFile(filename string) error {
 	data, err := json.Marshal(mc.Data)
 	if err != nil {
@@ -176,43 +417,58 @@ func (mc *MapCollection) SaveToFile(filename string) error {
 	return err
 }
 
+// Блокировки образуют иерархию AllPools -> Pools -> Schema -> TreeCollection
+// и всегда берутся сверху вниз. DDL берет исключительную блокировку на
+// изменяемом уровне, а на предках - разделяемую (намеренную), поэтому
+// операции над разными коллекциями друг друга не ждут.
 type AllPools struct {
 	Pools map[string]*Pools
+	mu    sync.RWMutex
+	txm   *TransactionManager
 }
 
 func InitPools() *AllPools {
-	return &AllPools{
+	ap := &AllPools{
 		Pools: make(map[string]*Pools),
+		txm:   NewTransactionManager(),
 	}
+	go ap.sweepExpired(expirySweepInterval)
+	return ap
 }
 
 func (ap *AllPools) ShowAll() {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	ap.showAll()
+}
+
+func (ap *AllPools) showAll() {
 	fmt.Println("Текущие пулы и схемы:")
 	for poolName, pool := range ap.Pools {
 		fmt.Printf("Пул: %s\n", poolName)
-		for schemaName := range pool.schema {
+		for _, schemaName := range pool.SchemaNames() {
 			fmt.Printf("  Схема: %s\n", schemaName)
 		}
 	}
 }
 
 func (ap *AllPools) AddPools(name string) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
 	if _, exists := ap.Pools[name]; exists {
 		fmt.Println("Пул с именем", name, "уже существует.")
 	} else {
 		ap.Pools[name] = NewPools()
 		fmt.Println("Добавлен пул с именем", name)
 	}
-	ap.ShowAll()
+	ap.showAll()
 }
 
 func (ap *AllPools) RemovePools(name string) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
 	if pool, exists := ap.Pools[name]; exists {
-		for schemaName := range pool.schema {
-			schema := pool.schema[schemaName]
-			for collectionName := range schema.Collection {
-				schema.RemoveCollection(collectionName)
-			}
+		for _, schemaName := range pool.SchemaNames() {
 			pool.RemoveSchema(schemaName)
 		}
 		delete(ap.Pools, name)
@@ -220,10 +476,12 @@ func (ap *AllPools) RemovePools(name string) {
 	} else {
 		fmt.Println("Пул с именем", name, "не существует.")
 	}
-	ap.ShowAll()
+	ap.showAll()
 }
 
 func (ap *AllPools) GetPools(name string) (*Pools, error) {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
 	returnEl, ok := ap.Pools[name]
 	if !ok {
 		return nil, errors.New("Элемент не найден!")
@@ -231,7 +489,60 @@ func (ap *AllPools) GetPools(name string) (*Pools, error) {
 	return returnEl, nil
 }
 
+// PoolNames возвращает имена всех пулов.
+func (ap *AllPools) PoolNames() []string {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	names := make([]string, 0, len(ap.Pools))
+	for name := range ap.Pools {
+		names = append(names, name)
+	}
+	return names
+}
+
+// WithPool вызывает fn для пула name, удерживая намеренную блокировку на
+// AllPools: пул не может быть удален, пока fn выполняется.
+func (ap *AllPools) WithPool(name string, fn func(pool *Pools) error) error {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+	pool, ok := ap.Pools[name]
+	if !ok {
+		return errors.New("Элемент не найден!")
+	}
+	return fn(pool)
+}
+
+// WithSchema вызывает fn для схемы, удерживая намеренные блокировки на
+// AllPools и пуле.
+func (ap *AllPools) WithSchema(poolName, schemaName string, fn func(schema *Schema) error) error {
+	return ap.WithPool(poolName, func(pool *Pools) error {
+		pool.mu.RLock()
+		defer pool.mu.RUnlock()
+		schema, ok := pool.schema[schemaName]
+		if !ok {
+			return errors.New("Элемент не найден!")
+		}
+		return fn(schema)
+	})
+}
+
+// WithCollection вызывает fn для коллекции, удерживая намеренные блокировки
+// на всех ее предках. Блокировку самой коллекции берут методы TreeCollection.
+func (ap *AllPools) WithCollection(poolName, schemaName, collectionName string, fn func(tc *TreeCollection) error) error {
+	return ap.WithSchema(poolName, schemaName, func(schema *Schema) error {
+		schema.mu.RLock()
+		defer schema.mu.RUnlock()
+		tc, ok := schema.Collection[collectionName]
+		if !ok {
+			return errors.New("Элемент не найден!")
+		}
+		return fn(tc)
+	})
+}
+
 func (ap *AllPools) GetRange(minValue, maxValue string) ([]*Pools, error) {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
 	var result []*Pools
 	for name, pool := range ap.Pools {
 		if name >= minValue && name <= maxValue {
@@ -242,6 +553,8 @@ func (ap *AllPools) GetRange(minValue, maxValue string) ([]*Pools, error) {
 }
 
 func (ap *AllPools) SaveToFile(filename string) error {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
 	for _, pool := range ap.Pools {
 		if err := pool.SaveToFile(filename); err != nil {
 			return err
@@ -265,6 +578,7 @@ func (ap *AllPools) SaveToFile(filename string) error {
 
 type Pools struct {
 	schema map[string]*Schema
+	mu     sync.RWMutex
 }
 
 func NewPools() *Pools {
@@ -274,6 +588,8 @@ func NewPools() *Pools {
 }
 
 func (p *Pools) GetSchema(schemaName string) (*Schema, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	returnEl, ok := p.schema[schemaName]
 	if !ok {
 		return nil, errors.New("Элемент не найден!")
@@ -281,19 +597,38 @@ func (p *Pools) GetSchema(schemaName string) (*Schema, error) {
 	return returnEl, nil
 }
 
+// SchemaNames возвращает имена всех схем пула.
+func (p *Pools) SchemaNames() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	names := make([]string, 0, len(p.schema))
+	for name := range p.schema {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (p *Pools) String() string {
+	return fmt.Sprintf("схемы: %v", p.SchemaNames())
+}
+
 func (p *Pools) AddSchema(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if _, exists := p.schema[name]; exists {
 		fmt.Println("Схема с именем", name, "уже существует в пуле.")
 	} else {
 		p.schema[name] = InitSchema()
 		fmt.Println("Схема с именем", name, "добавлена в пул.")
 	}
-	p.ShowSchemas()
+	p.showSchemas()
 }
 
 func (p *Pools) RemoveSchema(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	if schema, exists := p.schema[name]; exists {
-		for collectionName := range schema.Collection {
+		for _, collectionName := range schema.CollectionNames() {
 			schema.RemoveCollection(collectionName)
 		}
 		// Удаляем схему из пула
@@ -302,17 +637,34 @@ func (p *Pools) RemoveSchema(name string) {
 	} else {
 		fmt.Println("Схема с именем", name, "не найдена в пуле.")
 	}
-	p.ShowSchemas()
+	p.showSchemas()
 }
 
 func (p *Pools) ShowSchemas() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	p.showSchemas()
+}
+
+func (p *Pools) showSchemas() {
 	fmt.Println("Текущие схемы в пуле:")
 	for schemaName := range p.schema {
 		fmt.Printf("  Схема: %s\n", schemaName)
 	}
 }
 
+// MarshalJSON сериализует схемы пула под разделяемой блокировкой.
+func (p *Pools) MarshalJSON() ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return json.Marshal(struct {
+		Schema map[string]*Schema `json:"schema"`
+	}{p.schema})
+}
+
 func (p *Pools) SaveToFile(filename string) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 	type tempStruct struct {
 		Schema map[string]*Schema `json:"schema"`
 	}
@@ -343,58 +695,101 @@ func (p *Pools) SaveToFile(filename string) error {
 }
 
 type Schema struct {
-	Collection map[string]TreeCollection
+	Collection map[string]*TreeCollection
+	mu         sync.RWMutex
 }
 
 func InitSchema() *Schema {
 	return &Schema{
-		Collection: make(map[string]TreeCollection),
+		Collection: make(map[string]*TreeCollection),
 	}
 }
 
-func (s *Schema) GetCollection(name string) (TreeCollection, error) {
+func (s *Schema) GetCollection(name string) (*TreeCollection, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	returnEl, ok := s.Collection[name]
 	if !ok {
-		return TreeCollection{}, errors.New("Элемент не найден!")
+		return nil, errors.New("Элемент не найден!")
 	}
 	return returnEl, nil
 }
 
-func (p *Pools) AddCollection(schemaName, collectionName string, collection TreeCollection) error {
-	schema, err := p.GetSchema(schemaName)
-	if err != nil {
-		return err
+// CollectionNames возвращает имена всех коллекций схемы.
+func (s *Schema) CollectionNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.Collection))
+	for name := range s.Collection {
+		names = append(names, name)
 	}
+	return names
+}
 
+func (p *Pools) AddCollection(schemaName, collectionName string, collection *TreeCollection) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	schema, ok := p.schema[schemaName]
+	if !ok {
+		return errors.New("Элемент не найден!")
+	}
+
+	schema.mu.Lock()
+	defer schema.mu.Unlock()
 	if _, exists := schema.Collection[collectionName]; exists {
 		return errors.New("Коллекция с таким именем уже существует!")
 	}
 
 	schema.Collection[collectionName] = collection
 	fmt.Printf("Коллекция с именем %s добавлена в схему %s в пуле\n", collectionName, schemaName)
-	schema.ShowCollections()
+	schema.showCollections()
 	return nil
 }
 
 func (s *Schema) RemoveCollection(name string) {
-	if _, exists := s.Collection[name]; exists {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tc, exists := s.Collection[name]; exists {
+		tc.releaseStrings()
 		delete(s.Collection, name)
 		fmt.Println("Коллекция с именем", name, "удалена из схемы.")
 	} else {
 		fmt.Println("Коллекция с именем", name, "не найдена в схеме.")
 	}
-	s.ShowCollections()
+	s.showCollections()
 }
 
 func (s *Schema) ShowCollections() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.showCollections()
+}
+
+func (s *Schema) showCollections() {
 	fmt.Println("Текущие коллекции в схеме:")
 	for collectionName := range s.Collection {
 		fmt.Printf("  Коллекция: %s\n", collectionName)
 	}
 }
 
+// MarshalJSON сериализует коллекции схемы под разделяемой блокировкой.
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return json.Marshal(struct {
+		Collection map[string]*TreeCollection
+	}{s.Collection})
+}
+
 func (s *Schema) SaveToFile(filename string) error {
+	s.mu.RLock()
+	collections := make([]*TreeCollection, 0, len(s.Collection))
 	for _, collection := range s.Collection {
+		collections = append(collections, collection)
+	}
+	s.mu.RUnlock()
+
+	for _, collection := range collections {
 		if err := collection.SaveToFile(filename); err != nil {
 			return err
 		}